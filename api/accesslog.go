@@ -0,0 +1,422 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AccessLogFormat is the format of access log lines written to a sink, rather
+// than logged with the server's logger.
+type AccessLogFormat int
+
+// Formats of access log lines.
+const (
+	// CombinedLogFormat is the NCSA combined log format, as used by Apache.
+	CombinedLogFormat AccessLogFormat = iota
+	// JSONLogFormat writes each line as a JSON object.
+	JSONLogFormat
+)
+
+// AccessLogOption is a function that can be passed to AccessLogMW to modify
+// what is logged about each request, and how.
+type AccessLogOption func(*accessLogConfig)
+
+// accessLogConfig configures AccessLogMW.
+type accessLogConfig struct {
+	trustedProxies []*net.IPNet
+	maskedParams   map[string]bool
+	headers        []string
+	redactor       *Redactor
+	levels         map[int]zapcore.Level
+	format         AccessLogFormat
+	sink           io.Writer
+	sampler        *logSampler
+}
+
+// maskedValue replaces the values of masked query parameters.
+const maskedValue = "***"
+
+// AccessLogTrustedProxies sets the addresses of proxies, as IPs or CIDRs, that
+// are trusted to set the 'X-Forwarded-For' header. The client IP of requests
+// from trusted proxies is read from the header. By default, no proxies are
+// trusted, so the client IP is the request's remote address. It panics if an
+// address can't be parsed.
+func AccessLogTrustedProxies(proxies ...string) AccessLogOption {
+	nets := parseTrustedProxies(proxies)
+	return func(c *accessLogConfig) {
+		c.trustedProxies = append(c.trustedProxies, nets...)
+	}
+}
+
+// parseTrustedProxies parses the addresses of trusted proxies, as IPs or CIDRs.
+// It panics if an address can't be parsed.
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			panic(fmt.Sprintf("api: invalid trusted proxy %q: %v", p, err))
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// AccessLogMaskQuery masks the values of the given query parameters, i.e.
+// 'token', when logging the query string. The parameter '*' masks all values.
+func AccessLogMaskQuery(params ...string) AccessLogOption {
+	return func(c *accessLogConfig) {
+		for _, p := range params {
+			c.maskedParams[p] = true
+		}
+	}
+}
+
+// AccessLogHeaders logs the values of the given request headers, i.e.
+// 'Content-Type', as a 'headers' field. Headers that aren't set aren't logged.
+func AccessLogHeaders(names ...string) AccessLogOption {
+	return func(c *accessLogConfig) {
+		c.headers = append(c.headers, names...)
+	}
+}
+
+// AccessLogRedact redacts sensitive data from the lines logged, using rd. By
+// default, lines are redacted by the redactor of the server serving the
+// request, if any, see WithRedactor.
+func AccessLogRedact(rd *Redactor) AccessLogOption {
+	return func(c *accessLogConfig) {
+		c.redactor = rd
+	}
+}
+
+// AccessLogLevel sets the level requests with responses of the given status
+// class, i.e. 5 for 5XX, are logged at. By default, all requests are logged at
+// Info. Levels above Error are logged at Error.
+func AccessLogLevel(class int, level zapcore.Level) AccessLogOption {
+	return func(c *accessLogConfig) {
+		c.levels[class] = level
+	}
+}
+
+// AccessLogOutput writes access log lines in the given format to w, instead of
+// logging them with the server's logger. Writes to w are serialized.
+func AccessLogOutput(format AccessLogFormat, w io.Writer) AccessLogOption {
+	return func(c *accessLogConfig) {
+		c.format = format
+		c.sink = &lockedWriter{w: w}
+	}
+}
+
+// newAccessLogConfig returns the access log configuration defined by the given
+// options.
+func newAccessLogConfig(opts []AccessLogOption) *accessLogConfig {
+	c := &accessLogConfig{
+		maskedParams: make(map[string]bool),
+		levels:       make(map[int]zapcore.Level),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// AccessLogMW returns a middleware that logs a line describing each request
+// and its response, once it has been responded to. Lines include the client's
+// IP address, user agent and referer, the request's route and query string,
+// the number of bytes read and written, and the duration of the request, as
+// a string and in seconds.
+func AccessLogMW(logger *zap.SugaredLogger, opts ...AccessLogOption) Middleware {
+
+	cfg := newAccessLogConfig(opts)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Count the bytes of the request body that are read.
+			body := &countingReader{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+
+			defer func() {
+				// Retrieve detail state of this request
+				d := getDetails(r)
+				if d == nil {
+					// There's nothing more to do if we can't find the details.
+					return
+				}
+
+				duration := time.Since(d.Now)
+				if cfg.sampler != nil && !cfg.sampler.sample(d, duration) {
+					return
+				}
+
+				rd := cfg.redactor
+				if rd == nil {
+					rd = d.redactor
+				}
+
+				entry := accessLogEntry{
+					d:         d,
+					r:         r,
+					clientIP:  clientIP(r, cfg.trustedProxies),
+					path:      rd.String(r.URL.Path),
+					query:     rd.Query(maskQuery(r.URL.RawQuery, cfg.maskedParams)),
+					userAgent: rd.String(r.UserAgent()),
+					referer:   rd.URL(r.Referer()),
+					headers:   rd.Header(loggedHeaders(r.Header, cfg.headers)),
+					bytesIn:   body.n,
+					duration:  duration,
+				}
+
+				level := zapcore.InfoLevel
+				if l, ok := cfg.levels[d.StatusCode/100]; ok {
+					level = l
+				}
+
+				if cfg.sink != nil {
+					cfg.sink.Write(entry.line(cfg.format, level)) //nolint:errcheck
+					return
+				}
+
+				logAt(logger, level, "request", entry.fields()...)
+			}()
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// accessLogEntry is what is logged about a request.
+type accessLogEntry struct {
+	d         *details
+	r         *http.Request
+	clientIP  string
+	path      string
+	query     string
+	userAgent string
+	referer   string
+	headers   http.Header
+	bytesIn   int64
+	duration  time.Duration
+}
+
+// fields returns the entry as fields of a structured log line.
+func (e accessLogEntry) fields() []interface{} {
+	fields := []interface{}{
+		"request_id", e.d.RequestID,
+		"method", e.d.Method,
+		"path", e.path,
+		"route", e.d.RequestPath,
+		"status", e.d.StatusCode,
+		"duration", e.duration.String(),
+		"duration_seconds", e.duration.Seconds(),
+		"client_ip", e.clientIP,
+		"bytes_in", e.bytesIn,
+		"bytes_out", e.d.BytesWritten,
+	}
+	if e.query != "" {
+		fields = append(fields, "query", e.query)
+	}
+	if e.userAgent != "" {
+		fields = append(fields, "user_agent", e.userAgent)
+	}
+	if e.referer != "" {
+		fields = append(fields, "referer", e.referer)
+	}
+	if len(e.headers) > 0 {
+		fields = append(fields, "headers", e.headers)
+	}
+	return append(fields, append(versionFields(e.d), requestFields(e.d)...)...)
+}
+
+// line returns the entry as a line of the given format, including its newline.
+func (e accessLogEntry) line(format AccessLogFormat, level zapcore.Level) []byte {
+	if format == JSONLogFormat {
+		m := map[string]interface{}{
+			"time":  e.d.Now.UTC().Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   "request",
+		}
+		fields := e.fields()
+		for i := 0; i+1 < len(fields); i += 2 {
+			m[fields[i].(string)] = fields[i+1]
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			// All of the fields are strings, numbers or headers, so this should
+			// never happen.
+			return nil
+		}
+		return append(b, '\n')
+	}
+
+	// The combined log format, with '-' for missing values.
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	user := ""
+	if e.d.principal != nil {
+		user = e.d.principal.ID
+	}
+	uri := e.path
+	if e.query != "" {
+		uri += "?" + e.query
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		dash(e.clientIP),
+		dash(user),
+		e.d.Now.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.r.Method+" "+uri+" "+e.r.Proto),
+		e.d.StatusCode,
+		dash(strconv.FormatInt(e.d.BytesWritten, 10)),
+		strconv.Quote(dash(e.referer)),
+		strconv.Quote(dash(e.userAgent)),
+	))
+}
+
+// logAt logs the message with the given fields at the given level.
+func logAt(l *zap.SugaredLogger, level zapcore.Level, msg string, fields ...interface{}) {
+	switch level {
+	case zapcore.DebugLevel:
+		l.Debugw(msg, fields...)
+	case zapcore.InfoLevel:
+		l.Infow(msg, fields...)
+	case zapcore.WarnLevel:
+		l.Warnw(msg, fields...)
+	default:
+		l.Errorw(msg, fields...)
+	}
+}
+
+// clientIP returns the IP address of the client that made the request. If the
+// request was made by a trusted proxy, the client is the last address in the
+// 'X-Forwarded-For' header that wasn't added by a trusted proxy.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	// Walk back through the addresses the request was forwarded from.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrusted reports whether ip is within one of the trusted networks.
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskQuery returns the raw query string with the values of the given
+// parameters masked.
+func maskQuery(query string, masked map[string]bool) string {
+	if query == "" || len(masked) == 0 {
+		return query
+	}
+	parts := strings.Split(query, "&")
+	for i, part := range parts {
+		key := part
+		if j := strings.Index(part, "="); j >= 0 {
+			key = part[:j]
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if masked["*"] || masked[name] {
+			parts[i] = key + "=" + maskedValue
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// loggedHeaders returns the given headers of h that are set.
+func loggedHeaders(h http.Header, names []string) http.Header {
+	if len(names) == 0 {
+		return nil
+	}
+	logged := make(http.Header, len(names))
+	for _, name := range names {
+		if values := h.Values(name); len(values) > 0 {
+			logged[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return logged
+}
+
+// countingReader is a request body that counts the bytes read from it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read implements io.Reader.
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// lockedWriter serializes writes to a writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements io.Writer.
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// WithAccessLog configures the access log lines the server logs for requests to
+// endpoints that don't suppress logs, see AccessLogMW.
+func WithAccessLog(opts ...AccessLogOption) Option {
+	return func(s *server) {
+		s.accessLogOpts = append(s.accessLogOpts, opts...)
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// accessLogAPI returns an API with an endpoint that reads the request body,
+// and an endpoint that fails.
+func accessLogAPI() API {
+	return apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "POST",
+				Path:   "/items/:id",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ioutil.ReadAll(r.Body) //nolint:errcheck
+					Respond(w, r, http.StatusCreated, map[string]string{"id": URLParam(r, "id")})
+				}),
+			},
+			{
+				Method: "GET",
+				Path:   "/fail",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Error(w, r, "Oops", http.StatusServiceUnavailable)
+				}),
+			},
+		}
+	})
+}
+
+func TestAccessLogMW(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.DebugLevel)
+
+	srv := NewServer(":0", logger, accessLogAPI(), WithRegisterer(prometheus.NewRegistry()), WithAccessLog(
+		AccessLogTrustedProxies("10.0.0.0/8", "192.168.1.1"),
+		AccessLogMaskQuery("token"),
+		AccessLogLevel(5, zapcore.ErrorLevel),
+	))
+
+	r := httptest.NewRequest("POST", "/items/123?token=secret&page=2", strings.NewReader(`{"name":"thing"}`))
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 192.168.1.1")
+	r.Header.Set("User-Agent", "test-agent")
+	r.Header.Set("Referer", "https://example.com/")
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusCreated) // response code is 201.
+
+	is.Equal(logs.Len(), 1) // request is logged.
+	ll := logs.All()[0]
+	fields := ll.ContextMap()
+	is.Equal(ll.Level, zapcore.InfoLevel)                      // successful requests are logged at info.
+	is.Equal(fields["path"], "/items/123")                     // path is logged.
+	is.Equal(fields["route"], "/items/:id")                    // route is logged.
+	is.Equal(fields["query"], "token=***&page=2")              // query is logged, with masked values.
+	is.Equal(fields["client_ip"], "203.0.113.7")               // client ip is the last untrusted forwarded address.
+	is.Equal(fields["user_agent"], "test-agent")               // user agent is logged.
+	is.Equal(fields["referer"], "https://example.com/")        // referer is logged.
+	is.Equal(fields["bytes_in"], int64(16))                    // request bytes are logged.
+	is.Equal(fields["bytes_out"], int64(len(rr.Body.Bytes()))) // response bytes are logged.
+	_, ok := fields["duration_seconds"].(float64)
+	is.True(ok) // duration is logged as a number.
+
+	r = httptest.NewRequest("GET", "/fail", nil)
+	r.RemoteAddr = "203.0.113.9:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	ll = logs.All()[1]
+	is.Equal(ll.Level, zapcore.ErrorLevel)                // server errors are logged at the configured level.
+	is.Equal(ll.ContextMap()["client_ip"], "203.0.113.9") // forwarded addresses from untrusted clients are ignored.
+	_, ok = ll.ContextMap()["query"]
+	is.True(!ok) // empty query is not logged.
+}
+
+func TestAccessLogOutput(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.DebugLevel)
+
+	var combined, jsonl bytes.Buffer
+	a := NewServer(":0", logger, accessLogAPI(), WithRegisterer(prometheus.NewRegistry()), WithAccessLog(AccessLogOutput(CombinedLogFormat, &combined)))
+	b := NewServer(":0", logger, accessLogAPI(), WithRegisterer(prometheus.NewRegistry()), WithAccessLog(AccessLogOutput(JSONLogFormat, &jsonl), AccessLogMaskQuery("*")))
+
+	for _, h := range []http.Handler{a.Handler, b.Handler} {
+		r := httptest.NewRequest("POST", "/items/123?token=secret", strings.NewReader(`{}`))
+		r.RemoteAddr = "203.0.113.7:1234"
+		r.Header.Set("User-Agent", "test-agent")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	is.Equal(logs.Len(), 0) // lines are written to the sink, not the logger.
+
+	re := regexp.MustCompile(`^203\.0\.113\.7 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /items/123\?token=secret HTTP/1\.1" 201 12 "-" "test-agent"\n$`)
+	is.True(re.Match(combined.Bytes())) // combined log line is written.
+
+	var line map[string]interface{}
+	is.NoErr(json.Unmarshal(jsonl.Bytes(), &line))
+	is.Equal(line["msg"], "request")                  // json line is written.
+	is.Equal(line["level"], "info")                   // json line has a level.
+	is.Equal(line["route"], "/items/:id")             // json line has the route.
+	is.Equal(line["query"], "token=***")              // all query values are masked.
+	is.Equal(line["status"], float64(201))            // json line has the status.
+	is.Equal(line["bytes_in"], float64(2))            // json line has the request bytes.
+	is.True(strings.Count(jsonl.String(), "\n") == 1) // json line is a single line.
+}
@@ -25,7 +25,47 @@ type Endpoint struct {
 	SuppressLogs bool
 	// Flag to suppress endpoint appearing in exposed Prometheus metrics.
 	SuppressMetrics bool
+	// Flag to suppress tracing of endpoint requests, if the server traces requests.
+	SuppressTracing bool
+	// Flags to log, instrument and trace this endpoint, even if it belongs to a
+	// Group that suppresses them. They have no effect if the endpoint
+	// suppresses them itself.
+	KeepLogs    bool
+	KeepMetrics bool
+	KeepTracing bool
 	// The Cross Origin Resource Sharing middleware to add to this endpoint. If
 	// defined, this will also register the 'OPTIONS' method for this endpoint.
 	CorsMiddleware *CorsMiddleware
+	// The sampling policy of this endpoint's request logs. If nil, the server's
+	// policy, if any, is used.
+	LogSampling *LogSampling
+	// The rate limit of this endpoint. If nil, the server's rate limit, if any,
+	// is used.
+	RateLimit *RateLimit
+	// The permissions a caller must have to call this endpoint, checked after
+	// the endpoint specific middlewares, i.e. AuthMW. If nil, or empty, no
+	// permissions are required.
+	Requires *Requirement
+	// How the ETags of this endpoint's responses are computed by Respond. By
+	// default, ETags are only set if the handler supplies a version.
+	ETag ETagMode
+	// The caching policy of this endpoint's successful responses, set in
+	// their 'Cache-Control' header by Respond.
+	CacheControl *CacheControl
+	// The idempotency policy of this endpoint. If set, retries of unsafe
+	// requests with the same 'Idempotency-Key' header are responded to with
+	// the first request's response.
+	Idempotency *Idempotency
+	// The version of this endpoint, if versioned. Endpoints with the same
+	// method and path, but different versions, can be served side-by-side,
+	// with requests routed to a version as set by WithVersioning.
+	Version string
+	// If set, this endpoint is deprecated, which is advertised in the
+	// 'Deprecation' and 'Sunset' headers of its responses.
+	Deprecation *Deprecation
+	// Documentation of this endpoint, used when generating an OpenAPI document.
+	Operation *Operation
+	// The maximum size, in bytes, of this endpoint's request bodies. If zero,
+	// the server's maximum is used. If negative, request bodies are not limited.
+	MaxBodyBytes int64
 }
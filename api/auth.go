@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request doesn't
+// include the credentials it authenticates, so another Authenticator may be tried.
+var ErrNoCredentials = errors.New("api: no credentials")
+
+// ErrInvalidCredentials is returned, possibly wrapped, by an Authenticator when
+// the request's credentials are invalid, i.e. an unknown API key or an expired
+// token.
+var ErrInvalidCredentials = errors.New("api: invalid credentials")
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// ID identifies the caller, i.e. the subject of a token, or a username.
+	ID string
+	// Method is how the caller was authenticated, i.e. 'jwt', 'api_key' or 'basic'.
+	Method string
+	// Claims are any other attributes of the caller, i.e. the claims of a token.
+	Claims map[string]interface{}
+}
+
+// PrincipalFromRequest returns the authenticated caller of the given request,
+// if there is one.
+func PrincipalFromRequest(r *http.Request) (*Principal, bool) {
+	return PrincipalFromContext(r.Context())
+}
+
+// PrincipalFromContext returns the authenticated caller of the request the
+// given context belongs to, if there is one.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	d, ok := ctx.Value(keyDetails).(*details)
+	if !ok || d.principal == nil {
+		return nil, false
+	}
+	return d.principal, true
+}
+
+// PrincipalID returns the ID of the authenticated caller of the request the
+// given context belongs to. It can be used with KeyByIdentity to rate limit
+// requests by caller.
+func PrincipalID(ctx context.Context) (string, bool) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return p.ID, true
+}
+
+// Authenticator authenticates the caller of a request from its credentials.
+type Authenticator interface {
+	// Authenticate returns the caller of the request. It returns
+	// ErrNoCredentials if the request has no credentials of the kind it
+	// authenticates, and an error wrapping ErrInvalidCredentials if they are
+	// invalid. Any other error means authentication could not be attempted.
+	Authenticate(r *http.Request) (*Principal, error)
+	// Challenge returns the 'WWW-Authenticate' header value telling clients how
+	// to authenticate, describing err if it is not nil.
+	Challenge(err error) string
+}
+
+// AuthMW returns a middleware that requires requests to be authenticated by
+// one of the given authenticators, which are tried in order. The caller is
+// placed into the request's context, and can be retrieved with
+// PrincipalFromRequest.
+//
+// Requests without valid credentials are responded to with a 401 Unauthorized
+// problem, including a 'WWW-Authenticate' header for each authenticator that
+// could have authenticated the request.
+func AuthMW(authenticators ...Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, a := range authenticators {
+				p, err := a.Authenticate(r)
+				switch {
+				case err == nil:
+					if d := getDetails(r); d != nil {
+						d.principal = p
+					} else {
+						// Without details, keep the principal in the context instead.
+						r = r.WithContext(context.WithValue(r.Context(), keyDetails, &details{principal: p}))
+					}
+					next.ServeHTTP(w, r)
+					return
+				case errors.Is(err, ErrNoCredentials):
+					continue
+				case errors.Is(err, ErrInvalidCredentials):
+					w.Header().Add("WWW-Authenticate", a.Challenge(err))
+					Error(w, r, "Credentials are invalid", http.StatusUnauthorized)
+					return
+				default:
+					// The credentials could not be checked, which isn't the client's fault.
+					SpanFromRequest(r).RecordError(err)
+					Error(w, r, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			// No authenticator found any credentials.
+			for _, a := range authenticators {
+				w.Header().Add("WWW-Authenticate", a.Challenge(nil))
+			}
+			Error(w, r, "Credentials are required", http.StatusUnauthorized)
+		})
+	}
+}
+
+//
+// API keys
+//
+
+// APIKeyLookup returns the caller identified by an API key, or an error
+// wrapping ErrInvalidCredentials if the key is unknown.
+type APIKeyLookup func(ctx context.Context, key string) (*Principal, error)
+
+// apiKeyAuthenticator authenticates requests by an API key in a header.
+type apiKeyAuthenticator struct {
+	header string
+	lookup APIKeyLookup
+}
+
+// APIKeyAuthenticator returns an Authenticator of API keys, sent in the given
+// header, i.e. 'X-API-Key'. Keys are checked with the given lookup, i.e.
+// StaticAPIKeys or HashedAPIKeys.
+func APIKeyAuthenticator(header string, lookup APIKeyLookup) Authenticator {
+	return &apiKeyAuthenticator{header: header, lookup: lookup}
+}
+
+// Authenticate implements Authenticator.
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(a.header)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	p, err := a.lookup(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	p.Method = "api_key"
+	return p, nil
+}
+
+// Challenge implements Authenticator.
+func (a *apiKeyAuthenticator) Challenge(err error) string {
+	return fmt.Sprintf("APIKey header=%q", a.header)
+}
+
+// StaticAPIKeys returns an APIKeyLookup of the given keys, mapped to the ID of
+// the caller they identify. Keys are compared in constant time.
+func StaticAPIKeys(keys map[string]string) APIKeyLookup {
+	hashes := make(map[string]string, len(keys))
+	for k, id := range keys {
+		hashes[hashAPIKey(k)] = id
+	}
+	return HashedAPIKeys(hashes)
+}
+
+// HashedAPIKeys returns an APIKeyLookup of keys, given as their hex encoded
+// SHA-256 hashes, mapped to the ID of the caller they identify. This allows
+// keys to be configured without being stored in plain text.
+func HashedAPIKeys(hashes map[string]string) APIKeyLookup {
+	normalized := make(map[string]string, len(hashes))
+	for h, id := range hashes {
+		normalized[strings.ToLower(h)] = id
+	}
+	return func(ctx context.Context, key string) (*Principal, error) {
+		id, ok := normalized[hashAPIKey(key)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+		}
+		return &Principal{ID: id}, nil
+	}
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash of an API key. Looking up
+// keys by their hash means the time taken doesn't depend on how much of a key
+// is correct.
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+//
+// Basic
+//
+
+// BasicLookup returns the caller identified by a username and password, or an
+// error wrapping ErrInvalidCredentials if they are incorrect.
+type BasicLookup func(ctx context.Context, username, password string) (*Principal, error)
+
+// basicAuthenticator authenticates requests using HTTP Basic authentication.
+type basicAuthenticator struct {
+	realm  string
+	lookup BasicLookup
+}
+
+// BasicAuthenticator returns an Authenticator of HTTP Basic credentials, as
+// defined by RFC 7617, checked with the given lookup, i.e. StaticBasicUsers.
+func BasicAuthenticator(realm string, lookup BasicLookup) Authenticator {
+	return &basicAuthenticator{realm: realm, lookup: lookup}
+}
+
+// Authenticate implements Authenticator.
+func (a *basicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if !hasAuthScheme(r, "Basic") {
+		return nil, ErrNoCredentials
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed basic credentials", ErrInvalidCredentials)
+	}
+	p, err := a.lookup(r.Context(), username, password)
+	if err != nil {
+		return nil, err
+	}
+	p.Method = "basic"
+	return p, nil
+}
+
+// Challenge implements Authenticator.
+func (a *basicAuthenticator) Challenge(err error) string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.realm)
+}
+
+// StaticBasicUsers returns a BasicLookup of the given usernames, mapped to their
+// passwords. Passwords are compared in constant time. The username is used as
+// the caller's ID.
+func StaticBasicUsers(users map[string]string) BasicLookup {
+	return func(ctx context.Context, username, password string) (*Principal, error) {
+		expected, ok := users[username]
+		// Always compare, so unknown users take as long as known ones.
+		given, want := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(expected))
+		if subtle.ConstantTimeCompare(given[:], want[:]) != 1 || !ok {
+			return nil, fmt.Errorf("%w: incorrect username or password", ErrInvalidCredentials)
+		}
+		return &Principal{ID: username}, nil
+	}
+}
+
+// hasAuthScheme reports whether the request's Authorization header uses the
+// given scheme, which is case insensitive.
+func hasAuthScheme(r *http.Request, scheme string) bool {
+	auth := r.Header.Get("Authorization")
+	return len(auth) > len(scheme) && strings.EqualFold(auth[:len(scheme)], scheme) && auth[len(scheme)] == ' '
+}
@@ -0,0 +1,388 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// signJWT returns a token with the given header and claims, signed with key.
+// If key is nil, the token is unsigned.
+func signJWT(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	alg := header["alg"].(string)
+	input := encode(header) + "." + encode(claims)
+	hash := jwtAlgorithms[alg]
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(input))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeJWKS writes a JSON Web Key Set of the given public keys to a temporary
+// file, returning its path.
+func writeJWKS(t *testing.T, rsaKey *rsa.PublicKey, ecKey *ecdsa.PublicKey) string {
+	t.Helper()
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64([]byte{1, 0, 1})},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "oct", "kid": "hmac", "k": b64([]byte("secret"))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": b64([]byte{1, 0, 1})},
+		},
+	}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeJWKS(t, &rsaKey.PublicKey, &ecKey.PublicKey)
+	defer os.Remove(path)
+
+	keys, err := NewFileKeySet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "alice", "iss": "kit", "aud": []string{"teapots"}, "exp": now + 60}
+
+	tests := []struct {
+		Name              string
+		Header            map[string]interface{}
+		Claims            map[string]interface{}
+		Key               interface{}
+		ExpectedID        string
+		ExpectedChallenge string
+	}{
+		{
+			Name:       "RS256",
+			Header:     map[string]interface{}{"alg": "RS256", "kid": "rsa"},
+			Claims:     valid,
+			Key:        rsaKey,
+			ExpectedID: "alice",
+		},
+		{
+			Name:       "ES256",
+			Header:     map[string]interface{}{"alg": "ES256", "kid": "ec"},
+			Claims:     valid,
+			Key:        ecKey,
+			ExpectedID: "alice",
+		},
+		{
+			Name:       "HS256",
+			Header:     map[string]interface{}{"alg": "HS256", "kid": "hmac"},
+			Claims:     valid,
+			Key:        []byte("secret"),
+			ExpectedID: "alice",
+		},
+		{
+			Name:              "wrong key",
+			Header:            map[string]interface{}{"alg": "RS256", "kid": "rsa"},
+			Claims:            valid,
+			Key:               otherKey,
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token signature is invalid"`,
+		},
+		{
+			Name:              "algorithm not matching key",
+			Header:            map[string]interface{}{"alg": "RS384", "kid": "rsa"},
+			Claims:            valid,
+			Key:               rsaKey,
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token algorithm does not match key"`,
+		},
+		{
+			Name:              "public key used as hmac secret",
+			Header:            map[string]interface{}{"alg": "HS256", "kid": "ec"},
+			Claims:            valid,
+			Key:               []byte("secret"),
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token signature is invalid"`,
+		},
+		{
+			Name:              "unknown key",
+			Header:            map[string]interface{}{"alg": "RS256", "kid": "enc"},
+			Claims:            valid,
+			Key:               rsaKey,
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token key is unknown"`,
+		},
+		{
+			Name:              "none algorithm",
+			Header:            map[string]interface{}{"alg": "none", "kid": "hmac"},
+			Claims:            valid,
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token algorithm is not allowed"`,
+		},
+		{
+			Name:              "expired",
+			Header:            map[string]interface{}{"alg": "HS256", "kid": "hmac"},
+			Claims:            map[string]interface{}{"sub": "alice", "iss": "kit", "aud": "teapots", "exp": now - 60},
+			Key:               []byte("secret"),
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token has expired"`,
+		},
+		{
+			Name:              "wrong audience",
+			Header:            map[string]interface{}{"alg": "HS256", "kid": "hmac"},
+			Claims:            map[string]interface{}{"sub": "alice", "iss": "kit", "aud": "kettles"},
+			Key:               []byte("secret"),
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token audience is not accepted"`,
+		},
+		{
+			Name:              "wrong issuer",
+			Header:            map[string]interface{}{"alg": "HS256", "kid": "hmac"},
+			Claims:            map[string]interface{}{"sub": "alice", "iss": "someone", "aud": "teapots"},
+			Key:               []byte("secret"),
+			ExpectedChallenge: `Bearer realm="teapots", error="invalid_token", error_description="token issuer is not accepted"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			a := JWTAuthenticator(JWTConfig{Keys: keys, Issuer: "kit", Audience: "teapots", Realm: "teapots"})
+
+			r, err := http.NewRequest("GET", "/", nil)
+			is.NoErr(err)
+			r.Header.Set("Authorization", "Bearer "+signJWT(t, tt.Header, tt.Claims, tt.Key))
+
+			p, err := a.Authenticate(r)
+			if tt.ExpectedID != "" {
+				is.NoErr(err)                    // token is valid.
+				is.Equal(p.ID, tt.ExpectedID)    // principal is the subject.
+				is.Equal(p.Method, "jwt")        // principal is authenticated by jwt.
+				is.Equal(p.Claims["iss"], "kit") // claims are kept.
+				return
+			}
+
+			is.True(err != nil)                              // token is invalid.
+			is.Equal(a.Challenge(err), tt.ExpectedChallenge) // challenge describes the error.
+		})
+	}
+}
+
+// authAPI returns an API with an endpoint requiring authentication, which logs
+// from its handler.
+func authAPI(logger *zap.SugaredLogger) API {
+	mw := AuthMW(
+		JWTAuthenticator(JWTConfig{Keys: StaticKeySet(JSONWebKey{Key: []byte("secret")}), Realm: "teapots"}),
+		APIKeyAuthenticator("X-API-Key", StaticAPIKeys(map[string]string{"teapot": "service"})),
+		BasicAuthenticator("teapots", StaticBasicUsers(map[string]string{"bob": "hunter2"})),
+	)
+
+	return apiFunc(func() []Endpoint {
+		return []Endpoint{{
+			Method: "GET",
+			Path:   "/private",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p, _ := PrincipalFromRequest(r)
+				LoggerFromRequest(r, logger).Info("from handler")
+				Respond(w, r, http.StatusOK, map[string]string{"id": p.ID, "method": p.Method})
+			}),
+			Middlewares: []Middleware{mw},
+		}}
+	})
+}
+
+func TestAuthMW(t *testing.T) {
+
+	token := signJWT(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "alice"}, []byte("secret"))
+
+	tests := []struct {
+		Name               string
+		Header             string
+		Value              string
+		ExpectedCode       int
+		ExpectedBody       string
+		ExpectedChallenges []string
+	}{
+		{
+			Name:         "bearer token",
+			Header:       "Authorization",
+			Value:        "Bearer " + token,
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"id":"alice","method":"jwt"}`,
+		},
+		{
+			Name:         "api key",
+			Header:       "X-API-Key",
+			Value:        "teapot",
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"id":"service","method":"api_key"}`,
+		},
+		{
+			Name:         "basic",
+			Header:       "Authorization",
+			Value:        "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:hunter2")),
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"id":"bob","method":"basic"}`,
+		},
+		{
+			Name:               "no credentials",
+			ExpectedCode:       http.StatusUnauthorized,
+			ExpectedBody:       `{"detail":"Credentials are required","status":401,"title":"Unauthorized","type":"about:blank"}`,
+			ExpectedChallenges: []string{`Bearer realm="teapots"`, `APIKey header="X-API-Key"`, `Basic realm="teapots", charset="UTF-8"`},
+		},
+		{
+			Name:               "invalid token",
+			Header:             "Authorization",
+			Value:              "Bearer " + token + "x",
+			ExpectedCode:       http.StatusUnauthorized,
+			ExpectedBody:       `{"detail":"Credentials are invalid","status":401,"title":"Unauthorized","type":"about:blank"}`,
+			ExpectedChallenges: []string{`Bearer realm="teapots", error="invalid_token", error_description="token signature is invalid"`},
+		},
+		{
+			Name:               "unknown api key",
+			Header:             "X-API-Key",
+			Value:              "kettle",
+			ExpectedCode:       http.StatusUnauthorized,
+			ExpectedBody:       `{"detail":"Credentials are invalid","status":401,"title":"Unauthorized","type":"about:blank"}`,
+			ExpectedChallenges: []string{`APIKey header="X-API-Key"`},
+		},
+		{
+			Name:               "wrong password",
+			Header:             "Authorization",
+			Value:              "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:hunter3")),
+			ExpectedCode:       http.StatusUnauthorized,
+			ExpectedBody:       `{"detail":"Credentials are invalid","status":401,"title":"Unauthorized","type":"about:blank"}`,
+			ExpectedChallenges: []string{`Basic realm="teapots", charset="UTF-8"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger, and captured logs.
+			logger, logs := newTestLogger(zap.InfoLevel)
+
+			srv := NewServer(":0", logger, authAPI(logger), WithRegisterer(prometheus.NewRegistry()))
+
+			r, err := http.NewRequest("GET", "/private", nil)
+			is.NoErr(err)
+			if tt.Header != "" {
+				r.Header.Set(tt.Header, tt.Value)
+			}
+
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode)                               // response code is as expected.
+			is.Equal(rr.Body.String(), tt.ExpectedBody)                      // response body is as expected.
+			is.Equal(rr.Header()["Www-Authenticate"], tt.ExpectedChallenges) // challenges are as expected.
+
+			// Check the principal is logged, if authenticated.
+			for _, ll := range logs.All() {
+				id, ok := ll.ContextMap()["principal_id"]
+				is.Equal(ok, tt.ExpectedCode == http.StatusOK) // principal is logged if authenticated.
+				if ok {
+					is.True(strings.Contains(tt.ExpectedBody, fmt.Sprintf("%q", id))) // logged principal is the caller.
+				}
+			}
+		})
+	}
+}
+
+func TestHashedAPIKeys(t *testing.T) {
+
+	is := is.New(t)
+
+	// Hashes are accepted in either case.
+	lookup := HashedAPIKeys(map[string]string{strings.ToUpper(hashAPIKey("teapot")): "service"})
+
+	p, err := lookup(context.Background(), "teapot")
+	is.NoErr(err)             // key is known.
+	is.Equal(p.ID, "service") // caller is identified by the key.
+
+	_, err = lookup(context.Background(), "kettle")
+	is.True(errors.Is(err, ErrInvalidCredentials)) // unknown keys are invalid.
+}
+
+func TestParseJWKS(t *testing.T) {
+
+	is := is.New(t)
+
+	_, err := ParseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"bad","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	is.True(err != nil) // points not on the curve are rejected.
+
+	keys, err := ParseJWKS([]byte(`{"keys":[{"kty":"OKP","kid":"ed","crv":"Ed25519","x":"AQ"}]}`))
+	is.NoErr(err)          // unsupported key types are skipped.
+	is.Equal(len(keys), 0) // no keys are parsed.
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Match is how many of a list of permissions are required.
+type Match int
+
+// Ways of matching permissions.
+const (
+	// AllOf requires every one of the permissions.
+	AllOf Match = iota
+	// AnyOf requires at least one of the permissions.
+	AnyOf
+)
+
+// Requirement declares the permissions a caller must have to call an endpoint.
+type Requirement struct {
+	// Scopes are the scopes required, i.e. 'orders:write'.
+	Scopes []string
+	// Roles are the roles required, i.e. 'admin'.
+	Roles []string
+	// Match is whether all, or any one, of the Scopes are required, and
+	// likewise of the Roles. Scopes and Roles must both be met. By default, all
+	// are required.
+	Match Match
+}
+
+// IsZero reports whether the requirement doesn't require any permissions.
+func (req Requirement) IsZero() bool {
+	return len(req.Scopes) == 0 && len(req.Roles) == 0
+}
+
+// MetBy reports whether a caller with the given grants meets the requirement.
+func (req Requirement) MetBy(g Grants) bool {
+	return req.matches(req.Scopes, g.Scopes) && req.matches(req.Roles, g.Roles)
+}
+
+// matches reports whether the granted permissions include the required ones.
+func (req Requirement) matches(required, granted []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	has := make(map[string]bool, len(granted))
+	for _, p := range granted {
+		has[p] = true
+	}
+	for _, p := range required {
+		if has[p] && req.Match == AnyOf {
+			return true
+		}
+		if !has[p] && req.Match == AllOf {
+			return false
+		}
+	}
+	return req.Match == AllOf
+}
+
+// Grants are the permissions a caller has.
+type Grants struct {
+	Scopes []string
+	Roles  []string
+}
+
+// GrantsLookup returns the permissions of the caller of the request the given
+// context belongs to, if the caller is known.
+type GrantsLookup func(ctx context.Context) (Grants, bool)
+
+// GrantsFromPrincipal is a GrantsLookup of the authenticated caller's
+// permissions, as placed into the context by AuthMW. Scopes are read from the
+// 'scope' claim, a space separated string as defined by RFC 8693, or the 'scp'
+// claim, and roles from the 'roles' claim.
+func GrantsFromPrincipal(ctx context.Context) (Grants, bool) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return Grants{}, false
+	}
+	g := Grants{
+		Scopes: claimStrings(p.Claims["scope"]),
+		Roles:  claimStrings(p.Claims["roles"]),
+	}
+	if len(g.Scopes) == 0 {
+		g.Scopes = claimStrings(p.Claims["scp"])
+	}
+	return g, true
+}
+
+// claimStrings returns the values of a claim that is either a space separated
+// string, or a list of strings.
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			if e, ok := e.(string); ok {
+				s = append(s, e)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// Policy decides whether the caller of a request may call an endpoint, allowing
+// the decision to be made by i.e. an external policy engine.
+type Policy interface {
+	// Authorize reports whether the caller of the request, with the given grants,
+	// may call an endpoint with the given requirement. An error means a decision
+	// could not be made.
+	Authorize(r *http.Request, req Requirement, g Grants) (bool, error)
+}
+
+// PolicyFunc is an adapter to allow the use of ordinary functions as a Policy.
+type PolicyFunc func(r *http.Request, req Requirement, g Grants) (bool, error)
+
+// Authorize implements Policy.
+func (f PolicyFunc) Authorize(r *http.Request, req Requirement, g Grants) (bool, error) {
+	return f(r, req, g)
+}
+
+// RequirementPolicy is a Policy that allows callers whose grants meet an
+// endpoint's requirement.
+var RequirementPolicy Policy = PolicyFunc(func(r *http.Request, req Requirement, g Grants) (bool, error) {
+	return req.MetBy(g), nil
+})
+
+// RequirementFromRequest returns the permissions required to call the endpoint
+// handling the given request, if it declares any.
+func RequirementFromRequest(r *http.Request) (Requirement, bool) {
+	d := getDetails(r)
+	if d == nil || d.requirement == nil {
+		return Requirement{}, false
+	}
+	return *d.requirement, true
+}
+
+// AuthorizeMW returns a middleware that only allows callers with the given
+// requirement to call an endpoint, as decided by the given policy. The
+// caller's permissions are found using the given lookup. If lookup is nil,
+// GrantsFromPrincipal is used, and if policy is nil, RequirementPolicy is used.
+//
+// Requests from callers that aren't allowed are responded to with a 403
+// Forbidden problem, or a 401 Unauthorized problem if the caller isn't known,
+// so that clients know to authenticate.
+func AuthorizeMW(req Requirement, lookup GrantsLookup, policy Policy) Middleware {
+	if lookup == nil {
+		lookup = GrantsFromPrincipal
+	}
+	if policy == nil {
+		policy = RequirementPolicy
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if d := getDetails(r); d != nil {
+				d.requirement = &req
+			}
+
+			// Callers that aren't known have no permissions.
+			g, known := lookup(r.Context())
+
+			ok, err := policy.Authorize(r, req, g)
+			if err != nil {
+				// The decision could not be made, which isn't the client's fault.
+				SpanFromRequest(r).RecordError(err)
+				Error(w, r, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if !ok && !known {
+				Error(w, r, "Credentials are required", http.StatusUnauthorized)
+				return
+			}
+			if !ok {
+				Error(w, r, "Insufficient permissions", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithAuthorization sets how endpoints' requirements are enforced, with the
+// given lookup of callers' permissions and policy. If either is nil, the
+// default is used, see AuthorizeMW.
+func WithAuthorization(lookup GrantsLookup, policy Policy) Option {
+	return func(s *server) {
+		s.grantsLookup = lookup
+		s.policy = policy
+	}
+}
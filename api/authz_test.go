@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestRequirementMetBy(t *testing.T) {
+
+	tests := []struct {
+		Name        string
+		Requirement Requirement
+		Grants      Grants
+		Expected    bool
+	}{
+		{
+			Name:        "nothing required",
+			Requirement: Requirement{},
+			Expected:    true,
+		},
+		{
+			Name:        "all scopes granted",
+			Requirement: Requirement{Scopes: []string{"read", "write"}},
+			Grants:      Grants{Scopes: []string{"write", "read", "delete"}},
+			Expected:    true,
+		},
+		{
+			Name:        "some scopes granted",
+			Requirement: Requirement{Scopes: []string{"read", "write"}},
+			Grants:      Grants{Scopes: []string{"read"}},
+			Expected:    false,
+		},
+		{
+			Name:        "any scope granted",
+			Requirement: Requirement{Scopes: []string{"read", "write"}, Match: AnyOf},
+			Grants:      Grants{Scopes: []string{"write"}},
+			Expected:    true,
+		},
+		{
+			Name:        "no scope granted",
+			Requirement: Requirement{Scopes: []string{"read", "write"}, Match: AnyOf},
+			Grants:      Grants{Scopes: []string{"delete"}, Roles: []string{"read"}},
+			Expected:    false,
+		},
+		{
+			Name:        "scopes but not roles granted",
+			Requirement: Requirement{Scopes: []string{"read"}, Roles: []string{"admin", "owner"}, Match: AnyOf},
+			Grants:      Grants{Scopes: []string{"read"}, Roles: []string{"viewer"}},
+			Expected:    false,
+		},
+		{
+			Name:        "scopes and roles granted",
+			Requirement: Requirement{Scopes: []string{"read"}, Roles: []string{"admin", "owner"}, Match: AnyOf},
+			Grants:      Grants{Scopes: []string{"read"}, Roles: []string{"owner"}},
+			Expected:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tt.Requirement.MetBy(tt.Grants), tt.Expected) // requirement is met as expected.
+		})
+	}
+}
+
+func TestEndpointRequires(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	auth := AuthMW(JWTAuthenticator(JWTConfig{Keys: StaticKeySet(JSONWebKey{Key: []byte("secret")})}))
+
+	var required Requirement
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required, _ = RequirementFromRequest(r)
+		Respond(w, r, http.StatusOK, nil)
+	})
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/orders", Handler: h, Middlewares: []Middleware{auth}, Requires: &Requirement{Scopes: []string{"orders:read"}}},
+			{Method: "DELETE", Path: "/orders", Handler: h, Middlewares: []Middleware{auth}, Requires: &Requirement{Roles: []string{"admin", "owner"}, Match: AnyOf}},
+			{Method: "GET", Path: "/public", Handler: h, Requires: &Requirement{}},
+			{Method: "GET", Path: "/reports", Handler: h, Requires: &Requirement{Scopes: []string{"reports:read"}}},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()))
+
+	// do makes a request with a token with the given claims.
+	do := func(method, path string, claims map[string]interface{}) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, nil)
+		is.NoErr(err)
+		claims["sub"] = "alice"
+		r.Header.Set("Authorization", "Bearer "+signJWT(t, map[string]interface{}{"alg": "HS256"}, claims, []byte("secret")))
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := do("GET", "/orders", map[string]interface{}{"scope": "orders:read orders:write"})
+	is.Equal(rr.Code, http.StatusOK)                   // caller with the scope is allowed.
+	is.Equal(required.Scopes, []string{"orders:read"}) // handler can find the endpoint's requirement.
+	rr = do("GET", "/orders", map[string]interface{}{"scp": []string{"orders:read"}})
+	is.Equal(rr.Code, http.StatusOK) // scopes can be given as a list.
+
+	rr = do("GET", "/orders", map[string]interface{}{"scope": "orders:write"})
+	is.Equal(rr.Code, http.StatusForbidden)                                                                                   // caller without the scope is forbidden.
+	is.Equal(rr.Body.String(), `{"detail":"Insufficient permissions","status":403,"title":"Forbidden","type":"about:blank"}`) // problem is responded with.
+
+	rr = do("DELETE", "/orders", map[string]interface{}{"roles": []string{"viewer", "owner"}})
+	is.Equal(rr.Code, http.StatusOK) // caller with any of the roles is allowed.
+	rr = do("DELETE", "/orders", map[string]interface{}{"roles": []string{"viewer"}})
+	is.Equal(rr.Code, http.StatusForbidden) // caller with none of the roles is forbidden.
+
+	rr = do("GET", "/public", map[string]interface{}{})
+	is.Equal(rr.Code, http.StatusOK) // empty requirements allow anyone.
+
+	rr = do("GET", "/reports", map[string]interface{}{"scope": "reports:read"})
+	is.Equal(rr.Code, http.StatusUnauthorized)                                                                                   // caller that wasn't authenticated is unauthorized.
+	is.Equal(rr.Body.String(), `{"detail":"Credentials are required","status":401,"title":"Unauthorized","type":"about:blank"}`) // problem is responded with.
+}
+
+func TestWithAuthorization(t *testing.T) {
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	type grantsKey struct{}
+
+	// Callers are identified by a header, and decisions are made by a policy
+	// that can fail.
+	identify := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if role := r.Header.Get("X-Role"); role != "" {
+				r = r.WithContext(context.WithValue(r.Context(), grantsKey{}, Grants{Roles: []string{role}}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	lookup := func(ctx context.Context) (Grants, bool) {
+		g, ok := ctx.Value(grantsKey{}).(Grants)
+		return g, ok
+	}
+	policy := PolicyFunc(func(r *http.Request, req Requirement, g Grants) (bool, error) {
+		if r.Header.Get("X-Fail") != "" {
+			return false, errors.New("policy engine unavailable")
+		}
+		if r.Header.Get("X-Anonymous") != "" {
+			return true, nil
+		}
+		return req.MetBy(g), nil
+	})
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{{
+			Method:      "GET",
+			Path:        "/admin",
+			Handler:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { Respond(w, r, http.StatusOK, nil) }),
+			Middlewares: []Middleware{identify},
+			Requires:    &Requirement{Roles: []string{"admin"}},
+		}}
+	}), WithRegisterer(prometheus.NewRegistry()), WithAuthorization(lookup, policy))
+
+	tests := []struct {
+		Name         string
+		Headers      map[string]string
+		ExpectedCode int
+	}{
+		{Name: "allowed", Headers: map[string]string{"X-Role": "admin"}, ExpectedCode: http.StatusOK},
+		{Name: "denied", Headers: map[string]string{"X-Role": "viewer"}, ExpectedCode: http.StatusForbidden},
+		{Name: "unknown caller", ExpectedCode: http.StatusUnauthorized},
+		{Name: "unknown caller allowed by policy", Headers: map[string]string{"X-Anonymous": "1"}, ExpectedCode: http.StatusOK},
+		{Name: "policy error", Headers: map[string]string{"X-Role": "admin", "X-Fail": "1"}, ExpectedCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			r, err := http.NewRequest("GET", "/admin", nil)
+			is.NoErr(err)
+			for k, v := range tt.Headers {
+				r.Header.Set(k, v)
+			}
+
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode) // response code is as expected.
+		})
+	}
+}
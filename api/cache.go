@@ -0,0 +1,336 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETagMode is how the ETag of a response is computed by Respond.
+type ETagMode int
+
+// Ways of computing ETags.
+const (
+	// NoETag doesn't compute ETags, unless a handler supplies a version.
+	NoETag ETagMode = iota
+	// StrongETag computes strong ETags, which change whenever the response body
+	// does.
+	StrongETag
+	// WeakETag computes weak ETags, which only claim responses are equivalent,
+	// i.e. if their encoding may differ.
+	WeakETag
+)
+
+// CacheControl describes how responses may be cached, as defined by RFC 7234.
+type CacheControl struct {
+	// MaxAge is how long the response is fresh for.
+	MaxAge time.Duration
+	// SharedMaxAge is how long the response is fresh for in shared caches, i.e.
+	// CDNs, if different from MaxAge.
+	SharedMaxAge time.Duration
+	// StaleWhileRevalidate is how long a stale response may be used for while it
+	// is revalidated in the background.
+	StaleWhileRevalidate time.Duration
+	// Public allows the response to be stored by shared caches.
+	Public bool
+	// Private only allows the response to be stored by the client's cache.
+	Private bool
+	// NoCache requires the response to be revalidated before each use.
+	NoCache bool
+	// NoStore stops the response being stored at all.
+	NoStore bool
+	// MustRevalidate stops the response being used once stale, without it
+	// being revalidated.
+	MustRevalidate bool
+	// Immutable means the response will not change while it's fresh.
+	Immutable bool
+}
+
+// String returns the value of the 'Cache-Control' header.
+func (c CacheControl) String() string {
+	var directives []string
+	add := func(ok bool, d string) {
+		if ok {
+			directives = append(directives, d)
+		}
+	}
+	add(c.Public, "public")
+	add(c.Private, "private")
+	add(c.NoCache, "no-cache")
+	add(c.NoStore, "no-store")
+	add(c.MaxAge > 0, fmt.Sprintf("max-age=%d", int(c.MaxAge.Seconds())))
+	add(c.SharedMaxAge > 0, fmt.Sprintf("s-maxage=%d", int(c.SharedMaxAge.Seconds())))
+	add(c.StaleWhileRevalidate > 0, fmt.Sprintf("stale-while-revalidate=%d", int(c.StaleWhileRevalidate.Seconds())))
+	add(c.MustRevalidate, "must-revalidate")
+	add(c.Immutable, "immutable")
+	return strings.Join(directives, ", ")
+}
+
+// PublicCache returns a CacheControl allowing responses to be cached by any
+// cache for the given duration.
+func PublicCache(maxAge time.Duration) *CacheControl {
+	return &CacheControl{Public: true, MaxAge: maxAge}
+}
+
+// PrivateCache returns a CacheControl allowing responses to be cached only by
+// the client, for the given duration.
+func PrivateCache(maxAge time.Duration) *CacheControl {
+	return &CacheControl{Private: true, MaxAge: maxAge}
+}
+
+// NoStore returns a CacheControl stopping responses from being cached.
+func NoStore() *CacheControl {
+	return &CacheControl{NoStore: true}
+}
+
+// CachingMW returns a middleware that makes Respond compute the ETag of
+// successful responses using the given mode, and set their 'Cache-Control'
+// header to cc, if not nil.
+//
+// Responses with an ETag, or a modification time set with SetLastModified, are
+// responded to with 304 Not Modified when the request's 'If-None-Match' or
+// 'If-Modified-Since' header shows the client already has the response.
+func CachingMW(mode ETagMode, cc *CacheControl) Middleware {
+	var cacheControl string
+	if cc != nil {
+		cacheControl = cc.String()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if d := getDetails(r); d != nil {
+				d.etagMode = mode
+				d.cacheControl = cacheControl
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SetVersion sets the version of the resource being responded with, from which
+// Respond computes its ETag, rather than from the response body. Versions
+// cheaply identify a resource's state, i.e. a revision number or update time.
+func SetVersion(r *http.Request, version string) {
+	if d := getDetails(r); d != nil {
+		d.version = version
+	}
+}
+
+// SetLastModified sets when the resource being responded with was last
+// modified. Respond includes this in the 'Last-Modified' header.
+func SetLastModified(r *http.Request, t time.Time) {
+	if d := getDetails(r); d != nil {
+		d.lastModified = t
+	}
+}
+
+// CheckPreconditions evaluates the request's conditional headers against the
+// current version and modification time of the resource, as defined by RFC
+// 7232. A zero version and time mean the resource doesn't exist.
+//
+// It should be called before a resource is modified, i.e. to implement
+// optimistic concurrency for PUT and PATCH requests using 'If-Match'. If a
+// precondition fails, a 412 Precondition Failed problem, or for GET and HEAD
+// requests a 304 Not Modified response, is responded with and false is
+// returned, in which case the handler should not respond.
+//
+// The version and modification time are also used by Respond, as if set with
+// SetVersion and SetLastModified.
+func CheckPreconditions(w http.ResponseWriter, r *http.Request, version string, lastModified time.Time) bool {
+	SetVersion(r, version)
+	SetLastModified(r, lastModified)
+
+	var etag string
+	if version != "" {
+		etag = formatETag(version, etagMode(r) == WeakETag)
+	}
+	exists := version != "" || !lastModified.IsZero()
+	lastModified = lastModified.Truncate(time.Second)
+
+	// The conditions are evaluated in the order defined by RFC 7232, section 6.
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !ifMatch(im, etag, exists) {
+			preconditionFailed(w, r)
+			return false
+		}
+	} else if t, ok := headerTime(r, "If-Unmodified-Since"); ok && !lastModified.IsZero() && lastModified.After(t) {
+		preconditionFailed(w, r)
+		return false
+	}
+
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if (strings.TrimSpace(inm) == "*" && exists) || matchETag(inm, etag, true) {
+			if safe {
+				notModified(w, r, etag, lastModified)
+			} else {
+				preconditionFailed(w, r)
+			}
+			return false
+		}
+	} else if t, ok := headerTime(r, "If-Modified-Since"); ok && safe && !lastModified.IsZero() && !lastModified.After(t) {
+		notModified(w, r, etag, lastModified)
+		return false
+	}
+
+	return true
+}
+
+// etagMode returns the ETag mode of the endpoint handling the request.
+func etagMode(r *http.Request) ETagMode {
+	if d := getDetails(r); d != nil {
+		return d.etagMode
+	}
+	return NoETag
+}
+
+// respondCached sets the caching headers of a response with the given code and
+// encoded body, and reports whether the client's copy of the response is still
+// valid, in which case a 304 Not Modified response has been responded with.
+func respondCached(w http.ResponseWriter, r *http.Request, code int, body []byte) bool {
+	d := getDetails(r)
+	if d == nil || code < 200 || code >= 300 {
+		return false
+	}
+
+	h := w.Header()
+	if d.cacheControl != "" && h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", d.cacheControl)
+	}
+
+	etag := h.Get("ETag")
+	if etag == "" {
+		switch {
+		case d.version != "":
+			etag = formatETag(d.version, d.etagMode == WeakETag)
+		case d.etagMode != NoETag && len(body) > 0:
+			sum := sha256.Sum256(body)
+			etag = formatETag(base64.RawURLEncoding.EncodeToString(sum[:16]), d.etagMode == WeakETag)
+		}
+		if etag != "" {
+			h.Set("ETag", etag)
+		}
+	}
+
+	lastModified := d.lastModified.Truncate(time.Second)
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// Only a full response to a GET or HEAD request can be replaced by 304.
+	if code != http.StatusOK || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" || !matchETag(inm, etag, true) {
+			return false
+		}
+	} else if t, ok := headerTime(r, "If-Modified-Since"); !ok || lastModified.IsZero() || lastModified.After(t) {
+		return false
+	}
+
+	notModified(w, r, etag, lastModified)
+	return true
+}
+
+// formatETag returns the ETag of the given version. Versions that can't be
+// used as an ETag as is are hashed.
+func formatETag(version string, weak bool) string {
+	for _, c := range version {
+		// Only these characters are allowed within an ETag, see RFC 7232.
+		if c != 0x21 && (c < 0x23 || c > 0x7e) {
+			sum := sha256.Sum256([]byte(version))
+			version = base64.RawURLEncoding.EncodeToString(sum[:16])
+			break
+		}
+	}
+	etag := `"` + version + `"`
+	if weak {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// matchETag reports whether etag matches one of the ETags in the given
+// 'If-Match' or 'If-None-Match' header value. Weak comparison ignores whether
+// ETags are weak, whereas strong comparison never matches weak ETags. An empty
+// etag means there is no current resource, so matches nothing.
+func matchETag(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if !weak && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch reports whether the resource, with the given ETag, matches the given
+// 'If-Match' header value, using strong comparison. '*' matches the resource if
+// it exists. Compression weakens the strong ETags of responses, so weak ETags
+// that are otherwise the resource's strong ETag also match.
+func ifMatch(header, etag string, exists bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return exists
+	}
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTime returns the time in the given header of the request, if valid.
+func headerTime(r *http.Request, name string) (time.Time, bool) {
+	v := r.Header.Get(name)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// notModified responds with 304 Not Modified, including the resource's
+// validators.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// Set status code value on request details so other middlewares can access it
+	if d := getDetails(r); d != nil {
+		d.StatusCode = http.StatusNotModified
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// preconditionFailed responds with a 412 Precondition Failed problem.
+func preconditionFailed(w http.ResponseWriter, r *http.Request) {
+	Error(w, r, "The resource has been modified", http.StatusPreconditionFailed)
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestCacheControl(t *testing.T) {
+
+	tests := []struct {
+		Name         string
+		CacheControl *CacheControl
+		Expected     string
+	}{
+		{Name: "public", CacheControl: PublicCache(time.Hour), Expected: "public, max-age=3600"},
+		{Name: "private", CacheControl: PrivateCache(time.Minute), Expected: "private, max-age=60"},
+		{Name: "no store", CacheControl: NoStore(), Expected: "no-store"},
+		{
+			Name:         "everything",
+			CacheControl: &CacheControl{Public: true, MaxAge: time.Minute, SharedMaxAge: time.Hour, StaleWhileRevalidate: 30 * time.Second, MustRevalidate: true, Immutable: true},
+			Expected:     "public, max-age=60, s-maxage=3600, stale-while-revalidate=30, must-revalidate, immutable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tt.CacheControl.String(), tt.Expected) // header value is as expected.
+		})
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	modified := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "GET",
+				Path:   "/strong",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Respond(w, r, http.StatusOK, map[string]string{"hello": "world"})
+				}),
+				ETag:         StrongETag,
+				CacheControl: PublicCache(time.Minute),
+			},
+			{
+				Method: "GET",
+				Path:   "/weak",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					SetLastModified(r, modified)
+					Respond(w, r, http.StatusOK, map[string]string{"hello": "world"})
+				}),
+				ETag: WeakETag,
+			},
+			{
+				Method: "GET",
+				Path:   "/missing",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					NotFound(w, r)
+				}),
+				ETag:         StrongETag,
+				CacheControl: PublicCache(time.Minute),
+			},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()))
+
+	// do makes a request with the given headers.
+	do := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", path, nil)
+		is.NoErr(err)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := do("/strong", nil)
+	etag := rr.Header().Get("ETag")
+	is.Equal(rr.Code, http.StatusOK)                                 // response code is 200.
+	is.True(len(etag) > 2 && etag[0] == '"')                         // strong etag is set.
+	is.Equal(rr.Header().Get("Cache-Control"), "public, max-age=60") // cache control is set.
+
+	rr = do("/strong", nil)
+	is.Equal(rr.Header().Get("ETag"), etag) // etag is stable.
+
+	rr = do("/strong", map[string]string{"If-None-Match": `"other", ` + etag})
+	is.Equal(rr.Code, http.StatusNotModified)                        // matching etag is not modified.
+	is.Equal(rr.Body.Len(), 0)                                       // no body is sent.
+	is.Equal(rr.Header().Get("ETag"), etag)                          // etag is still sent.
+	is.Equal(rr.Header().Get("Cache-Control"), "public, max-age=60") // cache control is still sent.
+	is.Equal(rr.Header().Get("Content-Type"), "")                    // content type isn't sent.
+
+	rr = do("/strong", map[string]string{"If-None-Match": "W/" + etag})
+	is.Equal(rr.Code, http.StatusNotModified) // weakened etag, i.e. by compression, still matches.
+
+	rr = do("/strong", map[string]string{"If-None-Match": `"other"`})
+	is.Equal(rr.Code, http.StatusOK) // other etags are modified.
+
+	rr = do("/weak", nil)
+	is.Equal(rr.Header().Get("ETag")[:3], `W/"`)                                // weak etag is set.
+	is.Equal(rr.Header().Get("Last-Modified"), "Fri, 01 Jan 2021 12:00:00 GMT") // last modified is set.
+
+	rr = do("/weak", map[string]string{"If-Modified-Since": "Fri, 01 Jan 2021 12:00:00 GMT"})
+	is.Equal(rr.Code, http.StatusNotModified) // unmodified since is not modified.
+	rr = do("/weak", map[string]string{"If-Modified-Since": "Fri, 01 Jan 2021 11:59:59 GMT"})
+	is.Equal(rr.Code, http.StatusOK) // modified since is modified.
+	rr = do("/weak", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Fri, 01 Jan 2021 12:00:00 GMT"})
+	is.Equal(rr.Code, http.StatusOK) // if-none-match takes precedence.
+
+	rr = do("/missing", nil)
+	is.Equal(rr.Code, http.StatusNotFound)         // response code is 404.
+	is.Equal(rr.Header().Get("ETag"), "")          // problems have no etag.
+	is.Equal(rr.Header().Get("Cache-Control"), "") // problems aren't cached.
+}
+
+func TestCheckPreconditions(t *testing.T) {
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// The resource, with a version that increments on each update.
+	var version int
+	var exists bool
+	modified := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, lastModified := "", time.Time{}
+		if exists {
+			current, lastModified = strconv.Itoa(version), modified
+		}
+		if !CheckPreconditions(w, r, current, lastModified) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			version++
+			exists = true
+			SetVersion(r, strconv.Itoa(version))
+		}
+		Respond(w, r, http.StatusOK, map[string]int{"version": version})
+	})
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/doc", Handler: h},
+			{Method: "PUT", Path: "/doc", Handler: h},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()))
+
+	tests := []struct {
+		Name         string
+		Method       string
+		Headers      map[string]string
+		ExpectedCode int
+		ExpectedETag string
+	}{
+		{Name: "update of missing resource", Method: "PUT", Headers: map[string]string{"If-Match": "*"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Name: "create if missing", Method: "PUT", Headers: map[string]string{"If-None-Match": "*"}, ExpectedCode: http.StatusOK, ExpectedETag: `"1"`},
+		{Name: "create if exists", Method: "PUT", Headers: map[string]string{"If-None-Match": "*"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Name: "update of current version", Method: "PUT", Headers: map[string]string{"If-Match": `"1"`}, ExpectedCode: http.StatusOK, ExpectedETag: `"2"`},
+		{Name: "update of stale version", Method: "PUT", Headers: map[string]string{"If-Match": `"1"`}, ExpectedCode: http.StatusPreconditionFailed},
+		{Name: "update with stale weak etag", Method: "PUT", Headers: map[string]string{"If-Match": `W/"1"`}, ExpectedCode: http.StatusPreconditionFailed},
+		{Name: "update with compressed etag", Method: "PUT", Headers: map[string]string{"If-Match": `W/"2"`}, ExpectedCode: http.StatusOK, ExpectedETag: `"3"`},
+		{Name: "update if unmodified", Method: "PUT", Headers: map[string]string{"If-Unmodified-Since": "Fri, 01 Jan 2021 12:00:00 GMT"}, ExpectedCode: http.StatusOK, ExpectedETag: `"4"`},
+		{Name: "update if unmodified before", Method: "PUT", Headers: map[string]string{"If-Unmodified-Since": "Fri, 01 Jan 2021 11:00:00 GMT"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Name: "get current version", Method: "GET", Headers: map[string]string{"If-None-Match": `"4"`}, ExpectedCode: http.StatusNotModified, ExpectedETag: `"4"`},
+		{Name: "get stale version", Method: "GET", Headers: map[string]string{"If-None-Match": `"3"`}, ExpectedCode: http.StatusOK, ExpectedETag: `"4"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			r, err := http.NewRequest(tt.Method, "/doc", nil)
+			is.NoErr(err)
+			for k, v := range tt.Headers {
+				r.Header.Set(k, v)
+			}
+
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode)                 // response code is as expected.
+			is.Equal(rr.Header().Get("ETag"), tt.ExpectedETag) // etag is as expected.
+			if rr.Code == http.StatusPreconditionFailed {
+				is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+			}
+		})
+	}
+}
+
+func TestCheckPreconditionsWithCompression(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	version := 1
+	items := make([]string, 500)
+	for i := range items {
+		items[i] = "item"
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !CheckPreconditions(w, r, strconv.Itoa(version), time.Time{}) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			version++
+			SetVersion(r, strconv.Itoa(version))
+		}
+		Respond(w, r, http.StatusOK, items)
+	})
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/doc", Handler: h},
+			{Method: "PUT", Path: "/doc", Handler: h},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()), WithCompression())
+
+	r := httptest.NewRequest("GET", "/doc", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Header().Get("Content-Encoding"), "gzip") // response is compressed.
+	is.Equal(rr.Header().Get("ETag"), `W/"1"`)            // compressed etag is weak.
+
+	r = httptest.NewRequest("PUT", "/doc", nil)
+	r.Header.Set("If-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusOK) // compressed etag matches the current version.
+
+	// A resource without a version, but that was modified, exists.
+	exists := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if CheckPreconditions(w, r, "", time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)) {
+			Respond(w, r, http.StatusOK, nil)
+		}
+	})
+	r = httptest.NewRequest("PUT", "/", nil)
+	r.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	exists.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusOK) // any etag matches a resource that exists.
+}
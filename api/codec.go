@@ -0,0 +1,461 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Media types of the codecs provided by this package.
+const (
+	MediaTypeJSON     = "application/json"
+	MediaTypeXML      = "application/xml"
+	MediaTypeForm     = "application/x-www-form-urlencoded"
+	MediaTypeMsgPack  = "application/msgpack"
+	MediaTypeProtobuf = "application/x-protobuf"
+)
+
+// ErrUnsupportedMediaType is returned by Decode when there is no codec for the
+// request's content type.
+var ErrUnsupportedMediaType = errors.New("api: unsupported media type")
+
+// Codec encodes and decodes request and response bodies of a media type.
+type Codec interface {
+	// Decode decodes the body read from r into v.
+	Decode(r io.Reader, v interface{}) error
+	// Encode encodes v as the body written to w.
+	Encode(w io.Writer, v interface{}) error
+}
+
+// codecs is a registry of codecs, keyed by media type. The order codecs are
+// registered in is kept, and is used when more than one codec is acceptable.
+type codecs struct {
+	types  []string
+	byType map[string]Codec
+}
+
+// defaultCodecs are used when a request has no codecs of its own, i.e. when it
+// isn't served by a server.
+var defaultCodecs = newCodecs()
+
+// newCodecs returns a codec registry with JSON registered.
+func newCodecs() *codecs {
+	c := &codecs{byType: make(map[string]Codec)}
+	c.register(MediaTypeJSON, JSONCodec{})
+	return c
+}
+
+// register adds the codec for the given media type, replacing any existing one.
+func (c *codecs) register(mediaType string, codec Codec) {
+	mediaType = strings.ToLower(mediaType)
+	if _, ok := c.byType[mediaType]; !ok {
+		c.types = append(c.types, mediaType)
+	}
+	c.byType[mediaType] = codec
+}
+
+// lookup returns the codec for the given media type, which may include
+// parameters. If there is no codec for the exact media type, the codec for its
+// structured syntax suffix is returned, i.e. the JSON codec for
+// 'application/problem+json'.
+func (c *codecs) lookup(mediaType string) (Codec, bool) {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, false
+	}
+
+	if codec, ok := c.byType[mt]; ok {
+		return codec, true
+	}
+
+	if i := strings.LastIndex(mt, "+"); i >= 0 {
+		codec, ok := c.byType["application/"+mt[i+1:]]
+		return codec, ok
+	}
+
+	return nil, false
+}
+
+// acceptRange is a single media range of an Accept header.
+type acceptRange struct {
+	mediaType string
+	raw       string
+	q         float64
+}
+
+// specificity returns how specific the media range is, where more specific
+// ranges take precedence.
+func (a acceptRange) specificity() int {
+	switch {
+	case a.mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(a.mediaType, "/*"):
+		return 1
+	}
+	return 2
+}
+
+// matches reports whether the given media type is within the media range.
+func (a acceptRange) matches(mediaType string) bool {
+	switch a.specificity() {
+	case 0:
+		return true
+	case 1:
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(a.mediaType, "*"))
+	}
+	return a.mediaType == mediaType
+}
+
+// parseAccept parses an Accept header into its media ranges, ordered by
+// preference.
+func parseAccept(accept string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+			delete(params, "q")
+		}
+
+		// Keep the media range without its quality, so parameters such as a
+		// version can be echoed in the response's content type.
+		raw := mt
+		if len(params) > 0 {
+			raw = mime.FormatMediaType(mt, params)
+		}
+
+		ranges = append(ranges, acceptRange{mediaType: mt, raw: raw, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return ranges[i].specificity() > ranges[j].specificity()
+	})
+
+	return ranges
+}
+
+// negotiate returns the media type and codec that best satisfy the given
+// Accept header. It returns false if no codec is acceptable.
+func (c *codecs) negotiate(accept string) (string, Codec, bool) {
+
+	// Anything is acceptable if there is no Accept header.
+	if strings.TrimSpace(accept) == "" {
+		mt := c.types[0]
+		return mt, c.byType[mt], true
+	}
+
+	ranges := parseAccept(accept)
+
+	// excluded reports whether a media type has explicitly been made unacceptable.
+	excluded := func(mt string) bool {
+		for _, ar := range ranges {
+			if ar.q == 0 && ar.specificity() == 2 && ar.mediaType == mt {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, ar := range ranges {
+		if ar.q <= 0 {
+			continue
+		}
+
+		if ar.specificity() == 2 {
+			if codec, ok := c.lookup(ar.mediaType); ok {
+				return ar.raw, codec, true
+			}
+			continue
+		}
+
+		// Wildcard ranges are satisfied by the first registered codec within them.
+		for _, mt := range c.types {
+			if ar.matches(mt) && !excluded(mt) {
+				return mt, c.byType[mt], true
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// supported returns all registered media types, for use in error messages.
+func (c *codecs) supported() string {
+	return strings.Join(c.types, ", ")
+}
+
+//
+// JSON
+//
+
+// JSONCodec encodes and decodes JSON bodies. It is registered with every server.
+type JSONCodec struct{}
+
+// Decode implements Codec.
+func (JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+//
+// XML
+//
+
+// XMLCodec encodes and decodes XML bodies.
+type XMLCodec struct{}
+
+// Decode implements Codec.
+func (XMLCodec) Decode(r io.Reader, v interface{}) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+// Encode implements Codec.
+func (XMLCodec) Encode(w io.Writer, v interface{}) error {
+	return xml.NewEncoder(w).Encode(v)
+}
+
+//
+// Protobuf
+//
+
+// ProtobufCodec encodes and decodes protocol buffer bodies. Values must
+// implement proto.Message.
+type ProtobufCodec struct{}
+
+// Decode implements Codec.
+func (ProtobufCodec) Decode(r io.Reader, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("api: cannot decode protobuf into %T, which is not a proto.Message", v)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// Encode implements Codec.
+func (ProtobufCodec) Encode(w io.Writer, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("api: cannot encode %T as protobuf, as it is not a proto.Message", v)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+//
+// Form
+//
+
+// FormCodec encodes and decodes URL encoded form bodies. Values may be
+// url.Values, a map of strings or string slices, or a struct whose fields are
+// named by their 'form' tags, falling back to their 'json' tags.
+type FormCodec struct{}
+
+// Decode implements Codec.
+func (FormCodec) Decode(r io.Reader, v interface{}) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case *url.Values:
+		*t = values
+		return nil
+	case *map[string][]string:
+		*t = values
+		return nil
+	case *map[string]string:
+		*t = make(map[string]string, len(values))
+		for k := range values {
+			(*t)[k] = values.Get(k)
+		}
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("api: cannot decode form into %T", v)
+	}
+
+	return forEachFormField(rv.Elem(), func(name string, f reflect.Value) error {
+		vs, ok := values[name]
+		if !ok {
+			return nil
+		}
+		return setFormField(f, vs)
+	})
+}
+
+// Encode implements Codec.
+func (FormCodec) Encode(w io.Writer, v interface{}) error {
+	values := url.Values{}
+
+	switch t := v.(type) {
+	case url.Values:
+		values = t
+	case map[string][]string:
+		values = t
+	case map[string]string:
+		for k, s := range t {
+			values.Set(k, s)
+		}
+	default:
+		rv := reflect.Indirect(reflect.ValueOf(v))
+		if rv.Kind() != reflect.Struct {
+			return fmt.Errorf("api: cannot encode %T as a form", v)
+		}
+		err := forEachFormField(rv, func(name string, f reflect.Value) error {
+			if f.Kind() == reflect.Slice {
+				for i := 0; i < f.Len(); i++ {
+					values.Add(name, fmt.Sprint(f.Index(i).Interface()))
+				}
+				return nil
+			}
+			values.Set(name, fmt.Sprint(f.Interface()))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, values.Encode())
+	return err
+}
+
+// forEachFormField calls fn with the form name and value of each exported
+// field of the struct value rv.
+func forEachFormField(rv reflect.Value, fn func(name string, f reflect.Value) error) error {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		tag := sf.Tag.Get("form")
+		if tag == "" {
+			tag = sf.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		name, _ := parseTag(tag)
+		if name == "" {
+			name = sf.Name
+		}
+
+		if err := fn(name, rv.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFormField sets the field f from the given form values.
+func setFormField(f reflect.Value, vs []string) error {
+	if f.Kind() == reflect.Slice {
+		s := reflect.MakeSlice(f.Type(), len(vs), len(vs))
+		for i, v := range vs {
+			if err := setFormValue(s.Index(i), v); err != nil {
+				return err
+			}
+		}
+		f.Set(s)
+		return nil
+	}
+	return setFormValue(f, vs[0])
+}
+
+// setFormValue sets the value f from the given string, converting it to the
+// kind of f.
+func setFormValue(f reflect.Value, v string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(v)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(v, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(v, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(v, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("api: cannot decode form value into %s", f.Type())
+	}
+	return nil
+}
+
+// WithCodec registers a codec for the given media type with the server, so
+// Decode can decode request bodies of that type, and Respond can encode
+// responses of that type when the request accepts it. JSON is always
+// registered, and is preferred when more than one codec is acceptable.
+func WithCodec(mediaType string, c Codec) Option {
+	return func(s *server) {
+		s.codecs.register(mediaType, c)
+	}
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestNegotiate(t *testing.T) {
+
+	// Create a registry with more than one codec.
+	cs := newCodecs()
+	cs.register(MediaTypeXML, XMLCodec{})
+	cs.register(MediaTypeMsgPack, MsgPackCodec{})
+
+	tests := []struct {
+		Name              string
+		Accept            string
+		ExpectedMediaType string
+		ExpectedOK        bool
+	}{
+		{"no accept header", "", "application/json", true},
+		{"any type", "*/*", "application/json", true},
+		{"exact type", "application/xml", "application/xml", true},
+		{"type wildcard", "application/*", "application/json", true},
+		{"highest quality wins", "application/json;q=0.5, application/xml;q=0.9", "application/xml", true},
+		{"specific beats wildcard", "*/*, application/msgpack", "application/msgpack", true},
+		{"excluded type skipped by wildcard", "application/json;q=0, */*;q=0.1", "application/xml", true},
+		{"structured syntax suffix", "application/vnd.teapot+json", "application/vnd.teapot+json", true},
+		{"parameters are kept", "application/vnd.teapot+json;version=2", "application/vnd.teapot+json; version=2", true},
+		{"unknown type", "text/csv", "", false},
+		{"zero quality", "application/json;q=0", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			mt, _, ok := cs.negotiate(tt.Accept)
+			is.Equal(ok, tt.ExpectedOK)        // negotiation outcome is as expected.
+			is.Equal(mt, tt.ExpectedMediaType) // media type is as expected.
+		})
+	}
+}
+
+func TestDecodeContentTypes(t *testing.T) {
+
+	type body struct {
+		Name  string   `json:"name" xml:"name"`
+		Cups  int      `json:"cups" xml:"cups"`
+		Lids  []string `json:"lids" xml:"lids"`
+		Hot   bool     `json:"hot" xml:"hot"`
+		Price float64  `json:"price" xml:"price"`
+	}
+
+	msgpack := &bytes.Buffer{}
+	err := MsgPackCodec{}.Encode(msgpack, body{"Brown Betty", 4, []string{"a", "b"}, true, 9.99})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name         string
+		ContentType  string
+		Body         string
+		ExpectedErr  error
+		ExpectedCode int
+	}{
+		{
+			Name:        "json",
+			ContentType: "application/json; charset=utf-8",
+			Body:        `{"name":"Brown Betty","cups":4,"lids":["a","b"],"hot":true,"price":9.99}`,
+		},
+		{
+			Name:        "xml",
+			ContentType: "application/xml",
+			Body:        `<body><name>Brown Betty</name><cups>4</cups><lids>a</lids><lids>b</lids><hot>true</hot><price>9.99</price></body>`,
+		},
+		{
+			Name:        "form",
+			ContentType: "application/x-www-form-urlencoded",
+			Body:        `name=Brown+Betty&cups=4&lids=a&lids=b&hot=true&price=9.99`,
+		},
+		{
+			Name:        "msgpack",
+			ContentType: "application/msgpack",
+			Body:        msgpack.String(),
+		},
+		{
+			Name:         "unsupported",
+			ContentType:  "text/csv",
+			Body:         `Brown Betty,4`,
+			ExpectedErr:  ErrUnsupportedMediaType,
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create a dummy request, with the codecs of a server.
+			r, err := newTestRequest("POST", "/teapot", strings.NewReader(tt.Body), "/:path")
+			is.NoErr(err)
+			r.Header.Set("Content-Type", tt.ContentType)
+
+			cs := newCodecs()
+			cs.register(MediaTypeXML, XMLCodec{})
+			cs.register(MediaTypeForm, FormCodec{})
+			cs.register(MediaTypeMsgPack, MsgPackCodec{})
+			getDetails(r).codecs = cs
+
+			// Create a response recorder, which satisfies http.ResponseWriter, to record the response.
+			rr := httptest.NewRecorder()
+
+			var b body
+			err = Decode(rr, r, &b)
+			is.Equal(err, tt.ExpectedErr) // decode error is as expected.
+
+			if tt.ExpectedErr != nil {
+				is.Equal(rr.Code, tt.ExpectedCode)                                    // response code is as expected.
+				is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+				return
+			}
+
+			is.Equal(b, body{"Brown Betty", 4, []string{"a", "b"}, true, 9.99}) // body is decoded.
+		})
+	}
+}
+
+func TestRespondNegotiation(t *testing.T) {
+
+	type body struct {
+		Name string `json:"name" xml:"name"`
+	}
+
+	tests := []struct {
+		Name                string
+		Accept              string
+		ExpectedCode        int
+		ExpectedContentType string
+		ExpectedBody        string
+	}{
+		{
+			Name:                "json by default",
+			ExpectedCode:        http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectedBody:        `{"name":"Brown Betty"}`,
+		},
+		{
+			Name:                "xml when accepted",
+			Accept:              "application/json;q=0.1, application/xml",
+			ExpectedCode:        http.StatusOK,
+			ExpectedContentType: "application/xml",
+			ExpectedBody:        `<body><name>Brown Betty</name></body>`,
+		},
+		{
+			Name:                "not acceptable",
+			Accept:              "text/csv",
+			ExpectedCode:        http.StatusNotAcceptable,
+			ExpectedContentType: "application/problem+json",
+			ExpectedBody:        `{"detail":"Accept must allow one of: application/json, application/xml","status":406,"title":"Not Acceptable","type":"about:blank"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger.
+			logger, _ := newTestLogger(zap.InfoLevel)
+
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Respond(w, r, http.StatusOK, body{"Brown Betty"})
+			})
+
+			// Create a server, with XML registered.
+			srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+				return []Endpoint{{Method: "GET", Path: "/teapot", Handler: h}}
+			}), WithRegisterer(prometheus.NewRegistry()), WithCodec(MediaTypeXML, XMLCodec{}))
+
+			r, err := http.NewRequest("GET", "/teapot", nil)
+			is.NoErr(err)
+			r.Header.Set("Accept", tt.Accept)
+
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode)                                // response code is as expected.
+			is.Equal(rr.Header().Get("Content-Type"), tt.ExpectedContentType) // content type is as expected.
+			is.Equal(rr.Body.String(), tt.ExpectedBody)                       // body is as expected.
+		})
+	}
+}
+
+func TestMsgPackCodec(t *testing.T) {
+
+	is := is.New(t)
+
+	type nested struct {
+		Values []interface{} `json:"values"`
+	}
+	type body struct {
+		Small    int               `json:"small"`
+		Negative int               `json:"negative"`
+		Large    int64             `json:"large"`
+		Float    float64           `json:"float"`
+		Text     string            `json:"text"`
+		Long     string            `json:"long"`
+		Nil      *string           `json:"nil"`
+		Map      map[string]string `json:"map"`
+		Nested   nested            `json:"nested"`
+		Data     []byte            `json:"data"`
+	}
+
+	in := body{
+		Small:    7,
+		Negative: -1000,
+		Large:    1 << 40,
+		Float:    3.25,
+		Text:     "teapot",
+		Long:     strings.Repeat("x", 300),
+		Map:      map[string]string{"a": "b"},
+		Nested:   nested{[]interface{}{true, false, "s"}},
+		Data:     []byte{0, 1, 2},
+	}
+
+	buf := &bytes.Buffer{}
+	is.NoErr(MsgPackCodec{}.Encode(buf, in)) // body is encoded.
+
+	is.Equal(buf.Bytes()[0], byte(0x80|10)) // body is encoded as a fixmap.
+
+	var out body
+	is.NoErr(MsgPackCodec{}.Decode(buf, &out)) // body is decoded.
+
+	// Compare JSON representations, as generic values decode differently.
+	a, _ := json.Marshal(in)
+	b, _ := json.Marshal(out)
+	is.Equal(string(a), string(b)) // body round trips.
+}
+
+func TestProtobufCodec(t *testing.T) {
+
+	is := is.New(t)
+
+	buf := &bytes.Buffer{}
+	is.NoErr(ProtobufCodec{}.Encode(buf, wrapperspb.String("teapot"))) // message is encoded.
+
+	var out wrapperspb.StringValue
+	is.NoErr(ProtobufCodec{}.Decode(buf, &out)) // message is decoded.
+	is.Equal(out.GetValue(), "teapot")          // message round trips.
+
+	is.True(ProtobufCodec{}.Encode(buf, "not a message") != nil) // non-messages cannot be encoded.
+}
+
+func TestFormCodecEncode(t *testing.T) {
+
+	is := is.New(t)
+
+	type body struct {
+		Name string   `form:"name"`
+		Cups int      `json:"cups"`
+		Lids []string `form:"lids"`
+		Skip string   `form:"-"`
+	}
+
+	buf := &bytes.Buffer{}
+	is.NoErr(FormCodec{}.Encode(buf, body{"Brown Betty", 4, []string{"a", "b"}, "x"})) // body is encoded.
+
+	values, err := url.ParseQuery(buf.String())
+	is.NoErr(err)                                                                            // body is a form.
+	is.Equal(values, url.Values{"name": {"Brown Betty"}, "cups": {"4"}, "lids": {"a", "b"}}) // form values are as expected.
+}
+
+// apiFunc is an API defined by a function returning its endpoints.
+type apiFunc func() []Endpoint
+
+// Endpoints implements API.
+func (f apiFunc) Endpoints() []Endpoint {
+	return f()
+}
+
+func TestMsgPackCodecLimits(t *testing.T) {
+
+	is := is.New(t)
+
+	var v interface{}
+
+	for _, body := range [][]byte{
+		{0xdd, 0xff, 0xff, 0xff, 0xff},       // array32 of 4294967295 values.
+		{0xdf, 0xff, 0xff, 0xff, 0xff},       // map32 of 4294967295 pairs.
+		{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'},  // str32 of 4294967295 bytes.
+		{0xc6, 0xff, 0xff, 0xff, 0xff, 0x00}, // bin32 of 4294967295 bytes.
+	} {
+		err := MsgPackCodec{}.Decode(bytes.NewReader(body), &v)
+		is.Equal(err, io.ErrUnexpectedEOF) // lengths longer than the body fail once the body ends.
+	}
+
+	nested := bytes.Repeat([]byte{0x91}, 100)
+	nested = append(nested, 0xc0)
+	is.NoErr(MsgPackCodec{MaxDepth: 100}.Decode(bytes.NewReader(nested), &v)) // bodies within the depth are decoded.
+
+	err := MsgPackCodec{MaxDepth: 99}.Decode(bytes.NewReader(nested), &v)
+	is.Equal(err, ErrBodyTooDeep) // bodies nested too deeply fail.
+
+	deep := bytes.Repeat([]byte{0x91}, 1000000)
+	err = MsgPackCodec{}.Decode(bytes.NewReader(deep), &v)
+	is.Equal(err, ErrBodyTooDeep) // bodies are limited to a depth by default.
+}
@@ -0,0 +1,506 @@
+package api
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoder compresses response bodies using a content coding, i.e. gzip.
+type Encoder interface {
+	// Encoding returns the name of the content coding, as used in the
+	// 'Accept-Encoding' and 'Content-Encoding' headers.
+	Encoding() string
+	// NewWriter returns a writer that compresses what is written to it into w.
+	// Closing the writer must write any remaining data, but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// Decoder is implemented by Encoders that can also decompress request bodies.
+type Decoder interface {
+	// NewReader returns a reader that decompresses r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// gzipEncoder is an Encoder, and Decoder, of the gzip content coding.
+type gzipEncoder struct {
+	level int
+	pool  sync.Pool
+}
+
+// GzipEncoder returns an Encoder of the gzip content coding, compressing at the
+// given level, i.e. gzip.DefaultCompression. It also decompresses gzip encoded
+// request bodies.
+func GzipEncoder(level int) Encoder {
+	return &gzipEncoder{level: level}
+}
+
+// Encoding implements Encoder.
+func (e *gzipEncoder) Encoding() string {
+	return "gzip"
+}
+
+// NewWriter implements Encoder. Writers are reused once closed.
+func (e *gzipEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if gz, ok := e.pool.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return &pooledWriter{Writer: gz, pool: &e.pool}, nil
+	}
+	gz, err := gzip.NewWriterLevel(w, e.level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledWriter{Writer: gz, pool: &e.pool}, nil
+}
+
+// NewReader implements Decoder.
+func (e *gzipEncoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// pooledWriter is a gzip writer that returns itself to a pool once closed.
+type pooledWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+// Close implements io.Closer.
+func (w *pooledWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// deflateEncoder is an Encoder, and Decoder, of the deflate content coding.
+type deflateEncoder struct {
+	level int
+}
+
+// DeflateEncoder returns an Encoder of the deflate content coding, compressing
+// at the given level, i.e. flate.DefaultCompression. It also decompresses
+// deflate encoded request bodies.
+//
+// The deflate content coding is the zlib format, but as some clients send raw
+// deflate data instead, bodies in either format are decompressed.
+func DeflateEncoder(level int) Encoder {
+	return &deflateEncoder{level: level}
+}
+
+// Encoding implements Encoder.
+func (e *deflateEncoder) Encoding() string {
+	return "deflate"
+}
+
+// NewWriter implements Encoder.
+func (e *deflateEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, e.level)
+}
+
+// NewReader implements Decoder.
+func (e *deflateEncoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// A zlib header's compression method is deflate, and its two bytes are a
+	// multiple of 31.
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// CompressionOption is a function that can be passed to CompressMW to modify
+// how responses are compressed.
+type CompressionOption func(*compressionConfig)
+
+// compressionConfig configures CompressMW.
+type compressionConfig struct {
+	encoders  []Encoder
+	minSize   int
+	skipTypes []string
+}
+
+// defaultCompressionMinSize is the size, in bytes, below which responses are
+// not compressed by default. Smaller responses don't benefit from compression.
+const defaultCompressionMinSize = 1024
+
+// defaultCompressionSkipTypes are the content types of responses that are
+// already compressed, so are not compressed by default.
+var defaultCompressionSkipTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+// CompressionEncoders sets the encoders responses can be compressed with, in
+// order of preference. By default, gzip is preferred over deflate.
+func CompressionEncoders(encoders ...Encoder) CompressionOption {
+	return func(c *compressionConfig) {
+		c.encoders = encoders
+	}
+}
+
+// CompressionMinSize sets the size, in bytes, below which responses are not
+// compressed. By default, responses smaller than 1KB are not compressed.
+func CompressionMinSize(n int) CompressionOption {
+	return func(c *compressionConfig) {
+		c.minSize = n
+	}
+}
+
+// CompressionSkipTypes adds content types of responses that should not be
+// compressed, i.e. as they are already compressed. Types ending in '/' match
+// all of their subtypes.
+func CompressionSkipTypes(types ...string) CompressionOption {
+	return func(c *compressionConfig) {
+		c.skipTypes = append(c.skipTypes, types...)
+	}
+}
+
+// newCompressionConfig returns the compression configuration defined by the
+// given options.
+func newCompressionConfig(opts []CompressionOption) *compressionConfig {
+	c := &compressionConfig{
+		encoders:  []Encoder{GzipEncoder(gzip.DefaultCompression), DeflateEncoder(flate.DefaultCompression)},
+		minSize:   defaultCompressionMinSize,
+		skipTypes: append([]string{}, defaultCompressionSkipTypes...),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// skip reports whether responses of the given content type should not be compressed.
+func (c *compressionConfig) skip(contentType string) bool {
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range c.skipTypes {
+		if ct == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(ct, t)) || (t == "font/woff" && ct == "font/woff2") {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressMW returns a middleware that compresses response bodies using the
+// encoder that best matches the request's 'Accept-Encoding' header. Responses
+// that are small, already encoded, or of an already compressed content type,
+// i.e. images, are not compressed. All responses include a
+// 'Vary: Accept-Encoding' header.
+//
+// Request bodies with a 'Content-Encoding' of one of the encoders that is also
+// a Decoder, i.e. gzip, are transparently decompressed. Request bodies with any
+// other encoding are responded to with a 415 Unsupported Media Type problem.
+func CompressMW(opts ...CompressionOption) Middleware {
+
+	cfg := newCompressionConfig(opts)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			// Decompress the request body, if it's encoded.
+			if ce := r.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+				body, ok, err := decompressBody(r, cfg.encoders, ce)
+				if !ok {
+					w.Header().Set("Accept-Encoding", strings.Join(decoderNames(cfg.encoders), ", "))
+					Error(w, r, "Content-Encoding must be one of: "+strings.Join(decoderNames(cfg.encoders), ", "), http.StatusUnsupportedMediaType)
+					return
+				}
+				if err != nil {
+					Error(w, r, "Request body is not valid "+strings.ToLower(ce)+" data", http.StatusBadRequest)
+					return
+				}
+				r.Body = body
+				r.ContentLength = -1
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			cw := &compressWriter{
+				ResponseWriter: captureResponseWriter(w, r),
+				r:              r,
+				cfg:            cfg,
+				encoder:        negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.encoders),
+			}
+
+			next.ServeHTTP(cw, r)
+
+			// Write whatever remains of the response. This isn't deferred, so if the
+			// handler panics, the buffered response can be replaced.
+			cw.close()
+		})
+	}
+}
+
+// decompressBody returns the request's body, decompressed using the decoder of
+// the given encoding. It reports false if there is no such decoder.
+func decompressBody(r *http.Request, encoders []Encoder, encoding string) (io.ReadCloser, bool, error) {
+	for _, e := range encoders {
+		dec, ok := e.(Decoder)
+		if !ok || !strings.EqualFold(e.Encoding(), encoding) {
+			continue
+		}
+
+		body, err := dec.NewReader(r.Body)
+		if err != nil {
+			return nil, true, err
+		}
+
+		// Limit the size of the decompressed body too, so a small compressed
+		// body can't expand beyond the endpoint's limit.
+		if d := getDetails(r); d != nil && d.maxBodyBytes > 0 {
+			body = newLimitedBody(body, -1, d.maxBodyBytes)
+		}
+		return body, true, nil
+	}
+	return nil, false, nil
+}
+
+// decoderNames returns the encodings of the given encoders that can decompress.
+func decoderNames(encoders []Encoder) []string {
+	var names []string
+	for _, e := range encoders {
+		if _, ok := e.(Decoder); ok {
+			names = append(names, e.Encoding())
+		}
+	}
+	return names
+}
+
+// negotiateEncoding returns the encoder that best matches the given
+// 'Accept-Encoding' header, or nil if the response shouldn't be compressed.
+// Encoders the client prefers equally are chosen in the order given.
+func negotiateEncoding(header string, encoders []Encoder) Encoder {
+	if header == "" {
+		return nil
+	}
+
+	// Parse the quality of each coding the client accepts.
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		qs[coding] = q
+	}
+
+	var best Encoder
+	var bestQ float64
+	for _, e := range encoders {
+		q, ok := qs[strings.ToLower(e.Encoding())]
+		if !ok {
+			// Codings that aren't listed are accepted as much as any other coding.
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressWriter is a http.ResponseWriter that compresses the response body,
+// if it is large enough and of a type that should be compressed. The response
+// is buffered until this can be decided.
+type compressWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	cfg     *compressionConfig
+	encoder Encoder
+
+	code        int
+	wroteHeader bool
+	committed   bool
+	buf         []byte
+	w           io.WriteCloser
+}
+
+// WriteHeader implements http.ResponseWriter. The header is only written once
+// it's known whether the response will be compressed. Informational responses
+// are sent as they are written.
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	if informational(code) {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	cw.code = code
+
+	if !cw.compressible() {
+		cw.commit(false)
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.committed {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.cfg.minSize {
+			return len(b), nil
+		}
+		if err := cw.commit(cw.compressible()); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.w != nil {
+		return cw.w.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// compressible reports whether the response can be compressed, from its
+// request, status code and headers.
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	return cw.encoder != nil &&
+		cw.r.Method != http.MethodHead &&
+		cw.code >= 200 && cw.code != http.StatusNoContent && cw.code != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" &&
+		!cw.cfg.skip(h.Get("Content-Type"))
+}
+
+// commit writes the response header, compressing the response if compress is
+// true, then writes any buffered body.
+func (cw *compressWriter) commit(compress bool) error {
+	cw.committed = true
+
+	if compress {
+		w, err := cw.encoder.NewWriter(cw.ResponseWriter)
+		if err == nil {
+			cw.w = w
+			h := cw.Header()
+			h.Set("Content-Encoding", cw.encoder.Encoding())
+			h.Del("Content-Length")
+			// The compressed body isn't byte for byte the same, so a strong
+			// validator no longer applies.
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.w != nil {
+		_, err = cw.w.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close writes any buffered response, and completes the compressed body.
+func (cw *compressWriter) close() {
+	if !cw.wroteHeader {
+		// Nothing was written, so leave the implicit response to the server.
+		return
+	}
+	if !cw.committed {
+		// The response is too small to be worth compressing.
+		cw.commit(false) //nolint:errcheck
+	}
+	if cw.w != nil {
+		cw.w.Close() //nolint:errcheck
+	}
+}
+
+// started reports whether the handler has begun the response.
+func (cw *compressWriter) started() bool {
+	return cw.wroteHeader
+}
+
+// Flush implements http.Flusher, so streamed responses are sent as they are
+// written, compressed if possible.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.committed {
+		cw.commit(cw.compressible()) //nolint:errcheck
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush() //nolint:errcheck
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker. It returns an error if the underlying
+// ResponseWriter does not support hijacking.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("api: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	// The connection has been taken over, so there's nothing left to write.
+	cw.committed = true
+	return h.Hijack()
+}
+
+// Push implements http.Pusher. It returns http.ErrNotSupported if the
+// underlying ResponseWriter does not support server push.
+func (cw *compressWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := cw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// WithCompression compresses the responses of each of the server's endpoints,
+// and decompresses their request bodies. See CompressMW.
+func WithCompression(opts ...CompressionOption) Option {
+	return func(s *server) {
+		s.compressmw = CompressMW(opts...)
+	}
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// reverseEncoder is an Encoder of a made up coding, that reverses each write.
+type reverseEncoder struct{}
+
+func (reverseEncoder) Encoding() string { return "reverse" }
+
+func (reverseEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return reverseWriter{w}, nil
+}
+
+type reverseWriter struct{ w io.Writer }
+
+func (rw reverseWriter) Write(b []byte) (int, error) {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return rw.w.Write(r)
+}
+
+func (rw reverseWriter) Close() error { return nil }
+
+func TestCompressMW(t *testing.T) {
+
+	large := strings.Repeat("a", 2048)
+
+	tests := []struct {
+		Name             string
+		Method           string
+		AcceptEncoding   string
+		ContentType      string
+		Body             string
+		Code             int
+		ExpectedEncoding string
+	}{
+		{
+			Name:             "gzip",
+			AcceptEncoding:   "gzip, deflate",
+			Body:             large,
+			ExpectedEncoding: "gzip",
+		},
+		{
+			Name:             "deflate preferred",
+			AcceptEncoding:   "gzip;q=0.5, deflate",
+			Body:             large,
+			ExpectedEncoding: "deflate",
+		},
+		{
+			Name:             "custom encoder by wildcard",
+			AcceptEncoding:   "gzip;q=0, deflate;q=0, *",
+			Body:             large,
+			ExpectedEncoding: "reverse",
+		},
+		{
+			Name:           "nothing acceptable",
+			AcceptEncoding: "br",
+			Body:           large,
+		},
+		{
+			Name: "no accept encoding",
+			Body: large,
+		},
+		{
+			Name:           "small body",
+			AcceptEncoding: "gzip",
+			Body:           "small",
+		},
+		{
+			Name:           "compressed content type",
+			AcceptEncoding: "gzip",
+			ContentType:    "image/png",
+			Body:           large,
+		},
+		{
+			Name:           "head request",
+			Method:         "HEAD",
+			AcceptEncoding: "gzip",
+		},
+		{
+			Name:           "no content",
+			AcceptEncoding: "gzip",
+			Code:           http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			h := CompressMW(CompressionEncoders(GzipEncoder(gzip.BestSpeed), DeflateEncoder(flate.BestSpeed), reverseEncoder{}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.ContentType != "" {
+					w.Header().Set("Content-Type", tt.ContentType)
+				}
+				code := tt.Code
+				if code == 0 {
+					code = http.StatusOK
+				}
+				w.WriteHeader(code)
+				// Write in pieces, so the decision to compress is made part way through.
+				for i := 0; i < len(tt.Body); i += 100 {
+					end := i + 100
+					if end > len(tt.Body) {
+						end = len(tt.Body)
+					}
+					w.Write([]byte(tt.Body[i:end])) //nolint:errcheck
+				}
+			}))
+
+			method := tt.Method
+			if method == "" {
+				method = "GET"
+			}
+			r, err := newTestRequest(method, "/", nil, "/")
+			is.NoErr(err)
+			if tt.AcceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.AcceptEncoding)
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+
+			is.Equal(rr.Header().Get("Vary"), "Accept-Encoding")               // response varies by encoding.
+			is.Equal(rr.Header().Get("Content-Encoding"), tt.ExpectedEncoding) // response is encoded as expected.
+
+			// Check the body decodes to what the handler wrote.
+			var body io.Reader = rr.Body
+			switch tt.ExpectedEncoding {
+			case "gzip":
+				body, err = gzip.NewReader(rr.Body)
+				is.NoErr(err)
+			case "deflate":
+				body, err = zlib.NewReader(rr.Body)
+				is.NoErr(err)
+			case "reverse":
+				b := rr.Body.Bytes()
+				for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+					b[i], b[j] = b[j], b[i]
+				}
+			}
+			b, err := ioutil.ReadAll(body)
+			is.NoErr(err)
+			is.Equal(string(b), tt.Body) // body decodes to the original.
+			if tt.ExpectedEncoding == "gzip" {
+				is.True(rr.Body.Len() < len(tt.Body)) // body is compressed.
+			}
+		})
+	}
+}
+
+func TestCompressMWWithServer(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	items := make([]string, 500)
+	for i := range items {
+		items[i] = "item"
+	}
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "GET",
+				Path:   "/items",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("ETag", `"v1"`)
+					Respond(w, r, http.StatusOK, items)
+				}),
+				CorsMiddleware: AllowAllCorsMW(),
+			},
+			{
+				Method: "POST",
+				Path:   "/items",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					var got []string
+					if err := Decode(w, r, &got); err != nil {
+						return
+					}
+					Respond(w, r, http.StatusCreated, map[string]int{"count": len(got)})
+				}),
+				MaxBodyBytes: 4096,
+			},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()), WithCompression())
+
+	// Large responses are compressed, and the status and size is still captured.
+	r, err := http.NewRequest("GET", "/items", nil)
+	is.NoErr(err)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Origin", "https://example.com")
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusOK)                                            // response code is 200.
+	is.Equal(rr.Header().Get("Content-Encoding"), "gzip")                       // response is compressed.
+	is.Equal(rr.Header().Get("ETag"), `W/"v1"`)                                 // strong etag is weakened.
+	is.Equal(rr.Header().Get("Access-Control-Allow-Origin"), "*")               // cors headers are still set.
+	is.Equal(rr.Header().Values("Vary"), []string{"Accept-Encoding", "Origin"}) // response varies by encoding and origin.
+	is.Equal(logs.Len(), 1)                                                     // request is logged.
+	is.Equal(logs.All()[0].ContextMap()["status"], int64(http.StatusOK))        // status is captured.
+
+	// Gzipped request bodies are decompressed.
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(`["a","b","c"]`)) //nolint:errcheck
+	gz.Close()
+
+	r, err = http.NewRequest("POST", "/items", &body)
+	is.NoErr(err)
+	r.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusCreated)     // request is accepted.
+	is.Equal(rr.Body.String(), `{"count":3}`) // body is decompressed.
+
+	// Decompressed bodies are still limited in size.
+	body.Reset()
+	gz = gzip.NewWriter(&body)
+	gz.Write([]byte(`["` + strings.Repeat("a", 10000) + `"]`)) //nolint:errcheck
+	gz.Close()
+	is.True(body.Len() < 4096) // compressed body is within the limit.
+
+	r, err = http.NewRequest("POST", "/items", &body)
+	is.NoErr(err)
+	r.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusRequestEntityTooLarge) // decompressed body is too large.
+
+	// Unsupported encodings are rejected.
+	r, err = http.NewRequest("POST", "/items", strings.NewReader(`[]`))
+	is.NoErr(err)
+	r.Header.Set("Content-Encoding", "br")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusUnsupportedMediaType)            // encoding is unsupported.
+	is.Equal(rr.Header().Get("Accept-Encoding"), "gzip, deflate") // supported encodings are listed.
+}
+
+func TestDeflateDecoder(t *testing.T) {
+
+	is := is.New(t)
+
+	dec := DeflateEncoder(flate.DefaultCompression).(Decoder)
+
+	// Both zlib wrapped and raw deflate data can be decompressed.
+	var zb, fb bytes.Buffer
+	zw := zlib.NewWriter(&zb)
+	zw.Write([]byte("hello")) //nolint:errcheck
+	zw.Close()
+	fw, err := flate.NewWriter(&fb, flate.DefaultCompression)
+	is.NoErr(err)
+	fw.Write([]byte("hello")) //nolint:errcheck
+	fw.Close()
+
+	for _, b := range []*bytes.Buffer{&zb, &fb} {
+		r, err := dec.NewReader(b)
+		is.NoErr(err)
+		got, err := ioutil.ReadAll(r)
+		is.NoErr(err)                  // data is decompressed.
+		is.Equal(string(got), "hello") // data is as expected.
+	}
+}
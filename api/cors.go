@@ -27,34 +27,16 @@ func AllowAllCorsMW() *CorsMiddleware {
 func CorsMW(c *cors.Cors) *CorsMiddleware {
 	var mw CorsMiddleware = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Wrap the response writer with another that captures the status code.
-			scrw := &statusCodeResponseWriter{w, http.StatusOK}
-
-			defer func() {
-				// Set status code value on request details so other middlewares can access it.
-				if d := getDetails(r); d != nil {
-					d.StatusCode = scrw.statusCode
-				}
-			}()
+			// Wrap the response writer with another that captures the status code,
+			// and sets it on the request details so other middlewares can access it.
+			w = captureResponseWriter(w, r)
 
 			// Create the CORS handler.
 			h := c.Handler(next)
 
 			// Call the CORS handler with the wrapped response writer.
-			h.ServeHTTP(scrw, r)
+			h.ServeHTTP(w, r)
 		})
 	}
 	return &mw
 }
-
-// statusCodeResponseWriter is a http.ResponseWriter that can capture the status code written to it.
-type statusCodeResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-// WriteHeader overrides the underlying ResponseWriter to capture the status code written.
-func (w *statusCodeResponseWriter) WriteHeader(code int) {
-	w.statusCode = code
-	w.ResponseWriter.WriteHeader(code)
-}
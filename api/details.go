@@ -5,7 +5,8 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/segmentio/ksuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 // ctxKey represents the type of value for the context key
@@ -14,6 +15,10 @@ type ctxKey int
 // keyDetails is how request details are stored and retrieved
 const keyDetails ctxKey = 1
 
+// keyRequestID is how the ID given to a request, before it is routed, is stored
+// and retrieved
+const keyRequestID ctxKey = 2
+
 // details represent state for each request
 type details struct {
 	Now         time.Time
@@ -22,24 +27,64 @@ type details struct {
 	RequestPath string
 	Params      map[string]string
 	StatusCode  int
+	// BytesWritten is the number of response body bytes written.
+	BytesWritten int64
+	// TimeToFirstByte is the time between the request being received and the
+	// response header being written.
+	TimeToFirstByte time.Duration
+	// codecs are the codecs registered with the server serving the request.
+	codecs *codecs
+	// maxBodyBytes is the maximum size of the request body, if limited.
+	maxBodyBytes int64
+	// maxJSONDepth is how deeply a JSON request body may be nested, if limited.
+	maxJSONDepth int
+	// rejected counts requests whose bodies exceeded one of the server's limits.
+	rejected *prometheus.CounterVec
+	// logger is the logger of the server serving the request.
+	logger *zap.SugaredLogger
+	// redactor redacts what is logged about, and responded to, the request, if
+	// configured.
+	redactor *Redactor
+	// errorStatuses map errors to the status codes they are responded to with.
+	errorStatuses []errorStatus
+	// etagMode is how the ETags of responses are computed.
+	etagMode ETagMode
+	// cacheControl is the 'Cache-Control' header of successful responses, if any.
+	cacheControl string
+	// version and lastModified identify the state of the resource responded with.
+	version      string
+	lastModified time.Time
+	// span is the server span of the request, if it is being traced.
+	span *Span
+	// apiVersion is the version of the endpoint handling the request, if any.
+	apiVersion string
+	// principal is the authenticated caller of the request, if any.
+	principal *Principal
+	// requirement is the permissions required to call the endpoint, if any.
+	requirement *Requirement
+	// requestIDHeader is the header the request ID is read from, and forwarded in.
+	requestIDHeader string
+	// header is the request's header, from which correlation headers are forwarded.
+	header http.Header
 }
 
 // SetDetails adds the required details into the given request's context. The returned request should then be used.
+// The request's ID is taken from its 'X-Request-ID' header if valid, otherwise a new ID is created.
 func SetDetails(r *http.Request, path string, params map[string]string) *http.Request {
+	return setDetails(r, path, params, defaultRequestIDConfig)
+}
 
-	// Retrieve request id from header.
-	requestID := r.Header.Get("X-Request-ID")
-	if requestID == "" {
-		// Create request id if not found in header.
-		requestID = ksuid.New().String()
-	}
+// setDetails implements SetDetails, identifying the request as configured.
+func setDetails(r *http.Request, path string, params map[string]string, ids requestIDConfig) *http.Request {
 
 	d := details{
-		Now:         time.Now(),
-		RequestID:   requestID,
-		Method:      r.Method,
-		RequestPath: path,
-		Params:      params,
+		Now:             time.Now(),
+		RequestID:       ids.requestID(r),
+		Method:          r.Method,
+		RequestPath:     path,
+		Params:          params,
+		requestIDHeader: ids.header,
+		header:          r.Header,
 	}
 
 	// Add details to the context, so other functions can access them.
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// EndpointError describes a problem with one of an API's endpoints, found
+// when a server is created.
+type EndpointError struct {
+	// Index is the position of the endpoint in the list of endpoints.
+	Index int
+	// Method and Path are the endpoint's, as given.
+	Method string
+	Path   string
+	// Reason is what is wrong with the endpoint.
+	Reason string
+}
+
+// Error implements error.
+func (e EndpointError) Error() string {
+	return fmt.Sprintf("endpoint %d (%s %s): %s", e.Index, e.Method, e.Path, e.Reason)
+}
+
+// EndpointErrors is an error describing all of the problems with an API's
+// endpoints.
+type EndpointErrors []EndpointError
+
+// Error implements error.
+func (e EndpointErrors) Error() string {
+	problems := make([]string, 0, len(e))
+	for _, ee := range e {
+		problems = append(problems, ee.Error())
+	}
+	return "api: invalid endpoints:\n\t" + strings.Join(problems, "\n\t")
+}
+
+// ValidateEndpoints checks that the given endpoints can be registered with a
+// server, returning EndpointErrors describing every problem found, or nil.
+//
+// Endpoints must have a handler, an uppercase method and a path beginning with
+// '/'. No two endpoints may have the same method, path and version, including
+// the 'OPTIONS' method registered for endpoints with CORS. Paths that only
+// differ by the names of their parameters, i.e. '/items/:id' and '/items/:key',
+// must use the same names, and catch-all parameters must be last.
+func ValidateEndpoints(endpoints []Endpoint) error {
+	var errs EndpointErrors
+	add := func(i int, e Endpoint, format string, args ...interface{}) {
+		errs = append(errs, EndpointError{Index: i, Method: e.Method, Path: e.Path, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	// route is a method and path registered with the router, and the endpoint
+	// that registered it.
+	type route struct {
+		index    int
+		implicit bool
+	}
+	routes := make(map[string]route)
+
+	// The parameter names of each path, keyed by the path with its names
+	// removed, and the endpoint that first used them.
+	type params struct {
+		index int
+		path  string
+		names []string
+	}
+	shapes := make(map[string]params)
+
+	for i, e := range endpoints {
+		if e.Handler == nil {
+			add(i, e, "handler is nil")
+		}
+
+		if !validMethod(e.Method) {
+			add(i, e, "method %q must be an uppercase HTTP method, i.e. 'GET'", e.Method)
+		}
+
+		shape, names, reason := pathShape(e.Path)
+		if reason != "" {
+			add(i, e, "%s", reason)
+			continue
+		}
+
+		// Endpoints with the same path must use the same parameter names, or
+		// the router can't tell which to use.
+		if p, ok := shapes[shape]; !ok {
+			shapes[shape] = params{index: i, path: e.Path, names: names}
+		} else if strings.Join(p.names, "/") != strings.Join(names, "/") {
+			add(i, e, "parameters %v conflict with parameters %v of endpoint %d (%s)", names, p.names, p.index, p.path)
+			continue
+		}
+
+		methods := []string{e.Method}
+		if e.CorsMiddleware != nil {
+			methods = append(methods, http.MethodOptions)
+		}
+		for j, method := range methods {
+			key := method + " " + shape + " " + e.Version
+			r, ok := routes[key]
+			if !ok {
+				routes[key] = route{index: i, implicit: j > 0}
+				continue
+			}
+			switch {
+			case r.implicit && j > 0:
+				add(i, e, "CORS is configured more than once for %s, also by endpoint %d", e.Path, r.index)
+			case r.implicit:
+				add(i, e, "%s clashes with the CORS preflight route of endpoint %d", method, r.index)
+			case j > 0:
+				add(i, e, "CORS preflight route clashes with %s endpoint %d", method, r.index)
+			default:
+				add(i, e, "duplicates endpoint %d", r.index)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validMethod reports whether method is a valid, uppercase, HTTP method token.
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, c := range method {
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// pathShape returns the given path with the names of its parameters removed,
+// and those names, or the reason the router can't register the path. As with
+// the router, parameters may be unnamed, i.e. '/files/*', or reuse a name.
+func pathShape(path string) (string, []string, string) {
+	if !strings.HasPrefix(path, "/") {
+		return "", nil, "path must begin with '/'"
+	}
+
+	segments := strings.Split(path, "/")
+	names := make([]string, 0)
+	for i, seg := range segments {
+		if seg == "" || (seg[0] != ':' && seg[0] != '*') {
+			continue
+		}
+		if seg[0] == '*' && i != len(segments)-1 {
+			return "", nil, fmt.Sprintf("catch-all parameter %q must be last", seg)
+		}
+		names = append(names, seg[1:])
+		segments[i] = seg[:1]
+	}
+	return strings.Join(segments, "/"), names, ""
+}
+
+// NewValidatedServer returns a HTTP server for accessing the given API, like
+// NewServer, unless the API's endpoints are invalid, in which case
+// EndpointErrors describing every problem are returned instead.
+func NewValidatedServer(addr string, logger *zap.SugaredLogger, a API, opts ...Option) (http.Server, error) {
+
+	s, err := newServer(logger, a, opts...)
+	if err != nil {
+		return http.Server{}, err
+	}
+
+	return http.Server{
+		Addr:        addr,
+		Handler:     s,
+		ReadTimeout: s.readTimeout,
+	}, nil
+}
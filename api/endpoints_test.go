@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestValidateEndpoints(t *testing.T) {
+
+	h := http.NotFoundHandler()
+
+	tests := []struct {
+		Name      string
+		Endpoints []Endpoint
+		Expected  []string
+	}{
+		{
+			Name: "valid",
+			Endpoints: []Endpoint{
+				{Method: "GET", Path: "/items", Handler: h, CorsMiddleware: DefaultCorsMW()},
+				{Method: "POST", Path: "/items", Handler: h},
+				{Method: "GET", Path: "/items/:id", Handler: h},
+				{Method: "PUT", Path: "/items/:id", Handler: h},
+				{Method: "GET", Path: "/items/:item/tags/:tag", Handler: h},
+				{Method: "GET", Path: "/files/*path", Handler: h},
+				{Method: "GET", Path: "/assets/*", Handler: h},
+				{Method: "GET", Path: "/tags/:", Handler: h},
+				{Method: "GET", Path: "/items/:id/parts/:id", Handler: h},
+			},
+		},
+		{
+			Name:      "nil handler",
+			Endpoints: []Endpoint{{Method: "GET", Path: "/"}},
+			Expected:  []string{"endpoint 0 (GET /): handler is nil"},
+		},
+		{
+			Name: "bad methods",
+			Endpoints: []Endpoint{
+				{Method: "", Path: "/", Handler: h},
+				{Method: "get", Path: "/", Handler: h},
+			},
+			Expected: []string{
+				`endpoint 0 ( /): method "" must be an uppercase HTTP method, i.e. 'GET'`,
+				`endpoint 1 (get /): method "get" must be an uppercase HTTP method, i.e. 'GET'`,
+			},
+		},
+		{
+			Name: "bad paths",
+			Endpoints: []Endpoint{
+				{Method: "GET", Path: "items", Handler: h},
+				{Method: "GET", Path: "/files/*path/info", Handler: h},
+				{Method: "GET", Path: "/files/*/info", Handler: h},
+			},
+			Expected: []string{
+				"endpoint 0 (GET items): path must begin with '/'",
+				`endpoint 1 (GET /files/*path/info): catch-all parameter "*path" must be last`,
+				`endpoint 2 (GET /files/*/info): catch-all parameter "*" must be last`,
+			},
+		},
+		{
+			Name: "duplicates",
+			Endpoints: []Endpoint{
+				{Method: "GET", Path: "/items", Handler: h},
+				{Method: "GET", Path: "/items", Handler: h},
+			},
+			Expected: []string{"endpoint 1 (GET /items): duplicates endpoint 0"},
+		},
+		{
+			Name: "param conflicts",
+			Endpoints: []Endpoint{
+				{Method: "GET", Path: "/items/:id", Handler: h},
+				{Method: "PUT", Path: "/items/:key", Handler: h},
+				{Method: "GET", Path: "/files/*path", Handler: h},
+				{Method: "PUT", Path: "/files/*name", Handler: h},
+			},
+			Expected: []string{
+				"endpoint 1 (PUT /items/:key): parameters [key] conflict with parameters [id] of endpoint 0 (/items/:id)",
+				"endpoint 3 (PUT /files/*name): parameters [name] conflict with parameters [path] of endpoint 2 (/files/*path)",
+			},
+		},
+		{
+			Name: "cors clashes",
+			Endpoints: []Endpoint{
+				{Method: "GET", Path: "/items", Handler: h, CorsMiddleware: DefaultCorsMW()},
+				{Method: "OPTIONS", Path: "/items", Handler: h},
+				{Method: "POST", Path: "/items", Handler: h, CorsMiddleware: DefaultCorsMW()},
+				{Method: "OPTIONS", Path: "/other", Handler: h},
+				{Method: "GET", Path: "/other", Handler: h, CorsMiddleware: DefaultCorsMW()},
+			},
+			Expected: []string{
+				"endpoint 1 (OPTIONS /items): OPTIONS clashes with the CORS preflight route of endpoint 0",
+				"endpoint 2 (POST /items): CORS is configured more than once for /items, also by endpoint 0",
+				"endpoint 4 (GET /other): CORS preflight route clashes with OPTIONS endpoint 3",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			err := ValidateEndpoints(tt.Endpoints)
+			if tt.Expected == nil {
+				is.NoErr(err) // endpoints are valid.
+
+				// Valid endpoints can be registered with the router.
+				logger, _ := newTestLogger(zap.InfoLevel)
+				NewServer(":0", logger, apiFunc(func() []Endpoint { return tt.Endpoints }), WithRegisterer(prometheus.NewRegistry()))
+				return
+			}
+
+			var errs EndpointErrors
+			is.True(errors.As(err, &errs)) // error describes each endpoint.
+			reasons := make([]string, 0)
+			for _, e := range errs {
+				reasons = append(reasons, e.Error())
+			}
+			is.Equal(reasons, tt.Expected) // every problem is described.
+		})
+	}
+}
+
+func TestNewValidatedServer(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	a := apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/debug/routes"},
+		}
+	})
+
+	_, err := NewValidatedServer(":0", logger, a, WithRegisterer(prometheus.NewRegistry()), WithRoutesEndpoint("/debug/routes"))
+	is.True(err != nil)                                                    // invalid endpoints are an error.
+	is.True(strings.HasPrefix(err.Error(), "api: invalid endpoints:\n\t")) // error is readable.
+	is.Equal(len(err.(EndpointErrors)), 2)                                 // every problem is returned.
+	is.Equal(err.(EndpointErrors)[1].Reason, "duplicates endpoint 0")      // server's own endpoints are validated.
+
+	defer func() {
+		is.Equal(recover(), err) // NewServer panics with the same error.
+	}()
+	NewServer(":0", logger, a, WithRegisterer(prometheus.NewRegistry()), WithRoutesEndpoint("/debug/routes"))
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// ProblemError is an error that describes the problem response, as defined by
+// RFC 7807, it should result in. Handlers can return it from a HandlerFunc, or
+// pass it to RespondError.
+type ProblemError struct {
+	// Type is a URI identifying the type of problem. By default, 'about:blank'.
+	Type string
+	// Title is a short summary of the type of problem. By default, the status
+	// text of the Status.
+	Title string
+	// Status is the HTTP status code of the response. By default, 500.
+	Status int
+	// Detail explains this occurrence of the problem.
+	Detail string
+	// Instance is a URI identifying this occurrence of the problem.
+	Instance string
+	// Extensions are additional fields of the problem response.
+	Extensions map[string]interface{}
+	// Err is the cause of the problem. It is logged, but not included in the
+	// response.
+	Err error
+}
+
+// Error implements error.
+func (e *ProblemError) Error() string {
+	msg := fmt.Sprintf("api: problem %d", e.status())
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the cause of the problem.
+func (e *ProblemError) Unwrap() error {
+	return e.Err
+}
+
+// status returns the status code of the problem, defaulting to 500.
+func (e *ProblemError) status() int {
+	if e.Status == 0 {
+		return http.StatusInternalServerError
+	}
+	return e.Status
+}
+
+// HandlerFunc is an adapter to allow handlers to return errors. The returned
+// error is responded to with RespondError.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// ServeHTTP implements http.Handler.
+func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f(w, r); err != nil {
+		RespondError(w, r, err)
+	}
+}
+
+// errorStatus maps an error to the status code of the response it results in.
+type errorStatus struct {
+	target error
+	status int
+}
+
+// RespondError replies to the request with a problem response describing err.
+//
+// If err is, or wraps, a *ProblemError then it is responded with. Otherwise, if
+// err is, or wraps, an error registered with WithErrorStatus, then the response
+// has the registered status and that error's message as its detail. Any other
+// error results in an opaque 500 Internal Server Error problem.
+//
+// Errors resulting in a 5XX response are logged with the request's ID, using
+// the server's logger. If the response has already begun, err is only logged,
+// unless the response is a client error, in which case err has already been
+// responded to, i.e. by Decode or DecodeAndValidate, and is ignored.
+func RespondError(w http.ResponseWriter, r *http.Request, err error) {
+
+	var statuses []errorStatus
+	logger := zap.S()
+	d := getDetails(r)
+	if d != nil {
+		statuses = d.errorStatuses
+		if d.logger != nil {
+			logger = d.logger
+		}
+	}
+
+	if d != nil && responseStarted(w) && d.StatusCode >= 400 && d.StatusCode < 500 {
+		// The client has already been told what it did wrong.
+		return
+	}
+
+	pe := problemFor(err, statuses)
+
+	if pe.status() >= 500 {
+		LoggerFromRequest(r, logger).Errorw("request failed", "error", err.Error(), "status", pe.status())
+		SpanFromRequest(r).RecordError(err)
+	}
+
+	if responseStarted(w) {
+		// The response has begun, so it's too late to replace it.
+		return
+	}
+
+	title := pe.Title
+	if title == "" {
+		title = http.StatusText(pe.status())
+	}
+	var extras []ProblemExtra
+	if len(pe.Extensions) > 0 {
+		extras = append(extras, WithFields(pe.Extensions))
+	}
+	if pe.Type != "" {
+		extras = append(extras, WithType(pe.Type))
+	}
+	if pe.Instance != "" {
+		extras = append(extras, WithInstance(pe.Instance))
+	}
+
+	Problem(w, r, title, pe.Detail, pe.status(), extras...)
+}
+
+// problemFor returns the problem that err should be responded to with.
+func problemFor(err error, statuses []errorStatus) *ProblemError {
+	var pe *ProblemError
+	if errors.As(err, &pe) {
+		if pe.Detail == "" {
+			// Don't fill in the original, so err is unchanged.
+			cp := *pe
+			cp.Detail = http.StatusText(pe.status())
+			pe = &cp
+		}
+		return pe
+	}
+
+	for _, s := range statuses {
+		if errors.Is(err, s.target) {
+			// Only the registered error's message is used, as errors wrapping it
+			// may include details that shouldn't be exposed.
+			return &ProblemError{Status: s.status, Detail: s.target.Error(), Err: err}
+		}
+	}
+
+	return &ProblemError{Status: http.StatusInternalServerError, Detail: "Internal Server Error", Err: err}
+}
+
+// WithErrorStatus registers the status code that errors which are, or wrap,
+// target are responded to with by RespondError, i.e. to map a domain's
+// ErrNotFound to 404. Errors are checked against targets in the order they are
+// registered.
+func WithErrorStatus(target error, status int) Option {
+	return func(s *server) {
+		s.errorStatuses = append(s.errorStatuses, errorStatus{target: target, status: status})
+	}
+}
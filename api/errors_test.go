@@ -0,0 +1,269 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	errOrderNotFound = errors.New("order not found")
+	errOrderClosed   = errors.New("order is closed")
+)
+
+func TestHandlerFunc(t *testing.T) {
+
+	tests := []struct {
+		Name         string
+		Err          error
+		ExpectedCode int
+		ExpectedBody string
+		ExpectedLog  string
+	}{
+		{
+			Name:         "no error",
+			ExpectedCode: http.StatusNoContent,
+		},
+		{
+			Name: "problem error",
+			Err: fmt.Errorf("checking out: %w", &ProblemError{
+				Type:       "https://example.com/probs/out-of-credit",
+				Title:      "You do not have enough credit.",
+				Status:     http.StatusForbidden,
+				Detail:     "Your current balance is 30, but that costs 50.",
+				Instance:   "/account/12345/msgs/abc",
+				Extensions: map[string]interface{}{"balance": 30, "status": 200},
+			}),
+			ExpectedCode: http.StatusForbidden,
+			ExpectedBody: `{"balance":30,"detail":"Your current balance is 30, but that costs 50.","instance":"/account/12345/msgs/abc","status":403,"title":"You do not have enough credit.","type":"https://example.com/probs/out-of-credit"}`,
+		},
+		{
+			Name:         "problem error with defaults",
+			Err:          &ProblemError{Status: http.StatusConflict, Err: errors.New("version mismatch")},
+			ExpectedCode: http.StatusConflict,
+			ExpectedBody: `{"detail":"Conflict","status":409,"title":"Conflict","type":"about:blank"}`,
+		},
+		{
+			Name:         "server problem error",
+			Err:          &ProblemError{Status: http.StatusBadGateway, Detail: "Upstream is unavailable", Err: errors.New("dial tcp: connection refused")},
+			ExpectedCode: http.StatusBadGateway,
+			ExpectedBody: `{"detail":"Upstream is unavailable","status":502,"title":"Bad Gateway","type":"about:blank"}`,
+			ExpectedLog:  "api: problem 502: Upstream is unavailable: dial tcp: connection refused",
+		},
+		{
+			Name:         "registered error",
+			Err:          fmt.Errorf("loading order 42 from db-1: %w", errOrderNotFound),
+			ExpectedCode: http.StatusNotFound,
+			ExpectedBody: `{"detail":"order not found","status":404,"title":"Not Found","type":"about:blank"}`,
+		},
+		{
+			Name:         "other registered error",
+			Err:          errOrderClosed,
+			ExpectedCode: http.StatusConflict,
+			ExpectedBody: `{"detail":"order is closed","status":409,"title":"Conflict","type":"about:blank"}`,
+		},
+		{
+			Name:         "unmapped error",
+			Err:          errors.New("pq: password authentication failed"),
+			ExpectedCode: http.StatusInternalServerError,
+			ExpectedBody: `{"detail":"Internal Server Error","status":500,"title":"Internal Server Error","type":"about:blank"}`,
+			ExpectedLog:  "pq: password authentication failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger, and captured logs.
+			logger, logs := newTestLogger(zap.InfoLevel)
+
+			srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+				return []Endpoint{{
+					Method: "GET",
+					Path:   "/",
+					Handler: HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+						if tt.Err != nil {
+							return tt.Err
+						}
+						Respond(w, r, http.StatusNoContent, nil)
+						return nil
+					}),
+					SuppressLogs: true,
+				}}
+			}), WithRegisterer(prometheus.NewRegistry()), WithErrorStatus(errOrderNotFound, http.StatusNotFound), WithErrorStatus(errOrderClosed, http.StatusConflict))
+
+			r, err := http.NewRequest("GET", "/", nil)
+			is.NoErr(err)
+			r.Header.Set("X-Request-ID", "abc123")
+
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode)          // response code is as expected.
+			is.Equal(rr.Body.String(), tt.ExpectedBody) // response body is as expected.
+
+			// Check the cause is logged, only for server errors.
+			if tt.ExpectedLog == "" {
+				is.Equal(logs.Len(), 0) // error isn't logged.
+				return
+			}
+			is.Equal(logs.Len(), 1)                                       // error is logged.
+			is.Equal(logs.All()[0].ContextMap()["error"], tt.ExpectedLog) // cause is logged.
+			is.Equal(logs.All()[0].ContextMap()["request_id"], "abc123")  // error is logged with the request id.
+		})
+	}
+}
+
+func TestHandlerFuncDecodeErrors(t *testing.T) {
+
+	type order struct {
+		Item string `json:"item" validate:"required"`
+	}
+
+	tests := []struct {
+		Name         string
+		ContentType  string
+		Body         string
+		ExpectedCode int
+	}{
+		{
+			Name:         "unsupported media type",
+			ContentType:  "text/plain",
+			Body:         `item`,
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			Name:         "body too large",
+			Body:         `{"item":"` + strings.Repeat("x", 100) + `"}`,
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Name:         "invalid body",
+			Body:         `{"item":1}`,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Name:         "invalid params",
+			Body:         `{}`,
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger, and captured logs.
+			logger, logs := newTestLogger(zap.InfoLevel)
+
+			srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+				return []Endpoint{{
+					Method: "POST",
+					Path:   "/",
+					Handler: HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+						var o order
+						return DecodeAndValidate(w, r, &o)
+					}),
+					MaxBodyBytes: 64,
+					SuppressLogs: true,
+				}}
+			}), WithRegisterer(prometheus.NewRegistry()))
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.Body))
+			if tt.ContentType != "" {
+				r.Header.Set("Content-Type", tt.ContentType)
+			}
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode)                       // response code is the client error.
+			is.Equal(strings.Count(rr.Body.String(), `"status"`), 1) // only one problem is responded with.
+			is.Equal(logs.Len(), 0)                                  // client errors aren't logged as failures.
+		})
+	}
+}
+
+func TestHandlerFuncDecode(t *testing.T) {
+
+	tests := []struct {
+		Name           string
+		Body           string
+		ExpectedDetail string
+	}{
+		{
+			Name:           "malformed body",
+			Body:           `{"item":`,
+			ExpectedDetail: "Request body is malformed",
+		},
+		{
+			Name:           "invalid syntax",
+			Body:           `item`,
+			ExpectedDetail: "Request body is malformed",
+		},
+		{
+			Name:           "wrong type",
+			Body:           `{"item":1}`,
+			ExpectedDetail: "Request body could not be decoded",
+		},
+		{
+			Name:           "empty body",
+			Body:           ``,
+			ExpectedDetail: "Request body must not be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger, and captured logs.
+			logger, logs := newTestLogger(zap.InfoLevel)
+
+			srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+				return []Endpoint{{
+					Method: "POST",
+					Path:   "/",
+					Handler: HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+						var o struct {
+							Item string `json:"item"`
+						}
+						return Decode(w, r, &o)
+					}),
+					SuppressLogs: true,
+				}}
+			}), WithRegisterer(prometheus.NewRegistry()))
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.Body))
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			var p map[string]interface{}
+			is.NoErr(json.Unmarshal(rr.Body.Bytes(), &p))
+			is.Equal(rr.Code, http.StatusBadRequest) // response is a client error.
+			is.Equal(p["detail"], tt.ExpectedDetail) // problem describes the body.
+			is.Equal(logs.Len(), 0)                  // client errors aren't logged as failures.
+		})
+	}
+}
+
+func TestProblemError(t *testing.T) {
+
+	is := is.New(t)
+
+	cause := errors.New("boom")
+	err := fmt.Errorf("wrapped: %w", &ProblemError{Status: http.StatusTeapot, Detail: "I'm short and stout", Err: cause})
+
+	var pe *ProblemError
+	is.True(errors.As(err, &pe))                                                  // problem error can be found.
+	is.True(errors.Is(err, cause))                                                // cause can be found.
+	is.Equal(err.Error(), "wrapped: api: problem 418: I'm short and stout: boom") // message includes the cause.
+}
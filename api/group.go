@@ -0,0 +1,73 @@
+package api
+
+import "strings"
+
+// Group is an API composed of other APIs, whose endpoints are mounted under a
+// shared path prefix, with shared middleware and defaults. Groups can be
+// nested, i.e. to mount '/orders' and '/users' APIs under '/v1'.
+//
+//	api.Group{
+//		Prefix: "/v1",
+//		APIs: []api.API{
+//			api.Group{Prefix: "/orders", APIs: []api.API{orders}},
+//			api.Group{Prefix: "/users", APIs: []api.API{users}, Middlewares: []api.Middleware{authmw}},
+//		},
+//	}
+//
+// Endpoints keep their full path, i.e. '/v1/orders/:id', so it is what metrics,
+// logs and the route table report.
+type Group struct {
+	// Prefix is prepended to the paths of all of the group's endpoints. It must
+	// begin with '/', and any trailing '/' is ignored, as with httptreemux's
+	// groups. It may be empty, to only share middleware and defaults.
+	Prefix string
+	// APIs are the APIs whose endpoints make up the group.
+	APIs []API
+	// Middlewares are run for all of the group's endpoints, before each
+	// endpoint's own middlewares.
+	Middlewares []Middleware
+	// CorsMiddleware is the Cross Origin Resource Sharing middleware of
+	// endpoints that don't have their own.
+	CorsMiddleware *CorsMiddleware
+	// SuppressLogs, SuppressMetrics and SuppressTracing suppress logs, metrics
+	// and tracing of the group's endpoints by default. Endpoints can override
+	// this with KeepLogs, KeepMetrics and KeepTracing.
+	SuppressLogs    bool
+	SuppressMetrics bool
+	SuppressTracing bool
+}
+
+// Endpoints implements API.
+func (g Group) Endpoints() []Endpoint {
+	prefix := strings.TrimSuffix(g.Prefix, "/")
+
+	endpoints := make([]Endpoint, 0)
+	for _, a := range g.APIs {
+		for _, e := range a.Endpoints() {
+			e.Path = prefix + e.Path
+
+			if len(g.Middlewares) > 0 {
+				// Copy the middlewares, so the API's endpoint isn't modified.
+				mws := make([]Middleware, 0, len(g.Middlewares)+len(e.Middlewares))
+				mws = append(mws, g.Middlewares...)
+				e.Middlewares = append(mws, e.Middlewares...)
+			}
+
+			if e.CorsMiddleware == nil {
+				e.CorsMiddleware = g.CorsMiddleware
+			}
+
+			e.SuppressLogs = e.SuppressLogs || (g.SuppressLogs && !e.KeepLogs)
+			e.SuppressMetrics = e.SuppressMetrics || (g.SuppressMetrics && !e.KeepMetrics)
+			e.SuppressTracing = e.SuppressTracing || (g.SuppressTracing && !e.KeepTracing)
+
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// Mount returns a Group of the given APIs, mounted under prefix.
+func Mount(prefix string, apis ...API) Group {
+	return Group{Prefix: prefix, APIs: apis}
+}
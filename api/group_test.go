@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestGroup(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	// trace returns a middleware that appends name to the 'X-Trace' header.
+	trace := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Trace", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, r, http.StatusOK, map[string]string{"id": URLParam(r, "id")})
+	})
+
+	orders := apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/:id", Handler: h, Middlewares: []Middleware{trace("endpoint")}},
+			{Method: "POST", Path: "/", Handler: h, CorsMiddleware: AllowAllCorsMW()},
+		}
+	})
+	users := apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/:id", Handler: h},
+			{Method: "POST", Path: "/", Handler: h, KeepLogs: true},
+		}
+	})
+
+	v1 := Group{
+		Prefix:      "/v1/",
+		Middlewares: []Middleware{trace("v1")},
+		APIs: []API{
+			Group{Prefix: "/orders", APIs: []API{orders}, Middlewares: []Middleware{trace("orders")}, CorsMiddleware: DefaultCorsMW()},
+			Group{Prefix: "/users", APIs: []API{users}, SuppressLogs: true},
+		},
+	}
+
+	reg := prometheus.NewRegistry()
+	srv := NewServer(":0", logger, v1, WithRegisterer(reg))
+
+	routes := Routes(srv.Handler)
+	paths := make([]string, 0)
+	for _, r := range routes {
+		paths = append(paths, r.Method+" "+r.Path)
+	}
+	is.Equal(paths, []string{
+		"OPTIONS /v1/orders/",
+		"POST /v1/orders/",
+		"GET /v1/orders/:id",
+		"OPTIONS /v1/orders/:id",
+		"POST /v1/users/",
+		"GET /v1/users/:id",
+	}) // endpoints are mounted under their prefixes.
+
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/orders/123", nil))
+	is.Equal(rr.Code, http.StatusOK)                                                         // response code is 200.
+	is.Equal(rr.Body.String(), `{"id":"123"}`)                                               // params are matched.
+	is.Equal(rr.Header().Values("X-Trace"), []string{"v1", "orders", "endpoint"})            // group middlewares run first, outermost group first.
+	is.Equal(logs.FilterMessage("request").All()[0].ContextMap()["route"], "/v1/orders/:id") // logs report the full route.
+
+	r := httptest.NewRequest("OPTIONS", "/v1/orders/123", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Header().Get("Access-Control-Allow-Origin"), "*") // group cors is used by default.
+
+	r = httptest.NewRequest("OPTIONS", "/v1/orders/", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "X-Custom")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Header().Get("Access-Control-Allow-Headers"), "X-Custom") // endpoint cors overrides the group's.
+
+	before := logs.FilterMessage("request").Len()
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/users/abc", nil))
+	is.Equal(rr.Code, http.StatusOK)                        // response code is 200.
+	is.Equal(logs.FilterMessage("request").Len(), before)   // group suppression applies to its endpoints.
+	is.Equal(rr.Header().Values("X-Trace"), []string{"v1"}) // only the outer group's middleware runs.
+
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/users/", nil))
+	is.Equal(rr.Code, http.StatusOK)                        // response code is 200.
+	is.Equal(logs.FilterMessage("request").Len(), before+1) // endpoints can keep logs the group suppresses.
+
+	// Check metrics report the full route.
+	mfs, err := reg.Gather()
+	is.NoErr(err)
+	var observed uint64
+	for _, mf := range mfs {
+		if mf.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["method"] == "GET" && labels["path"] == "/v1/orders/:id" && labels["status"] == "2XX" {
+				observed = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	is.Equal(observed, uint64(1)) // metrics report the full route.
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultLivenessPath is the path the liveness endpoint is registered at, if no other is configured.
+	defaultLivenessPath = "/livez"
+	// defaultReadinessPath is the path the readiness endpoint is registered at, if no other is configured.
+	defaultReadinessPath = "/readyz"
+	// defaultHealthCheckTimeout is how long a health check may run for, if it has no timeout.
+	defaultHealthCheckTimeout = 5 * time.Second
+	// defaultHealthCacheTTL is how long health check results are cached for, if no other duration is configured.
+	defaultHealthCacheTTL = time.Second
+)
+
+// Health check statuses, as reported in health responses.
+const (
+	healthPass = "pass"
+	healthWarn = "warn"
+	healthFail = "fail"
+)
+
+// HealthCheck is a named check of something the API depends upon, i.e. a database.
+type HealthCheck struct {
+	// The name of the check, as reported in health responses and metrics.
+	Name string
+	// The function that performs the check. It should return an error if the check fails.
+	Check func(ctx context.Context) error
+	// How long the check may run for before it is considered to have failed.
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+	// Flag to mark the check as critical. If a critical check fails, the
+	// server is reported as not ready. Failing non-critical checks are only
+	// reported.
+	Critical bool
+}
+
+// healthResult is the outcome of running a health check.
+type healthResult struct {
+	err      error
+	at       time.Time
+	duration time.Duration
+}
+
+// healthChecker runs health checks, caching their results.
+type healthChecker struct {
+	checks []HealthCheck
+	ttl    time.Duration
+	ready  func() bool
+	status *prometheus.GaugeVec
+
+	mu      sync.Mutex
+	results map[string]healthResult
+}
+
+// newHealthChecker returns a healthChecker for the given checks, that exposes
+// the status of each check using a Prometheus Gauge.
+func newHealthChecker(checks []HealthCheck, ttl time.Duration, ready func() bool, reg prometheus.Registerer, cfg metricsConfig) *healthChecker {
+
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   cfg.namespace,
+		Name:        "health_check_status",
+		Help:        "Health check status, 1 if the check is passing, 0 otherwise",
+		ConstLabels: cfg.constLabels,
+	}, []string{"check"})
+
+	status = registerCollector(reg, status).(*prometheus.GaugeVec)
+
+	return &healthChecker{
+		checks:  checks,
+		ttl:     ttl,
+		ready:   ready,
+		status:  status,
+		results: make(map[string]healthResult),
+	}
+}
+
+// run runs all checks whose cached results have expired, and returns the
+// latest result of every check. Checks aren't run with the context of the
+// request that caused them to run, as their results are shared with other
+// requests, so shouldn't fail if that request is cancelled.
+func (h *healthChecker) run() map[string]healthResult {
+
+	// Only one set of checks runs at a time, concurrent callers are given the
+	// results of that run.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Run expired checks concurrently, collecting their results.
+	fresh := make([]healthResult, len(h.checks))
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		if r, ok := h.results[c.Name]; ok && time.Since(r.at) < h.ttl {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, c HealthCheck) {
+			defer wg.Done()
+			fresh[i] = runHealthCheck(context.Background(), c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i, c := range h.checks {
+		r := fresh[i]
+		if r.at.IsZero() {
+			// The check wasn't run, as its cached result is still valid.
+			continue
+		}
+		h.results[c.Name] = r
+
+		value := float64(1)
+		if r.err != nil {
+			value = 0
+		}
+		h.status.WithLabelValues(c.Name).Set(value)
+	}
+
+	results := make(map[string]healthResult, len(h.results))
+	for k, v := range h.results {
+		results[k] = v
+	}
+	return results
+}
+
+// runHealthCheck runs the given check, within its timeout.
+func runHealthCheck(ctx context.Context, c HealthCheck) healthResult {
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	// Run the check in the background, so a check that ignores its context
+	// still fails once the timeout is reached.
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return healthResult{
+		err:      err,
+		at:       time.Now(),
+		duration: time.Since(start),
+	}
+}
+
+// healthCheckResponse is the status of a single check in a health response.
+type healthCheckResponse struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// healthResponse is the body of a health response.
+type healthResponse struct {
+	Status string                         `json:"status"`
+	Reason string                         `json:"reason,omitempty"`
+	Checks map[string]healthCheckResponse `json:"checks,omitempty"`
+}
+
+// handleLiveness returns a handler that reports the server is alive.
+func (h *healthChecker) handleLiveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, r, http.StatusOK, healthResponse{Status: healthPass})
+	})
+}
+
+// handleReadiness returns a handler that reports whether the server is ready
+// to accept requests. The server is not ready if it is shutting down, or if
+// any critical check fails.
+func (h *healthChecker) handleReadiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		resp := healthResponse{
+			Status: healthPass,
+			Checks: make(map[string]healthCheckResponse),
+		}
+
+		results := h.run()
+
+		for _, c := range h.checks {
+			res := results[c.Name]
+			cr := healthCheckResponse{
+				Status:   healthPass,
+				Critical: c.Critical,
+				Duration: res.duration.String(),
+			}
+			if res.err != nil {
+				cr.Status = healthFail
+				cr.Error = res.err.Error()
+				if c.Critical {
+					resp.Status = healthFail
+				} else if resp.Status == healthPass {
+					resp.Status = healthWarn
+				}
+			}
+			resp.Checks[c.Name] = cr
+		}
+
+		if !h.ready() {
+			resp.Status = healthFail
+			resp.Reason = "shutting down"
+		}
+
+		code := http.StatusOK
+		if resp.Status == healthFail {
+			code = http.StatusServiceUnavailable
+		}
+
+		Respond(w, r, code, resp)
+	})
+}
+
+// WithHealthChecks registers liveness and readiness endpoints with the server.
+// The readiness endpoint runs the given checks, and reports the server as not
+// ready once it begins to shutdown. Neither endpoint is logged or instrumented.
+func WithHealthChecks(checks ...HealthCheck) Option {
+	return func(s *server) {
+		s.healthEnabled = true
+		s.healthChecks = append(s.healthChecks, checks...)
+	}
+}
+
+// WithHealthPaths sets the paths the liveness and readiness endpoints are
+// registered at. By default, these are '/livez' and '/readyz'.
+func WithHealthPaths(liveness, readiness string) Option {
+	return func(s *server) {
+		s.livenessPath = liveness
+		s.readinessPath = readiness
+	}
+}
+
+// WithHealthCacheTTL sets how long health check results are cached for, so
+// frequent probes don't overload the API's dependencies. By default, results
+// are cached for 1 second.
+func WithHealthCacheTTL(d time.Duration) Option {
+	return func(s *server) {
+		s.healthCacheTTL = d
+	}
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestHealthChecks(t *testing.T) {
+
+	// check returns a health check function that returns err, counting its calls.
+	check := func(err error, calls *int32) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			atomic.AddInt32(calls, 1)
+			return err
+		}
+	}
+
+	// slow is a health check function that never completes within its timeout.
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	tests := []struct {
+		Name           string
+		Checks         []HealthCheck
+		ExpectedCode   int
+		ExpectedStatus string
+		ExpectedChecks map[string]string
+	}{
+		{
+			Name:           "no checks",
+			ExpectedCode:   http.StatusOK,
+			ExpectedStatus: "pass",
+			ExpectedChecks: map[string]string{},
+		},
+		{
+			Name: "all checks pass",
+			Checks: []HealthCheck{
+				{Name: "db", Check: check(nil, new(int32)), Critical: true},
+				{Name: "cache", Check: check(nil, new(int32))},
+			},
+			ExpectedCode:   http.StatusOK,
+			ExpectedStatus: "pass",
+			ExpectedChecks: map[string]string{"db": "pass", "cache": "pass"},
+		},
+		{
+			Name: "non-critical check fails",
+			Checks: []HealthCheck{
+				{Name: "db", Check: check(nil, new(int32)), Critical: true},
+				{Name: "cache", Check: check(errors.New("boom"), new(int32))},
+			},
+			ExpectedCode:   http.StatusOK,
+			ExpectedStatus: "warn",
+			ExpectedChecks: map[string]string{"db": "pass", "cache": "fail"},
+		},
+		{
+			Name: "critical check fails",
+			Checks: []HealthCheck{
+				{Name: "db", Check: check(errors.New("boom"), new(int32)), Critical: true},
+				{Name: "cache", Check: check(nil, new(int32))},
+			},
+			ExpectedCode:   http.StatusServiceUnavailable,
+			ExpectedStatus: "fail",
+			ExpectedChecks: map[string]string{"db": "fail", "cache": "pass"},
+		},
+		{
+			Name: "critical check times out",
+			Checks: []HealthCheck{
+				{Name: "db", Check: slow, Timeout: 10 * time.Millisecond, Critical: true},
+			},
+			ExpectedCode:   http.StatusServiceUnavailable,
+			ExpectedStatus: "fail",
+			ExpectedChecks: map[string]string{"db": "fail"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+
+			is := is.New(t)
+
+			// Create logger.
+			logger, _ := newTestLogger(zap.InfoLevel)
+
+			// Create server.
+			srv := NewServer(":0", logger, &testAPI{logger},
+				WithRegisterer(prometheus.NewRegistry()),
+				WithHealthChecks(tt.Checks...),
+			)
+
+			// Check liveness.
+			r, err := http.NewRequest("GET", "/livez", nil)
+			is.NoErr(err)
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+			is.Equal(rr.Code, http.StatusOK) // server is alive.
+
+			// Check readiness.
+			r, err = http.NewRequest("GET", "/readyz", nil)
+			is.NoErr(err)
+			rr = httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+			is.Equal(rr.Code, tt.ExpectedCode) // readiness code is as expected.
+
+			var body struct {
+				Status string `json:"status"`
+				Checks map[string]struct {
+					Status string `json:"status"`
+				} `json:"checks"`
+			}
+			is.NoErr(json.Unmarshal(rr.Body.Bytes(), &body)) // body is json.
+			is.Equal(body.Status, tt.ExpectedStatus)         // overall status is as expected.
+
+			checks := map[string]string{}
+			for name, c := range body.Checks {
+				checks[name] = c.Status
+			}
+			is.Equal(checks, tt.ExpectedChecks) // check statuses are as expected.
+		})
+	}
+}
+
+func TestHealthChecksCachedAndInstrumented(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	reg := prometheus.NewRegistry()
+
+	var calls int32
+	srv := NewServer(":0", logger, &testAPI{logger},
+		WithRegisterer(reg),
+		WithHealthPaths("/health/live", "/health/ready"),
+		WithHealthCacheTTL(time.Hour),
+		WithHealthChecks(HealthCheck{
+			Name: "db",
+			Check: func(ctx context.Context) error {
+				atomic.AddInt32(&calls, 1)
+				return errors.New("boom")
+			},
+		}),
+	)
+
+	// Probe readiness a few times.
+	for i := 0; i < 3; i++ {
+		r, err := http.NewRequest("GET", "/health/ready", nil)
+		is.NoErr(err)
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, r)
+		is.Equal(rr.Code, http.StatusOK) // non-critical failure is still ready.
+	}
+
+	is.Equal(atomic.LoadInt32(&calls), int32(1)) // check result is cached.
+
+	mfs, err := reg.Gather()
+	is.NoErr(err)
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() == "health_check_status" {
+			found = true
+			is.Equal(mf.GetMetric()[0].GetGauge().GetValue(), float64(0)) // gauge reports the check is failing.
+		}
+	}
+	is.True(found) // gauge is exposed.
+}
+
+func TestReadinessFailsOnShutdown(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	srv := NewManagedServer(":0", logger, &testAPI{logger},
+		WithRegisterer(prometheus.NewRegistry()),
+		WithHealthChecks(HealthCheck{
+			Name:     "db",
+			Check:    func(ctx context.Context) error { return nil },
+			Critical: true,
+		}),
+	)
+
+	// ready returns the readiness response code.
+	ready := func() int {
+		r, _ := http.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	is.Equal(ready(), http.StatusOK) // server is ready.
+
+	is.NoErr(srv.Shutdown(context.Background())) // server shuts down.
+
+	is.Equal(ready(), http.StatusServiceUnavailable) // server is no longer ready.
+}
+
+func TestReadinessFailsOnHTTPServerShutdown(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	srv := NewServer(":0", logger, &testAPI{logger},
+		WithRegisterer(prometheus.NewRegistry()),
+		WithHealthChecks(),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	go srv.Serve(ln) //nolint:errcheck
+
+	res, err := http.Get("http://" + ln.Addr().String() + "/readyz")
+	is.NoErr(err)
+	res.Body.Close()
+	is.Equal(res.StatusCode, http.StatusOK) // server is ready.
+
+	is.NoErr(srv.Shutdown(context.Background())) // server shuts down.
+
+	// Shutdown runs its hooks in the background, so wait for readiness to fail.
+	code := http.StatusOK
+	for deadline := time.Now().Add(time.Second); code == http.StatusOK && time.Now().Before(deadline); {
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		code = rr.Code
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(code, http.StatusServiceUnavailable) // server is no longer ready.
+}
+
+func TestReadinessIgnoresCancelledProbes(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	srv := NewServer(":0", logger, &testAPI{logger},
+		WithRegisterer(prometheus.NewRegistry()),
+		WithHealthChecks(HealthCheck{
+			Name:     "db",
+			Check:    func(ctx context.Context) error { return ctx.Err() },
+			Critical: true,
+		}),
+		WithHealthCacheTTL(time.Minute),
+	)
+
+	// The first probe is cancelled by its caller.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil).WithContext(ctx))
+	is.Equal(rr.Code, http.StatusOK) // checks don't run with the caller's context.
+
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	is.Equal(rr.Code, http.StatusOK) // cached result is unaffected by the cancelled probe.
+}
@@ -0,0 +1,366 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Idempotency is a policy making requests to an endpoint idempotent, by the key
+// in their 'Idempotency-Key' header.
+type Idempotency struct {
+	// TTL is how long responses are kept to be replayed. By default, 24 hours.
+	TTL time.Duration
+	// Required rejects requests without an 'Idempotency-Key' header.
+	Required bool
+}
+
+// defaultIdempotencyTTL is how long responses are kept by default.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the maximum length of an idempotency key.
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyRecord is the stored state of a request with an idempotency key.
+type IdempotencyRecord struct {
+	// Fingerprint identifies the request the key was first used with.
+	Fingerprint string
+	// Complete is whether the request has been responded to. Until then, the
+	// response fields are empty.
+	Complete bool
+	// Status, Header and Body are the response to the request.
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore keeps the responses of requests with idempotency keys, so
+// they can be replayed. Implementations must be safe for concurrent use, and
+// may share state between servers, i.e. via a database.
+type IdempotencyStore interface {
+	// Begin claims the key for a request with the given fingerprint, keeping
+	// an incomplete record for the given TTL. If the key has already been
+	// claimed, its existing record is returned instead, and claimed is false.
+	Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (rec IdempotencyRecord, claimed bool, err error)
+	// Complete stores the response to the request that claimed the key, for
+	// the given TTL.
+	Complete(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) error
+	// Release forgets the key, so the request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// memoryIdempotencyStore is an IdempotencyStore that keeps records in memory.
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]*memoryIdempotencyRecord
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// memoryIdempotencyRecord is a record, and when it can be forgotten.
+type memoryIdempotencyRecord struct {
+	rec     IdempotencyRecord
+	expires time.Time
+}
+
+// idempotencySweepInterval is how often expired records are removed from memory.
+const idempotencySweepInterval = time.Minute
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore that keeps records in
+// memory, so responses are only replayed by the same server.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]*memoryIdempotencyRecord), now: time.Now}
+}
+
+// Begin implements IdempotencyStore.
+func (s *memoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Periodically forget expired records.
+	if now.Sub(s.lastSweep) > idempotencySweepInterval {
+		for k, r := range s.records {
+			if now.After(r.expires) {
+				delete(s.records, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if r, ok := s.records[key]; ok && !now.After(r.expires) {
+		return r.rec, false, nil
+	}
+
+	s.records[key] = &memoryIdempotencyRecord{
+		rec:     IdempotencyRecord{Fingerprint: fingerprint},
+		expires: now.Add(ttl),
+	}
+	return IdempotencyRecord{Fingerprint: fingerprint}, true, nil
+}
+
+// Complete implements IdempotencyStore.
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec.Complete = true
+	s.records[key] = &memoryIdempotencyRecord{rec: rec, expires: s.now().Add(ttl)}
+	return nil
+}
+
+// Release implements IdempotencyStore.
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// IdempotencyMW returns a middleware that makes unsafe requests, i.e. POST,
+// idempotent by the key in their 'Idempotency-Key' header, as defined by the
+// given policy. The first response to a request with a key is stored, and
+// replayed for retries of that request, with an 'Idempotent-Replayed' header.
+// Server errors aren't stored, so those requests can be retried.
+//
+// Reusing a key for a different request, identified by its method, path and
+// body, is responded to with a 422 Unprocessable Entity problem. Retrying a
+// request that is still in progress is responded to with a 409 Conflict
+// problem. Keys are kept separately for each route, and caller, if the request
+// has been authenticated.
+//
+// Requests are counted by a Prometheus Counter, labelled by whether a response
+// was replayed (hit), a new response was stored (miss), or the key was
+// rejected.
+func IdempotencyMW(reg prometheus.Registerer, store IdempotencyStore, policy Idempotency, opts ...MetricsOption) Middleware {
+
+	cfg := newMetricsConfig(opts)
+
+	if policy.TTL <= 0 {
+		policy.TTL = defaultIdempotencyTTL
+	}
+
+	// Create the Counter of requests with idempotency keys. If it has already
+	// been registered, i.e. by another endpoint, use the existing one instead.
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.namespace,
+		Name:        "http_idempotent_requests_total",
+		Help:        "HTTP Requests with an idempotency key",
+		ConstLabels: cfg.constLabels,
+	}, []string{"method", "path", "result"})
+	requests = registerCollector(reg, requests).(*prometheus.CounterVec)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+				// Safe methods are already idempotent.
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				if policy.Required {
+					Error(w, r, "Idempotency-Key header is required", http.StatusBadRequest)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				Error(w, r, "Idempotency-Key header is too long", http.StatusBadRequest)
+				return
+			}
+
+			method, path := r.Method, r.URL.Path
+			if d := getDetails(r); d != nil {
+				method, path = d.Method, d.RequestPath
+			}
+
+			// Read the body, to fingerprint the request, then restore it.
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				if rejectBody(w, r, err) == nil {
+					Error(w, r, "Request body could not be read", http.StatusBadRequest)
+				}
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			h := sha256.New()
+			h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n")) //nolint:errcheck
+			h.Write(body)                                               //nolint:errcheck
+			fingerprint := hex.EncodeToString(h.Sum(nil))
+
+			// Keep keys separately for each route and caller.
+			scoped := method + " " + path + " " + key
+			if id, ok := PrincipalID(r.Context()); ok {
+				scoped += " " + id
+			}
+
+			rec, claimed, err := store.Begin(r.Context(), scoped, fingerprint, policy.TTL)
+			switch {
+			case err != nil:
+				requests.WithLabelValues(method, path, "error").Inc()
+				SpanFromRequest(r).RecordError(err)
+				Error(w, r, "Internal Server Error", http.StatusInternalServerError)
+				return
+			case !claimed && rec.Fingerprint != fingerprint:
+				requests.WithLabelValues(method, path, "mismatch").Inc()
+				Error(w, r, "Idempotency-Key has already been used with a different request", http.StatusUnprocessableEntity)
+				return
+			case !claimed && !rec.Complete:
+				requests.WithLabelValues(method, path, "conflict").Inc()
+				w.Header().Set("Retry-After", "1")
+				Error(w, r, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			case !claimed:
+				requests.WithLabelValues(method, path, "hit").Inc()
+				replay(w, r, rec)
+				return
+			}
+
+			requests.WithLabelValues(method, path, "miss").Inc()
+
+			rw := &recordingWriter{ResponseWriter: w}
+			completed := false
+			defer func() {
+				if !completed {
+					// The handler panicked, so allow the request to be retried.
+					store.Release(context.Background(), scoped) //nolint:errcheck
+				}
+			}()
+
+			next.ServeHTTP(rw, r)
+
+			completed = true
+			if rw.status == 0 || rw.status >= 500 || rw.hijacked {
+				// Nothing was responded, it failed, or it can't be replayed, so allow
+				// the request to be retried.
+				store.Release(r.Context(), scoped) //nolint:errcheck
+				return
+			}
+			rec = IdempotencyRecord{Fingerprint: fingerprint, Status: rw.status, Header: rw.header, Body: rw.body.Bytes()}
+			if err := store.Complete(r.Context(), scoped, rec, policy.TTL); err != nil {
+				SpanFromRequest(r).RecordError(err)
+			}
+		})
+	}
+}
+
+// replay responds with a stored response.
+func replay(w http.ResponseWriter, r *http.Request, rec IdempotencyRecord) {
+	h := w.Header()
+	for k, v := range rec.Header {
+		// Headers already set, i.e. the request's ID, describe this request.
+		if _, ok := h[k]; !ok {
+			h[k] = v
+		}
+	}
+	h.Set("Idempotent-Replayed", "true")
+
+	// Set status code value on request details so other middlewares can access it
+	if d := getDetails(r); d != nil {
+		d.StatusCode = rec.Status
+	}
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body) //nolint:errcheck
+}
+
+// recordingWriter is a http.ResponseWriter that records the response written,
+// as well as writing it. Like responseWriter, it always implements
+// http.Flusher, http.Hijacker, http.Pusher and io.ReaderFrom.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	hijacked bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.status == 0 && !informational(code) {
+		w.status = code
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom implements io.ReaderFrom. The body is copied through Write, so that
+// it is recorded.
+func (w *recordingWriter) ReadFrom(src io.Reader) (int64, error) {
+	// Hide our ReadFrom method from io.Copy, so it isn't called recursively.
+	return io.Copy(struct{ io.Writer }{w}, src)
+}
+
+// Flush implements http.Flusher. It does nothing if the underlying
+// ResponseWriter does not support flushing.
+func (w *recordingWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker. It returns an error if the underlying
+// ResponseWriter does not support hijacking. A hijacked response isn't
+// recorded, as it can't be replayed.
+func (w *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("api: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher. It returns http.ErrNotSupported if the
+// underlying ResponseWriter does not support server push.
+func (w *recordingWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// started reports whether the response has begun.
+func (w *recordingWriter) started() bool {
+	return w.status != 0 || w.hijacked
+}
+
+// WithIdempotencyStore sets the store the responses of idempotent requests are
+// kept in. By default, responses are kept in memory.
+func WithIdempotencyStore(store IdempotencyStore) Option {
+	return func(s *server) {
+		s.idempotencyStore = store
+	}
+}
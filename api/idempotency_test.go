@@ -0,0 +1,173 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestIdempotencyMW(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// Count the side effects of each endpoint.
+	var payments, failures int32
+	started, release := make(chan struct{}), make(chan struct{})
+
+	reg := prometheus.NewRegistry()
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "POST",
+				Path:   "/payments",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Header.Get("X-Slow") != "" {
+						close(started)
+						<-release
+					}
+					n := atomic.AddInt32(&payments, 1)
+					w.Header().Set("Location", "/payments/1")
+					Respond(w, r, http.StatusCreated, map[string]int32{"payment": n})
+				}),
+				Idempotency: &Idempotency{},
+			},
+			{
+				Method: "POST",
+				Path:   "/failures",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&failures, 1)
+					Error(w, r, "Try again", http.StatusServiceUnavailable)
+				}),
+				Idempotency: &Idempotency{Required: true},
+			},
+		}
+	}), WithRegisterer(reg))
+
+	// do makes a request with the given key and body.
+	do := func(path, key, body string, headers ...string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", path, strings.NewReader(body))
+		is.NoErr(err)
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := do("/payments", "key-1", `{"amount":10}`)
+	is.Equal(rr.Code, http.StatusCreated)                // first request is handled.
+	is.Equal(rr.Body.String(), `{"payment":1}`)          // first request has a side effect.
+	is.Equal(rr.Header().Get("Idempotent-Replayed"), "") // first response isn't replayed.
+	firstID := rr.Header().Get("X-Request-ID")
+
+	rr = do("/payments", "key-1", `{"amount":10}`)
+	is.Equal(rr.Code, http.StatusCreated)                    // retry has the same status.
+	is.Equal(rr.Body.String(), `{"payment":1}`)              // retry has the same body.
+	is.Equal(rr.Header().Get("Location"), "/payments/1")     // retry has the same headers.
+	is.Equal(rr.Header().Get("Idempotent-Replayed"), "true") // retry is replayed.
+	is.True(rr.Header().Get("X-Request-ID") != firstID)      // retry has its own request id.
+	is.Equal(atomic.LoadInt32(&payments), int32(1))          // retry has no side effect.
+
+	rr = do("/payments", "key-1", `{"amount":20}`)
+	is.Equal(rr.Code, http.StatusUnprocessableEntity)                     // reusing a key for another request is rejected.
+	is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+
+	rr = do("/payments", "key-2", `{"amount":10}`)
+	is.Equal(rr.Body.String(), `{"payment":2}`) // other keys are handled separately.
+
+	rr = do("/payments", "", `{"amount":10}`)
+	is.Equal(rr.Body.String(), `{"payment":3}`) // requests without a key are handled.
+
+	// A retry while the request is in progress conflicts.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do("/payments", "key-3", `{}`, "X-Slow", "true")
+	}()
+	<-started
+	rr = do("/payments", "key-3", `{}`)
+	is.Equal(rr.Code, http.StatusConflict)        // concurrent retry conflicts.
+	is.Equal(rr.Header().Get("Retry-After"), "1") // client is told when to retry.
+	close(release)
+	<-done
+
+	// Server errors aren't stored, so can be retried.
+	rr = do("/failures", "key-1", `{}`)
+	is.Equal(rr.Code, http.StatusServiceUnavailable) // request fails.
+	rr = do("/failures", "key-1", `{}`)
+	is.Equal(rr.Code, http.StatusServiceUnavailable) // retry is handled again.
+	is.Equal(atomic.LoadInt32(&failures), int32(2))  // retry has a side effect.
+
+	rr = do("/failures", "", `{}`)
+	is.Equal(rr.Code, http.StatusBadRequest) // key is required.
+
+	// Check requests are counted by result.
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http_idempotent_requests_total", Help: "HTTP Requests with an idempotency key"}, []string{"method", "path", "result"})
+	requests = registerCollector(reg, requests).(*prometheus.CounterVec)
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("POST", "/payments", "miss")), float64(3))     // new keys are counted.
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("POST", "/payments", "hit")), float64(1))      // replays are counted.
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("POST", "/payments", "mismatch")), float64(1)) // mismatches are counted.
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("POST", "/payments", "conflict")), float64(1)) // conflicts are counted.
+}
+
+func TestIdempotencyMWKeepsInterfaces(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{{
+			Method: "POST",
+			Path:   "/events",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, flusher := w.(http.Flusher)
+				_, hijacker := w.(http.Hijacker)
+				_, pusher := w.(http.Pusher)
+				_, readerFrom := w.(io.ReaderFrom)
+				if !flusher || !hijacker || !pusher || !readerFrom {
+					http.Error(w, "interfaces are missing", http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte("event 1\n")) //nolint:errcheck
+				w.(http.Flusher).Flush()
+				io.Copy(w, strings.NewReader("event 2\n")) //nolint:errcheck
+			}),
+			Idempotency: &Idempotency{},
+		}}
+	}), WithRegisterer(prometheus.NewRegistry()))
+
+	// Create test server from real server
+	s := httptest.NewServer(srv.Handler)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", s.URL+"/events", nil)
+		is.NoErr(err)
+		req.Header.Set("Idempotency-Key", "key-1")
+		resp, err := http.DefaultClient.Do(req)
+		is.NoErr(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		is.NoErr(err)
+		resp.Body.Close()
+		is.Equal(resp.StatusCode, http.StatusOK)     // writer implements the optional interfaces.
+		is.Equal(string(body), "event 1\nevent 2\n") // streamed body is recorded, and replayed.
+	}
+}
@@ -0,0 +1,434 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha512" // Register SHA-384 and SHA-512, for HS384, HS512 etc.
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrKeyNotFound is returned by a KeySet that has no key with the requested ID.
+var ErrKeyNotFound = errors.New("api: key not found")
+
+// JSONWebKey is a key that JWTs are verified with.
+type JSONWebKey struct {
+	// KeyID is the 'kid' of the key, which tokens refer to.
+	KeyID string
+	// Algorithm is the 'alg' the key must be used with. If empty, any algorithm
+	// matching the type of key may be used.
+	Algorithm string
+	// Key is the key itself, which is a *rsa.PublicKey, *ecdsa.PublicKey or,
+	// for HMAC algorithms, a []byte secret.
+	Key interface{}
+}
+
+// KeySet provides the keys JWTs are verified with, i.e. from a JSON Web Key Set
+// (RFC 7517) published by an identity provider.
+type KeySet interface {
+	// Key returns the key with the given ID, or ErrKeyNotFound if there is none.
+	// The ID is empty for tokens that don't specify one.
+	Key(ctx context.Context, kid string) (JSONWebKey, error)
+}
+
+// staticKeySet is a KeySet of fixed keys.
+type staticKeySet struct {
+	mu   sync.RWMutex
+	keys []JSONWebKey
+}
+
+// StaticKeySet returns a KeySet of the given keys. If a token doesn't specify
+// a key ID, the only key is used.
+func StaticKeySet(keys ...JSONWebKey) KeySet {
+	return &staticKeySet{keys: keys}
+}
+
+// Key implements KeySet.
+func (s *staticKeySet) Key(ctx context.Context, kid string) (JSONWebKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if kid == "" && len(s.keys) == 1 {
+		return s.keys[0], nil
+	}
+	for _, k := range s.keys {
+		if k.KeyID == kid {
+			return k, nil
+		}
+	}
+	return JSONWebKey{}, ErrKeyNotFound
+}
+
+// FileKeySet is a KeySet read from a local JSON Web Key Set file. It stands in
+// for an identity provider's published key set, i.e. in development and tests.
+type FileKeySet struct {
+	staticKeySet
+	path string
+}
+
+// NewFileKeySet returns a KeySet of the keys in the JSON Web Key Set file at
+// the given path.
+func NewFileKeySet(path string) (*FileKeySet, error) {
+	s := &FileKeySet{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the key set file again, i.e. once keys have been rotated.
+func (s *FileKeySet) Reload() error {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(b)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	return nil
+}
+
+// ParseJWKS parses a JSON Web Key Set. RSA, EC (P-256, P-384 and P-521) and
+// symmetric ('oct') keys are supported, other keys are skipped.
+func ParseJWKS(data []byte) ([]JSONWebKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]JSONWebKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key, err = parseECJWK(k.Crv, k.X, k.Y)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(k.K)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("api: invalid key %q: %w", k.Kid, err)
+		}
+
+		keys = append(keys, JSONWebKey{KeyID: k.Kid, Algorithm: k.Alg, Key: key})
+	}
+	return keys, nil
+}
+
+// parseRSAJWK returns the RSA public key of the given JWK parameters.
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+// parseECJWK returns the EC public key of the given JWK parameters.
+func parseECJWK(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on curve")
+	}
+	return key, nil
+}
+
+// JWTConfig configures how JWT bearer tokens are verified.
+type JWTConfig struct {
+	// Keys provides the keys tokens are verified with.
+	Keys KeySet
+	// Algorithms are the signing algorithms accepted. By default, all of
+	// HS256, HS384, HS512, RS256, RS384, RS512, ES256, ES384 and ES512 are.
+	Algorithms []string
+	// Issuer, if set, must match the 'iss' claim of tokens.
+	Issuer string
+	// Audience, if set, must be one of the 'aud' claims of tokens.
+	Audience string
+	// Leeway allows for clock skew when checking the 'exp' and 'nbf' claims.
+	Leeway time.Duration
+	// Realm is included in the 'WWW-Authenticate' challenge.
+	Realm string
+}
+
+// jwtAlgorithms are the supported signing algorithms, and their hash functions.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// jwtCurveSizes are the sizes of the curves each ECDSA algorithm must use.
+var jwtCurveSizes = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// jwtAuthenticator authenticates requests by a JWT bearer token.
+type jwtAuthenticator struct {
+	cfg        JWTConfig
+	algorithms map[string]bool
+	now        func() time.Time
+}
+
+// JWTAuthenticator returns an Authenticator of JWT bearer tokens (RFC 7519),
+// sent in the Authorization header. The caller's ID is the token's 'sub' claim,
+// and all of the token's claims are kept on the Principal.
+func JWTAuthenticator(cfg JWTConfig) Authenticator {
+	algs := cfg.Algorithms
+	if len(algs) == 0 {
+		for alg := range jwtAlgorithms {
+			algs = append(algs, alg)
+		}
+	}
+	a := &jwtAuthenticator{cfg: cfg, algorithms: make(map[string]bool), now: time.Now}
+	for _, alg := range algs {
+		a.algorithms[alg] = true
+	}
+	return a
+}
+
+// Authenticate implements Authenticator.
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if !hasAuthScheme(r, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	token := strings.TrimSpace(r.Header.Get("Authorization")[len("Bearer "):])
+
+	claims, err := a.verify(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, invalidToken("token has no subject")
+	}
+
+	return &Principal{ID: sub, Method: "jwt", Claims: claims}, nil
+}
+
+// Challenge implements Authenticator.
+func (a *jwtAuthenticator) Challenge(err error) string {
+	c := "Bearer"
+	if a.cfg.Realm != "" {
+		c += fmt.Sprintf(" realm=%q", a.cfg.Realm)
+	}
+	var te *tokenError
+	if errors.As(err, &te) {
+		if a.cfg.Realm != "" {
+			c += ","
+		}
+		c += fmt.Sprintf(" error=\"invalid_token\", error_description=%q", te.reason)
+	}
+	return c
+}
+
+// tokenError describes why a token is invalid.
+type tokenError struct {
+	reason string
+}
+
+// Error implements error.
+func (e *tokenError) Error() string {
+	return "api: invalid token: " + e.reason
+}
+
+// Unwrap allows a tokenError to be identified as ErrInvalidCredentials.
+func (e *tokenError) Unwrap() error {
+	return ErrInvalidCredentials
+}
+
+// invalidToken returns an error describing why a token is invalid.
+func invalidToken(reason string) error {
+	return &tokenError{reason: reason}
+}
+
+// verify verifies the signature and claims of the given token, returning its claims.
+func (a *jwtAuthenticator) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("token is malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, invalidToken("token header is malformed")
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok || !a.algorithms[header.Alg] {
+		return nil, invalidToken("token algorithm is not allowed")
+	}
+
+	key, err := a.cfg.Keys.Key(ctx, header.Kid)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, invalidToken("token key is unknown")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != "" && key.Algorithm != header.Alg {
+		return nil, invalidToken("token algorithm does not match key")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("token signature is malformed")
+	}
+	if !verifyJWTSignature(header.Alg, key.Key, parts[0]+"."+parts[1], sig) {
+		return nil, invalidToken("token signature is invalid")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, invalidToken("token claims are malformed")
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// checkClaims checks the registered claims of a token.
+func (a *jwtAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := a.now()
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(a.cfg.Leeway)) {
+		return invalidToken("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-a.cfg.Leeway)) {
+		return invalidToken("token is not valid yet")
+	}
+	if a.cfg.Issuer != "" && claims["iss"] != a.cfg.Issuer {
+		return invalidToken("token issuer is not accepted")
+	}
+	if a.cfg.Audience != "" {
+		var found bool
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == a.cfg.Audience
+		case []interface{}:
+			for _, v := range aud {
+				found = found || v == a.cfg.Audience
+			}
+		}
+		if !found {
+			return invalidToken("token audience is not accepted")
+		}
+	}
+	return nil
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token into v.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifyJWTSignature reports whether sig is a valid signature of the signing
+// input, using the given algorithm and key. The key must be of the type the
+// algorithm requires, so that i.e. a public key cannot be used as an HMAC secret.
+func verifyJWTSignature(alg string, key interface{}, input string, sig []byte) bool {
+	hash := jwtAlgorithms[alg]
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(input)) //nolint:errcheck
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+
+	h := hash.New()
+	h.Write([]byte(input)) //nolint:errcheck
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().BitSize != jwtCurveSizes[alg] {
+			return false
+		}
+		// The signature is the concatenation of r and s, each the size of the curve.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultShutdownTimeout is how long a server waits for in flight requests to
+// complete during shutdown, if no other timeout is configured.
+const defaultShutdownTimeout = 15 * time.Second
+
+// ShutdownHook is a function that is run once a server has stopped serving
+// requests, i.e. to close database connections or flush buffers.
+type ShutdownHook func(ctx context.Context) error
+
+// Server is a HTTP server for accessing an API, that also manages its own
+// lifecycle. Use Run to serve requests until the process is signalled to stop.
+type Server struct {
+	*http.Server
+	s *server
+}
+
+// NewManagedServer returns a Server for accessing the given API. Unlike
+// NewServer, the returned server can be run with Run, which handles graceful
+// shutdown. Like NewServer, it panics if the API's endpoints are invalid.
+func NewManagedServer(addr string, logger *zap.SugaredLogger, a API, opts ...Option) *Server {
+
+	s, err := newServer(logger, a, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     s,
+		ReadTimeout: s.readTimeout,
+	}
+
+	// Readiness should fail as soon as shutdown begins, however it was started.
+	srv.RegisterOnShutdown(s.beginShutdown)
+
+	return &Server{
+		Server: srv,
+		s:      s,
+	}
+}
+
+// Ready reports whether the server is ready to accept requests. It returns
+// false once the server has begun to shutdown.
+func (s *Server) Ready() bool {
+	return s.s.ready()
+}
+
+// Shutdown marks the server as not ready, then gracefully shuts it down in the
+// same way as http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.s.beginShutdown()
+	return s.Server.Shutdown(ctx)
+}
+
+// Run listens on the server's address and serves requests until either the
+// given context is done, or SIGINT or SIGTERM is received. The server then
+// stops accepting new connections, marks itself as not ready, waits for in
+// flight requests to complete, up to the shutdown timeout, and finally runs
+// any registered shutdown hooks.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.serve(ctx, ln)
+}
+
+// serve implements Run, using the given listener.
+func (s *Server) serve(ctx context.Context, ln net.Listener) error {
+
+	signals := s.s.signals
+	if signals == nil {
+		// Listen for OS signals if no other signal source has been configured.
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(c)
+		signals = c
+	}
+
+	// Serve requests in the background, so we can wait for a reason to stop.
+	errs := make(chan error, 1)
+	go func() {
+		s.s.logger.Infow("server starting", "addr", ln.Addr().String())
+		errs <- s.Server.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			// The server failed, so there is nothing to shutdown.
+			return err
+		}
+		s.s.logger.Infow("shutdown started", "reason", "server closed")
+	case <-ctx.Done():
+		s.s.logger.Infow("shutdown started", "reason", "context done")
+	case sig := <-signals:
+		s.s.logger.Infow("shutdown started", "reason", "signal received", "signal", sig.String())
+	}
+
+	return s.shutdown()
+}
+
+// shutdown gracefully stops the server, and runs all registered shutdown hooks.
+func (s *Server) shutdown() error {
+
+	timeout := s.s.shutdownTimeout
+
+	// Mark the server as not ready first, so that probes fail as soon as possible.
+	s.s.beginShutdown()
+
+	s.s.logger.Infow("draining requests",
+		"in_flight", atomic.LoadInt32(&s.s.inflight),
+		"timeout", timeout.String(),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop accepting new connections, and wait for idle connections.
+	err := s.Server.Shutdown(ctx)
+	if err == nil {
+		// Wait for requests that are no longer tied to a connection the http.Server
+		// tracks, i.e. hijacked connections.
+		err = s.s.waitInFlight(ctx)
+	}
+	if err != nil {
+		s.s.logger.Warnw("drain timeout exceeded, closing connections",
+			"in_flight", atomic.LoadInt32(&s.s.inflight),
+			"error", err,
+		)
+		//nolint:errcheck
+		s.Server.Close()
+	}
+
+	// Give shutdown hooks their own deadline, so that a slow drain does not
+	// prevent them from running.
+	hctx, hcancel := context.WithTimeout(context.Background(), timeout)
+	defer hcancel()
+
+	s.s.logger.Infow("running shutdown hooks", "hooks", len(s.s.shutdownHooks))
+	for _, h := range s.s.shutdownHooks {
+		if herr := h(hctx); herr != nil {
+			s.s.logger.Errorw("shutdown hook failed", "error", herr)
+			if err == nil {
+				err = herr
+			}
+		}
+	}
+
+	s.s.logger.Infow("server stopped")
+
+	return err
+}
+
+// beginShutdown marks the server as shutting down.
+func (s *server) beginShutdown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// ready reports whether the server has not yet begun to shutdown.
+func (s *server) ready() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 0
+}
+
+// waitInFlight blocks until there are no in flight requests, or the given
+// context is done.
+func (s *server) waitInFlight(ctx context.Context) error {
+	// Poll, in the same way as http.Server.Shutdown does for idle connections.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt32(&s.inflight) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WithShutdownTimeout sets how long the server waits for in flight requests to
+// complete when shutting down.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithShutdownHook adds a hook that is run after the server has stopped
+// serving requests. Hooks are run in the order they are added.
+func WithShutdownHook(h ShutdownHook) Option {
+	return func(s *server) {
+		s.shutdownHooks = append(s.shutdownHooks, h)
+	}
+}
+
+// WithSignals sets the channel the server listens on for shutdown signals,
+// instead of listening for SIGINT and SIGTERM.
+func WithSignals(c <-chan os.Signal) Option {
+	return func(s *server) {
+		s.signals = c
+	}
+}
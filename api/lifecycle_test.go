@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// blockingAPI is an API with a single endpoint that blocks until released.
+type blockingAPI struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingAPI) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method: "GET",
+			Path:   "/block",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(a.entered)
+				<-a.release
+				Respond(w, r, http.StatusOK, map[string]string{"status": "ok"})
+			}),
+		},
+	}
+}
+
+func TestServerRunGracefulShutdown(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	// Create a fake signal source.
+	signals := make(chan os.Signal, 1)
+
+	// Record when the shutdown hook is run.
+	hookRun := make(chan struct{})
+
+	a := &blockingAPI{make(chan struct{}), make(chan struct{})}
+
+	srv := NewManagedServer(":0", logger, a,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithSignals(signals),
+		WithShutdownTimeout(5*time.Second),
+		WithShutdownHook(func(ctx context.Context) error {
+			close(hookRun)
+			return nil
+		}),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err) // listener created.
+
+	// Run the server in the background.
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.serve(context.Background(), ln)
+	}()
+
+	is.True(srv.Ready()) // server is ready before shutdown.
+
+	// Make a request that will be in flight during shutdown.
+	type result struct {
+		code int
+		body string
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/block")
+		if err != nil {
+			results <- result{}
+			return
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		results <- result{resp.StatusCode, string(buf)}
+	}()
+
+	// Wait for the request to reach the handler, then signal shutdown.
+	<-a.entered
+	signals <- syscall.SIGTERM
+
+	// Wait for readiness to flip.
+	for srv.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-hookRun:
+		t.Fatal("shutdown hook run before in flight request completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Let the in flight request complete.
+	close(a.release)
+
+	res := <-results
+	is.Equal(res.code, http.StatusOK)     // in flight request completed.
+	is.Equal(res.body, `{"status":"ok"}`) // in flight request body is as expected.
+	is.NoErr(<-done)                      // server shutdown cleanly.
+
+	// Check shutdown hook has been run.
+	<-hookRun
+
+	// Check shutdown phases are logged.
+	started := logs.FilterMessage("shutdown started").All()
+	is.Equal(len(started), 1)                                          // shutdown start is logged.
+	is.Equal(started[0].ContextMap()["signal"].(string), "terminated") // signal is logged.
+	is.Equal(logs.FilterMessage("draining requests").Len(), 1)         // drain is logged.
+	is.Equal(logs.FilterMessage("server stopped").Len(), 1)            // final phase is logged.
+}
+
+func TestServerRunShutdownTimeout(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	hookRun := false
+
+	a := &blockingAPI{make(chan struct{}), make(chan struct{})}
+	defer close(a.release)
+
+	srv := NewManagedServer(":0", logger, a,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithSignals(make(chan os.Signal)),
+		WithShutdownTimeout(50*time.Millisecond),
+		WithShutdownHook(func(ctx context.Context) error {
+			hookRun = true
+			return nil
+		}),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err) // listener created.
+
+	// Run the server in the background, stopping it via the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.serve(ctx, ln)
+	}()
+
+	// Make a request that never completes within the shutdown timeout.
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/block")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-a.entered
+	cancel()
+
+	err = <-done
+	is.Equal(err, context.DeadlineExceeded)                                              // drain timed out.
+	is.True(hookRun)                                                                     // shutdown hook still run.
+	is.Equal(logs.FilterMessage("drain timeout exceeded, closing connections").Len(), 1) // timeout is logged.
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrBodyTooLarge is returned when reading a request body that is larger than
+// the maximum body size of its endpoint.
+var ErrBodyTooLarge = errors.New("api: request body too large")
+
+// ErrBodyTooDeep is returned by Decode when a JSON request body is nested more
+// deeply than the server's maximum depth.
+var ErrBodyTooDeep = errors.New("api: request body nested too deeply")
+
+// ErrBodyReadTimeout is returned by Decode when the request body could not be
+// read within the server's read timeout.
+var ErrBodyReadTimeout = errors.New("api: request body read timed out")
+
+// Reasons a request body can be rejected, used as the 'reason' label of the
+// rejection metric.
+const (
+	rejectBodyTooLarge    = "body_too_large"
+	rejectBodyTooDeep     = "body_too_deep"
+	rejectBodyReadTimeout = "read_timeout"
+)
+
+// newRejectionCounter returns a counter of requests whose bodies were rejected,
+// by reason. If an identical counter has already been registered, i.e. by
+// another server, that counter is shared.
+func newRejectionCounter(reg prometheus.Registerer, cfg metricsConfig) *prometheus.CounterVec {
+	rejected := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.namespace,
+		Name:        "http_requests_rejected_total",
+		Help:        "HTTP Requests Rejected due to their body exceeding a limit",
+		ConstLabels: cfg.constLabels,
+	}, []string{"method", "path", "reason"})
+
+	return registerCollector(reg, rejected).(*prometheus.CounterVec)
+}
+
+// rejectBody responds to a request whose body exceeded one of the server's
+// limits with a problem, and counts the rejection. The error describing which
+// limit was exceeded is returned, or nil if err wasn't caused by a limit, in
+// which case nothing is responded with.
+func rejectBody(w http.ResponseWriter, r *http.Request, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var netErr net.Error
+
+	var reason, detail string
+	var code int
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		reason, code, detail = rejectBodyTooLarge, http.StatusRequestEntityTooLarge, "Request body is too large"
+		err = ErrBodyTooLarge
+	case errors.Is(err, ErrBodyTooDeep):
+		reason, code, detail = rejectBodyTooDeep, http.StatusBadRequest, "Request body is nested too deeply"
+		err = ErrBodyTooDeep
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason, code, detail = rejectBodyReadTimeout, http.StatusRequestTimeout, "Request body was not received in time"
+		err = ErrBodyReadTimeout
+	default:
+		return nil
+	}
+
+	if d := getDetails(r); d != nil && d.rejected != nil {
+		d.rejected.WithLabelValues(d.Method, d.RequestPath, reason).Inc()
+	}
+
+	Error(w, r, detail, code)
+
+	return err
+}
+
+// requestBody returns the reader the request's body should be decoded from.
+// JSON bodies, of the 'application/json' or any '+json' media type, are limited
+// to the server's maximum depth, whichever codec decodes them.
+func requestBody(r *http.Request) io.Reader {
+	if !isJSONMediaType(r.Header.Get("Content-Type")) {
+		return r.Body
+	}
+	if d := getDetails(r); d != nil && d.maxJSONDepth > 0 {
+		return &depthReader{r: r.Body, max: d.maxJSONDepth}
+	}
+	return r.Body
+}
+
+// isJSONMediaType reports whether the given content type is JSON, i.e.
+// 'application/json' or 'application/merge-patch+json'. Bodies without a content
+// type are decoded as JSON, so are JSON too.
+func isJSONMediaType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == MediaTypeJSON || strings.HasSuffix(mt, "+json")
+}
+
+// limitedBody is a request body that returns ErrBodyTooLarge once more than
+// the maximum number of bytes have been read. Unlike io.LimitReader, this
+// allows a body that is too large to be told apart from one that ends.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+// newLimitedBody returns body, limited to max bytes. If the request's content
+// length is already known to be too large, the body fails without being read.
+func newLimitedBody(body io.ReadCloser, contentLength, max int64) io.ReadCloser {
+	b := &limitedBody{ReadCloser: body, remaining: max}
+	if contentLength > max {
+		b.err = ErrBodyTooLarge
+	}
+	return b
+}
+
+// Read implements io.Reader.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	// Read at most one byte more than allowed, to tell if the limit is exceeded.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.err = ErrBodyTooLarge
+		return n, b.err
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// depthReader is a reader of JSON that returns ErrBodyTooDeep once the JSON
+// read is nested more deeply than the maximum depth. This stops deeply nested
+// bodies from being decoded at all, rather than after the fact.
+type depthReader struct {
+	r        io.Reader
+	max      int
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+// Read implements io.Reader.
+func (d *depthReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	for _, c := range p[:n] {
+		switch {
+		case d.escaped:
+			d.escaped = false
+		case d.inString && c == '\\':
+			d.escaped = true
+		case c == '"':
+			d.inString = !d.inString
+		case d.inString:
+		case c == '{' || c == '[':
+			d.depth++
+			if d.depth > d.max {
+				return 0, ErrBodyTooDeep
+			}
+		case c == '}' || c == ']':
+			d.depth--
+		}
+	}
+	return n, err
+}
+
+// WithMaxBodyBytes sets the maximum size, in bytes, of request bodies accepted
+// by the server's endpoints, unless an endpoint sets its own maximum. Decode
+// responds to bodies larger than this with a 413 Payload Too Large problem. By
+// default, request bodies are not limited.
+func WithMaxBodyBytes(n int64) Option {
+	return func(s *server) {
+		s.maxBodyBytes = n
+	}
+}
+
+// WithMaxJSONDepth sets how deeply JSON request bodies may be nested, counting
+// each object and array. Bodies are JSON if their content type is
+// 'application/json', or has the '+json' suffix, whichever codec is registered
+// to decode them. Decode responds to bodies nested more deeply than
+// this with a 400 Bad Request problem. By default, nesting is not limited.
+func WithMaxJSONDepth(depth int) Option {
+	return func(s *server) {
+		s.maxJSONDepth = depth
+	}
+}
+
+// WithReadTimeout sets the maximum duration for reading an entire request,
+// including its body, so that clients which send their body slowly cannot hold
+// on to the server's resources. Decode responds to bodies that are not received
+// in time with a 408 Request Timeout problem.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.readTimeout = d
+	}
+}
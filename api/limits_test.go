@@ -0,0 +1,208 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// limitsAPI returns an API whose endpoints decode their request bodies.
+func limitsAPI() API {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		if err := Decode(w, r, &body); err != nil {
+			return
+		}
+		Respond(w, r, http.StatusOK, body)
+	})
+
+	return apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "POST", Path: "/small", Handler: h},
+			{Method: "POST", Path: "/large", Handler: h, MaxBodyBytes: 64},
+			{Method: "POST", Path: "/unlimited", Handler: h, MaxBodyBytes: -1},
+		}
+	})
+}
+
+// customJSONCodec is a JSON codec other than JSONCodec.
+type customJSONCodec struct{}
+
+// Decode implements Codec.
+func (customJSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// Encode implements Codec.
+func (customJSONCodec) Encode(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func TestBodyLimits(t *testing.T) {
+
+	tests := []struct {
+		Name           string
+		Path           string
+		ContentType    string
+		Body           string
+		ChunkedBody    bool
+		ExpectedCode   int
+		ExpectedReason string
+	}{
+		{
+			Name:         "body within server limit",
+			Path:         "/small",
+			Body:         `{"a":[1]}`,
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:           "body over server limit",
+			Path:           "/small",
+			Body:           `{"a":"Brown Betty"}`,
+			ExpectedCode:   http.StatusRequestEntityTooLarge,
+			ExpectedReason: "body_too_large",
+		},
+		{
+			Name:           "body of unknown length over server limit",
+			Path:           "/small",
+			Body:           `{"a":"Brown Betty"}`,
+			ChunkedBody:    true,
+			ExpectedCode:   http.StatusRequestEntityTooLarge,
+			ExpectedReason: "body_too_large",
+		},
+		{
+			Name:         "body within endpoint limit",
+			Path:         "/large",
+			Body:         `{"a":"Brown Betty"}`,
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:         "body without limit",
+			Path:         "/unlimited",
+			Body:         fmt.Sprintf(`{"a":%q}`, strings.Repeat("x", 1024)),
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:         "brackets within strings are not nesting",
+			Path:         "/large",
+			Body:         `{"a":"[[[{{{\"]]]"}`,
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:           "body nested too deeply",
+			Path:           "/large",
+			Body:           `{"a":[{"b":1}]}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedReason: "body_too_deep",
+		},
+		{
+			Name:           "body decoded by custom json codec nested too deeply",
+			Path:           "/large",
+			ContentType:    "application/json; charset=utf-8",
+			Body:           `{"a":[{"b":1}]}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedReason: "body_too_deep",
+		},
+		{
+			Name:           "json suffixed body nested too deeply",
+			Path:           "/large",
+			ContentType:    "application/merge-patch+json",
+			Body:           `{"a":[{"b":1}]}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedReason: "body_too_deep",
+		},
+		{
+			Name:         "body decoded by custom json codec within limits",
+			Path:         "/large",
+			ContentType:  "application/json",
+			Body:         `{"a":[1]}`,
+			ExpectedCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger.
+			logger, _ := newTestLogger(zap.InfoLevel)
+
+			// Create a server with body limits.
+			srv := NewServer(":0", logger, limitsAPI(), WithRegisterer(prometheus.NewRegistry()), WithMaxBodyBytes(16), WithMaxJSONDepth(2), WithCodec(MediaTypeJSON, customJSONCodec{}))
+
+			r, err := http.NewRequest("POST", tt.Path, strings.NewReader(tt.Body))
+			is.NoErr(err)
+			if tt.ContentType != "" {
+				r.Header.Set("Content-Type", tt.ContentType)
+			}
+			if tt.ChunkedBody {
+				r.ContentLength = -1
+			}
+
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode) // response code is as expected.
+
+			if tt.ExpectedReason == "" {
+				is.Equal(rr.Body.String(), tt.Body) // body is decoded.
+				return
+			}
+
+			is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+
+			count := testutil.ToFloat64(srv.Handler.(*server).rejected.WithLabelValues("POST", tt.Path, tt.ExpectedReason))
+			is.Equal(count, float64(1)) // rejection is counted by reason.
+		})
+	}
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// Create a server with a short read timeout.
+	srv := NewServer(":0", logger, limitsAPI(), WithRegisterer(prometheus.NewRegistry()), WithReadTimeout(100*time.Millisecond))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	go srv.Serve(ln) //nolint:errcheck
+	defer srv.Close()
+
+	// Send only part of the request body, as a slow client would.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	is.NoErr(err)
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "POST /small HTTP/1.1\r\nHost: kit\r\nContent-Length: 10\r\n\r\n{\"a\"")
+	is.NoErr(err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	is.NoErr(err)
+	defer resp.Body.Close()
+
+	is.Equal(resp.StatusCode, http.StatusRequestTimeout) // slow body is rejected.
+
+	count := testutil.ToFloat64(srv.Handler.(*server).rejected.WithLabelValues("POST", "/small", "read_timeout"))
+	is.Equal(count, float64(1)) // rejection is counted by reason.
+}
@@ -2,46 +2,52 @@ package api
 
 import (
 	"net/http"
-	"time"
 
 	"go.uber.org/zap"
 )
 
 // LogMW returns a middleware that implements request + response detail logging.
-// The middleware will log upon response.
+// The middleware will log upon response. It is AccessLogMW, with its defaults.
 func LogMW(logger *zap.SugaredLogger) Middleware {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				// Retrieve detail state of this request
-				d := getDetails(r)
-				if d == nil {
-					// There's nothing more to do if we can't find the details.
-					return
-				}
-
-				logger.Infow("request",
-					"request_id", d.RequestID,
-					"method", d.Method,
-					"path", r.URL.Path,
-					"status", d.StatusCode,
-					"duration", time.Since(d.Now).String(),
-				)
-			}()
-			// Call the wrapped handler
-			next.ServeHTTP(w, r)
-		})
-	}
+	return AccessLogMW(logger)
 }
 
 // LoggerFromRequest returns a child logger of the given logger with predefined
 // fields. It should be used when logging from within a request handler, so that
-// those logs can be correlated.
+// those logs can be correlated. If the server redacts sensitive data, so does
+// the returned logger.
 func LoggerFromRequest(r *http.Request, l *zap.SugaredLogger) *zap.SugaredLogger {
 	d := getDetails(r)
 	if d == nil {
 		return l
 	}
 
-	return l.With("request_id", d.RequestID)
+	if d.redactor != nil {
+		l = RedactLogger(l, d.redactor)
+	}
+
+	return l.With(append([]interface{}{"request_id", d.RequestID}, requestFields(d)...)...)
+}
+
+// versionFields returns the log field of the version of the endpoint handling
+// the request, if it is versioned.
+func versionFields(d *details) []interface{} {
+	if d.apiVersion == "" {
+		return nil
+	}
+	return []interface{}{"version", d.apiVersion}
+}
+
+// requestFields returns the log fields identifying the trace and span of the
+// request, if it is being traced, and its caller, if it has been authenticated.
+func requestFields(d *details) []interface{} {
+	var fields []interface{}
+	if d.span != nil {
+		sc := d.span.SpanContext()
+		fields = append(fields, "trace_id", sc.TraceID.String(), "span_id", sc.SpanID.String())
+	}
+	if d.principal != nil {
+		fields = append(fields, "principal_id", d.principal.ID)
+	}
+	return fields
 }
@@ -66,6 +66,7 @@ func TestLogMW(t *testing.T) {
 	is.Equal(mwll.Message, "request")                         // log line message is 'request'.
 	is.Equal(mwll.ContextMap()["method"].(string), "GET")     // log line method field is 'GET'.
 	is.Equal(mwll.ContextMap()["path"].(string), "/status")   // log line path field is '/status', not '/*path'.
+	is.Equal(mwll.ContextMap()["route"].(string), "/:path")   // log line route field is the matched path.
 	is.Equal(mwll.ContextMap()["status"].(int64), int64(202)) // log line status field is '202'.
 	is.True(mwll.ContextMap()["request_id"].(string) != "")   // log line request_id field isn't empty.
 	is.True(mwll.ContextMap()["duration"].(string) != "")     // log line duration field isn't empty.
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LogSampling is a policy deciding which requests to an endpoint are logged,
+// to reduce the logs of high-volume endpoints. Requests that fail, or are
+// slow, are always logged. Of the other requests, the first First each second
+// are logged, then 1 in every Thereafter. If neither First nor Thereafter are
+// set, a random Rate of them are logged instead.
+type LogSampling struct {
+	// ErrorStatus is the status from which requests are always logged. By
+	// default, 400, so all client and server errors are logged.
+	ErrorStatus int
+	// SlowerThan is the duration from which requests are always logged. If
+	// zero, requests aren't logged for being slow.
+	SlowerThan time.Duration
+	// First is the number of requests logged each second, before only 1 in
+	// every Thereafter are logged.
+	First      int
+	Thereafter int
+	// Rate is the fraction, from 0 to 1, of requests logged, if neither First
+	// nor Thereafter are set. If zero, only failed and slow requests are logged.
+	Rate float64
+}
+
+// defaultLogSamplingErrorStatus is the status from which requests are always
+// logged by default.
+const defaultLogSamplingErrorStatus = 400
+
+// logSampler decides which requests are logged, by a LogSampling policy.
+type logSampler struct {
+	policy  LogSampling
+	dropped *prometheus.CounterVec
+
+	mu     sync.Mutex
+	second time.Time
+	count  int
+
+	now   func() time.Time
+	float func() float64
+}
+
+// newLogSampler returns a sampler for the given policy, which counts the log
+// lines it drops with a Prometheus Counter registered with reg.
+func newLogSampler(reg prometheus.Registerer, policy LogSampling, opts []MetricsOption) *logSampler {
+
+	cfg := newMetricsConfig(opts)
+
+	if policy.ErrorStatus <= 0 {
+		policy.ErrorStatus = defaultLogSamplingErrorStatus
+	}
+
+	// Create the Counter of dropped log lines. If it has already been
+	// registered, i.e. by another endpoint, use the existing one instead.
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.namespace,
+		Name:        "http_log_lines_dropped_total",
+		Help:        "HTTP Request log lines dropped by sampling",
+		ConstLabels: cfg.constLabels,
+	}, []string{"method", "path"})
+	dropped = registerCollector(reg, dropped).(*prometheus.CounterVec)
+
+	return &logSampler{
+		policy:  policy,
+		dropped: dropped,
+		now:     time.Now,
+		float:   rand.Float64,
+	}
+}
+
+// sample reports whether the request should be logged, counting it as
+// dropped if not.
+func (s *logSampler) sample(d *details, duration time.Duration) bool {
+	p := s.policy
+
+	if d.StatusCode >= p.ErrorStatus || (p.SlowerThan > 0 && duration >= p.SlowerThan) {
+		return true
+	}
+
+	keep := false
+	if p.First > 0 || p.Thereafter > 0 {
+		s.mu.Lock()
+		if second := s.now().Truncate(time.Second); !second.Equal(s.second) {
+			s.second = second
+			s.count = 0
+		}
+		s.count++
+		n := s.count
+		s.mu.Unlock()
+
+		keep = n <= p.First || (p.Thereafter > 0 && (n-p.First)%p.Thereafter == 0)
+	} else {
+		keep = p.Rate > 0 && s.float() < p.Rate
+	}
+
+	if !keep {
+		s.dropped.WithLabelValues(d.Method, d.RequestPath).Inc()
+	}
+	return keep
+}
+
+// AccessLogSampling samples the requests that are logged, by the given policy.
+// Log lines that are dropped are counted by a Prometheus Counter, registered
+// with reg, labelled by method and path.
+func AccessLogSampling(reg prometheus.Registerer, policy LogSampling, opts ...MetricsOption) AccessLogOption {
+	return func(c *accessLogConfig) {
+		c.sampler = newLogSampler(reg, policy, opts)
+	}
+}
+
+// WithLogSampling sets the log sampling policy of each of the server's
+// endpoints, unless an endpoint sets its own policy. See LogSampling.
+func WithLogSampling(policy LogSampling) Option {
+	return func(s *server) {
+		s.logSampling = &policy
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestLogSampler(t *testing.T) {
+
+	is := is.New(t)
+
+	s := newLogSampler(prometheus.NewRegistry(), LogSampling{First: 2, Thereafter: 3, SlowerThan: time.Second}, nil)
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	ok := &details{Method: "GET", RequestPath: "/items", StatusCode: http.StatusOK}
+	failed := &details{Method: "GET", RequestPath: "/items", StatusCode: http.StatusServiceUnavailable}
+	missing := &details{Method: "GET", RequestPath: "/items", StatusCode: http.StatusNotFound}
+
+	var kept []int
+	for n := 1; n <= 10; n++ {
+		if s.sample(ok, time.Millisecond) {
+			kept = append(kept, n)
+		}
+	}
+	is.Equal(kept, []int{1, 2, 5, 8}) // the first requests are logged, then 1 in every 3.
+
+	is.True(s.sample(failed, time.Millisecond))  // errors are always logged.
+	is.True(s.sample(missing, time.Millisecond)) // client errors are always logged.
+	is.True(s.sample(ok, 2*time.Second))         // slow requests are always logged.
+
+	now = now.Add(time.Second)
+	is.True(s.sample(ok, time.Millisecond)) // the first requests of the next second are logged.
+
+	is.Equal(testutil.ToFloat64(s.dropped.WithLabelValues("GET", "/items")), float64(6)) // dropped lines are counted.
+
+	s = newLogSampler(prometheus.NewRegistry(), LogSampling{Rate: 0.25}, nil)
+	s.float = func() float64 { return 0.2 }
+	is.True(s.sample(ok, time.Millisecond)) // requests within the rate are logged.
+	s.float = func() float64 { return 0.3 }
+	is.True(!s.sample(ok, time.Millisecond)) // requests outside the rate are dropped.
+}
+
+func TestWithLogSampling(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	h := func(code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Respond(w, r, code, nil)
+		})
+	}
+
+	reg := prometheus.NewRegistry()
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/ok", Handler: h(http.StatusOK)},
+			{Method: "GET", Path: "/fail", Handler: h(http.StatusInternalServerError)},
+			{Method: "GET", Path: "/all", Handler: h(http.StatusOK), LogSampling: &LogSampling{Rate: 1}},
+		}
+	}), WithRegisterer(reg), WithLogSampling(LogSampling{}))
+
+	for _, path := range []string{"/ok", "/ok", "/fail", "/all"} {
+		srv.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	routes := make([]string, 0)
+	for _, ll := range logs.FilterMessage("request").All() {
+		routes = append(routes, ll.ContextMap()["route"].(string))
+	}
+	is.Equal(routes, []string{"/fail", "/all"}) // only errors, and endpoints logging everything, are logged.
+
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http_log_lines_dropped_total", Help: "HTTP Request log lines dropped by sampling"}, []string{"method", "path"})
+	dropped = registerCollector(reg, dropped).(*prometheus.CounterVec)
+	is.Equal(testutil.ToFloat64(dropped.WithLabelValues("GET", "/ok")), float64(2)) // dropped lines are counted by route.
+}
@@ -8,33 +8,116 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// metricsConfig holds the configuration of the metrics exposed by MetricsMW.
+type metricsConfig struct {
+	namespace   string
+	constLabels prometheus.Labels
+}
+
+// MetricsOption is a function that can be passed to MetricsMW to modify the
+// metrics it exposes.
+type MetricsOption func(*metricsConfig)
+
+// MetricsNamespace sets the namespace, i.e. prefix, of the exposed metric names.
+func MetricsNamespace(ns string) MetricsOption {
+	return func(c *metricsConfig) {
+		c.namespace = ns
+	}
+}
+
+// MetricsConstLabels adds labels, with fixed values, to the exposed metrics.
+// This allows metrics of more than one server to be registered with the same
+// registerer, i.e. with a label of server="admin".
+func MetricsConstLabels(labels prometheus.Labels) MetricsOption {
+	return func(c *metricsConfig) {
+		if c.constLabels == nil {
+			c.constLabels = prometheus.Labels{}
+		}
+		for k, v := range labels {
+			c.constLabels[k] = v
+		}
+	}
+}
+
+// newMetricsConfig returns the metrics configuration defined by the given options.
+func newMetricsConfig(opts []MetricsOption) metricsConfig {
+	var cfg metricsConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// registerCollector registers the given collector with the registerer. If an
+// identical collector has already been registered, i.e. by another server, the
+// existing collector is returned so it can be shared.
+func registerCollector(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		return are.ExistingCollector
+	}
+	return c
+}
+
 // MetricsMW returns a middleware that implements counting + timing of requests
-// using a Prometheus Histogram
-func MetricsMW(reg prometheus.Registerer, endpoints []Endpoint) Middleware {
+// using a Prometheus Histogram.
+// If an identical Histogram has already been registered with the given
+// registerer, i.e. by another server, then that Histogram is shared.
+// If any of the endpoints are versioned, requests are also labelled by the
+// version of the endpoint handling them.
+func MetricsMW(reg prometheus.Registerer, endpoints []Endpoint, opts ...MetricsOption) Middleware {
+
+	cfg := newMetricsConfig(opts)
+
+	// Only label requests by version if there are versions, so the labels of
+	// unversioned APIs are unchanged.
+	labels := []string{"method", "path", "status"}
+	versioned := false
+	for _, e := range endpoints {
+		if e.Version != "" {
+			versioned = true
+			labels = append(labels, "version")
+			break
+		}
+	}
+	// values returns the label values of a request.
+	values := func(method, path, status, version string) []string {
+		if versioned {
+			return []string{method, path, status, version}
+		}
+		return []string{method, path, status}
+	}
+
 	// Create Histogram that will observe request latency.
 	// This Histogram will also expose a 'count' metric that can be used
 	// to rate requests.
 	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    "http_request_duration_seconds",
-		Help:    "HTTP Request Duration",
-		Buckets: prometheus.DefBuckets,
-	}, []string{"method", "path", "status"})
+		Namespace:   cfg.namespace,
+		Name:        "http_request_duration_seconds",
+		Help:        "HTTP Request Duration",
+		Buckets:     prometheus.DefBuckets,
+		ConstLabels: cfg.constLabels,
+	}, labels)
+
+	// Register the Histogram to be exposed via the Prometheus metrics handler.
+	// If it has already been registered, use the existing one instead.
+	duration = registerCollector(reg, duration).(*prometheus.HistogramVec)
 
 	// Predeclare metrics to alleviate existential issues
 	// See: https://www.robustperception.io/existential-issues-with-metrics
 	for _, e := range endpoints {
 		for _, status := range []string{"2XX", "3XX", "4XX", "5XX"} {
-			duration.WithLabelValues(e.Method, e.Path, status)
+			duration.WithLabelValues(values(e.Method, e.Path, status, e.Version)...)
 			// Also predeclare OPTIONS method if we have a CORS middleware.
 			if e.CorsMiddleware != nil {
-				duration.WithLabelValues("OPTIONS", e.Path, status)
+				duration.WithLabelValues(values("OPTIONS", e.Path, status, e.Version)...)
 			}
 		}
 	}
 
-	// Register the Histogram to be exposed via the Prometheus metrics handler
-	reg.MustRegister(duration)
-
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
@@ -49,7 +132,7 @@ func MetricsMW(reg prometheus.Registerer, endpoints []Endpoint) Middleware {
 				statusGroup := fmt.Sprintf("%dXX", d.StatusCode/100)
 
 				// Observe latency of request
-				duration.WithLabelValues(d.Method, d.RequestPath, statusGroup).Observe(time.Since(d.Now).Seconds())
+				duration.WithLabelValues(values(d.Method, d.RequestPath, statusGroup, d.apiVersion)...).Observe(time.Since(d.Now).Seconds())
 			}()
 			// Call the wrapped handler
 			next.ServeHTTP(w, r)
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// MsgPackCodec encodes and decodes MessagePack bodies. Values are converted
+// to and from MessagePack via their JSON representation, so the same struct
+// tags and custom marshalling apply as for JSON bodies.
+type MsgPackCodec struct {
+	// MaxDepth is how deeply bodies may be nested, counting each array and
+	// map. Decode returns ErrBodyTooDeep for bodies nested more deeply. By
+	// default, 1000.
+	MaxDepth int
+}
+
+// defaultMsgPackMaxDepth is how deeply MessagePack bodies may be nested by
+// default.
+const defaultMsgPackMaxDepth = 1000
+
+// Decode implements Codec.
+func (c MsgPackCodec) Decode(r io.Reader, v interface{}) error {
+	d := &msgPackDecoder{r: bufio.NewReader(r), maxDepth: c.MaxDepth}
+	if d.maxDepth <= 0 {
+		d.maxDepth = defaultMsgPackMaxDepth
+	}
+	generic, err := d.read()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Encode implements Codec.
+func (MsgPackCodec) Encode(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Decode into generic values, keeping numbers exact.
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := writeMsgPack(&buf, generic); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// writeMsgPack writes the generic JSON value v to buf as MessagePack.
+func writeMsgPack(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		writeMsgPackNumber(buf, t)
+	case string:
+		writeMsgPackLength(buf, len(t), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(t)
+	case []interface{}:
+		writeMsgPackLength(buf, len(t), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range t {
+			if err := writeMsgPack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// Sort keys, so encoding is deterministic.
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeMsgPackLength(buf, len(t), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			if err := writeMsgPack(buf, k); err != nil {
+				return err
+			}
+			if err := writeMsgPack(buf, t[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("api: cannot encode %T as msgpack", v)
+	}
+	return nil
+}
+
+// writeMsgPackLength writes the header of a string, array or map of length n.
+// A fix code of 0 means there is no 8 bit length variant.
+func writeMsgPackLength(buf *bytes.Buffer, n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n)) //nolint:errcheck
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n)) //nolint:errcheck
+	}
+}
+
+// writeMsgPackNumber writes the number n using the smallest MessagePack representation.
+func writeMsgPackNumber(buf *bytes.Buffer, n json.Number) {
+	if i, err := n.Int64(); err == nil {
+		switch {
+		case i >= 0 && i <= math.MaxInt8:
+			buf.WriteByte(byte(i))
+		case i < 0 && i >= -32:
+			buf.WriteByte(byte(int8(i)))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			buf.WriteByte(0xd0)
+			buf.WriteByte(byte(int8(i)))
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(i)) //nolint:errcheck
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(i)) //nolint:errcheck
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i) //nolint:errcheck
+		}
+		return
+	}
+
+	// Numbers that aren't integers, or are too large, are encoded as floats.
+	f, _ := n.Float64()
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, f) //nolint:errcheck
+}
+
+// msgPackDecoder reads MessagePack values, as generic JSON values. Lengths
+// are read from the body, so can't be trusted; values are only allocated as
+// their bytes are read, so a body can't claim more memory than it contains.
+type msgPackDecoder struct {
+	r        *bufio.Reader
+	depth    int
+	maxDepth int
+}
+
+// read reads a single MessagePack value.
+func (d *msgPackDecoder) read() (interface{}, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.readString(uint64(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.readArray(uint64(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.readMap(uint64(c & 0x0f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		// Binary data is represented as base64 in JSON, which []byte marshals to.
+		return d.readBytes(n)
+	case 0xca:
+		var f float32
+		err := binary.Read(d.r, binary.BigEndian, &f)
+		return float64(f), err
+	case 0xcb:
+		var f float64
+		err := binary.Read(d.r, binary.BigEndian, &f)
+		return f, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (c - 0xcc))
+	case 0xd0:
+		var i int8
+		err := binary.Read(d.r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd1:
+		var i int16
+		err := binary.Read(d.r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd2:
+		var i int32
+		err := binary.Read(d.r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := binary.Read(d.r, binary.BigEndian, &i)
+		return i, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(n)
+	}
+
+	return nil, fmt.Errorf("api: unsupported msgpack type 0x%x", c)
+}
+
+// readUint reads a big endian unsigned integer of the given size in bytes.
+func (d *msgPackDecoder) readUint(size int) (uint64, error) {
+	var n uint64
+	for i := 0; i < size; i++ {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// readBytes reads n bytes. The bytes are buffered as they're read, rather than
+// allocated up front, so a length larger than the body fails once the body
+// ends.
+func (d *msgPackDecoder) readBytes(n uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if n > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readString reads a string of length n.
+func (d *msgPackDecoder) readString(n uint64) (interface{}, error) {
+	b, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// nest records that a value is being read within an array or map, failing if
+// that is nested too deeply.
+func (d *msgPackDecoder) nest() error {
+	d.depth++
+	if d.depth > d.maxDepth {
+		return ErrBodyTooDeep
+	}
+	return nil
+}
+
+// readArray reads an array of n values. The array grows as its values are
+// read, as each needs at least a byte of the body.
+func (d *msgPackDecoder) readArray(n uint64) (interface{}, error) {
+	if err := d.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	a := make([]interface{}, 0)
+	for i := uint64(0); i < n; i++ {
+		v, err := d.read()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+// readMap reads a map of n key value pairs. Keys that aren't strings are
+// converted to strings, as required by JSON.
+func (d *msgPackDecoder) readMap(n uint64) (interface{}, error) {
+	if err := d.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	m := make(map[string]interface{})
+	for i := uint64(0); i < n; i++ {
+		k, err := d.read()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		v, err := d.read()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if s, ok := k.(string); ok {
+			m[s] = v
+		} else {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF if err is io.EOF, as the body
+// ended part way through a value.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
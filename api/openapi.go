@@ -0,0 +1,542 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// openAPIVersion is the version of the OpenAPI specification generated documents conform to.
+const openAPIVersion = "3.1.0"
+
+// Operation documents an Endpoint, for inclusion in a generated OpenAPI document.
+type Operation struct {
+	// A unique identifier of the operation.
+	ID string
+	// A short summary of what the operation does.
+	Summary string
+	// A verbose explanation of the operation.
+	Description string
+	// Tags used to group operations.
+	Tags []string
+	// Descriptions of the endpoint's path parameters, keyed by parameter name.
+	Params map[string]string
+	// A value of the type expected as the request body, i.e. CreateOrderRequest{},
+	// or nil if the endpoint does not expect a body.
+	Request interface{}
+	// The successful responses of the endpoint, keyed by status code.
+	Responses map[int]OperationResponse
+	// The problem responses the endpoint may respond with.
+	Problems []ProblemType
+	// Flag to mark the operation as deprecated.
+	Deprecated bool
+}
+
+// OperationResponse documents a response of an Endpoint.
+type OperationResponse struct {
+	// A short description of the response.
+	Description string
+	// A value of the type of the response body, i.e. Order{}, or nil if the
+	// response has no body.
+	Body interface{}
+}
+
+// ProblemType documents a problem response, as defined by RFC 7807, that an
+// Endpoint may respond with.
+type ProblemType struct {
+	// The HTTP status code of the problem response.
+	Status int
+	// A URI reference that identifies the problem type. If empty, the problem
+	// type is 'about:blank'.
+	Type string
+	// A short, human-readable summary of the problem type.
+	Title string
+}
+
+// OpenAPIInfo provides metadata about the API described by an OpenAPI document.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenAPIJSON returns an OpenAPI 3.1 document, encoded as JSON, describing the
+// given endpoints.
+func OpenAPIJSON(info OpenAPIInfo, endpoints []Endpoint) ([]byte, error) {
+	return json.Marshal(newOpenAPIDocument(info, endpoints))
+}
+
+// OpenAPIYAML returns an OpenAPI 3.1 document, encoded as YAML, describing the
+// given endpoints.
+func OpenAPIYAML(info OpenAPIInfo, endpoints []Endpoint) ([]byte, error) {
+	b, err := OpenAPIJSON(info, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert via the generic JSON representation, so the YAML document uses the
+	// same field names as the JSON document.
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(v)
+}
+
+// openAPIHandler returns a handler that serves an OpenAPI document describing
+// the given endpoints. The document is encoded as YAML if the request prefers
+// YAML, as negotiated by its Accept header, otherwise JSON.
+func openAPIHandler(info OpenAPIInfo, endpoints []Endpoint) (http.Handler, error) {
+	jsonDoc, err := OpenAPIJSON(info, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	yamlDoc, err := OpenAPIYAML(info, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	formats := newCodecs()
+	for _, mt := range []string{"application/yaml", "application/x-yaml", "text/yaml"} {
+		formats.register(mt, yamlCodec{})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType, codec, ok := formats.negotiate(r.Header.Get("Accept"))
+		if !ok {
+			Error(w, r, fmt.Sprintf("Accept must allow one of: %s", formats.supported()), http.StatusNotAcceptable)
+			return
+		}
+		doc := jsonDoc
+		if _, ok := codec.(yamlCodec); ok {
+			doc = yamlDoc
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		//nolint:errcheck
+		w.Write(doc)
+	}), nil
+}
+
+// yamlCodec is a Codec of YAML, used to negotiate which encoding of an OpenAPI
+// document is served.
+type yamlCodec struct{}
+
+// Decode implements Codec.
+func (yamlCodec) Decode(r io.Reader, v interface{}) error {
+	return yaml.NewDecoder(r).Decode(v)
+}
+
+// Encode implements Codec.
+func (yamlCodec) Encode(w io.Writer, v interface{}) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+//
+// Document
+//
+
+// openAPIDocument is the root of an OpenAPI document.
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+// openAPIComponents holds reusable objects of an OpenAPI document.
+type openAPIComponents struct {
+	Schemas map[string]*schema `json:"schemas"`
+}
+
+// openAPIOperation describes a single operation of an OpenAPI document.
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId,omitempty"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+}
+
+// openAPIParameter describes a single operation parameter.
+type openAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *schema `json:"schema"`
+}
+
+// openAPIRequestBody describes an operation's request body.
+type openAPIRequestBody struct {
+	Content  map[string]openAPIMediaType `json:"content"`
+	Required bool                        `json:"required"`
+}
+
+// openAPIResponse describes an operation's response.
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+// openAPIMediaType describes the schema of a request or response body.
+type openAPIMediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+// newOpenAPIDocument creates an OpenAPI document describing the given endpoints.
+func newOpenAPIDocument(info OpenAPIInfo, endpoints []Endpoint) *openAPIDocument {
+
+	g := newSchemaGenerator()
+
+	// All problem responses share the same schema.
+	g.define("Problem", reflect.TypeOf(problemSwaggerDefn{}))
+
+	doc := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info:    info,
+		Paths:   map[string]map[string]*openAPIOperation{},
+	}
+
+	for _, e := range endpoints {
+		path, params := openAPIPath(e.Path)
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+
+		doc.Paths[path][strings.ToLower(e.Method)] = newOpenAPIOperation(g, e.Operation, params)
+	}
+
+	doc.Components.Schemas = g.components
+
+	return doc
+}
+
+// newOpenAPIOperation creates the OpenAPI operation for an endpoint with the
+// given documentation and path parameters.
+func newOpenAPIOperation(g *schemaGenerator, op *Operation, params []string) *openAPIOperation {
+
+	if op == nil {
+		op = &Operation{}
+	}
+
+	o := &openAPIOperation{
+		OperationID: op.ID,
+		Summary:     op.Summary,
+		Description: op.Description,
+		Tags:        op.Tags,
+		Responses:   map[string]*openAPIResponse{},
+		Deprecated:  op.Deprecated,
+	}
+
+	for _, p := range params {
+		o.Parameters = append(o.Parameters, openAPIParameter{
+			Name:        p,
+			In:          "path",
+			Description: op.Params[p],
+			Required:    true,
+			Schema:      &schema{Type: "string"},
+		})
+	}
+
+	if op.Request != nil {
+		o.RequestBody = &openAPIRequestBody{
+			Content: map[string]openAPIMediaType{
+				"application/json": {g.schemaFor(reflect.TypeOf(op.Request))},
+			},
+			Required: true,
+		}
+	}
+
+	for code, resp := range op.Responses {
+		r := &openAPIResponse{Description: resp.Description}
+		if r.Description == "" {
+			r.Description = http.StatusText(code)
+		}
+		if resp.Body != nil {
+			r.Content = map[string]openAPIMediaType{
+				"application/json": {g.schemaFor(reflect.TypeOf(resp.Body))},
+			}
+		}
+		o.Responses[strconv.Itoa(code)] = r
+	}
+
+	// Group problem types by status code, as each status may only have one response.
+	problems := map[int][]ProblemType{}
+	for _, p := range op.Problems {
+		problems[p.Status] = append(problems[p.Status], p)
+	}
+	for code, ps := range problems {
+		titles := make([]string, 0, len(ps))
+		types := make([]string, 0, len(ps))
+		for _, p := range ps {
+			title := p.Title
+			if title == "" {
+				title = http.StatusText(code)
+			}
+			titles = append(titles, title)
+			if p.Type != "" {
+				types = append(types, p.Type)
+			}
+		}
+
+		s := &schema{Ref: schemaRef("Problem")}
+		if len(types) > 0 {
+			// Restrict the type field to the documented problem types.
+			s = &schema{AllOf: []*schema{s, {Properties: map[string]*schema{"type": {Enum: types}}}}}
+		}
+
+		o.Responses[strconv.Itoa(code)] = &openAPIResponse{
+			Description: strings.Join(titles, "; "),
+			Content: map[string]openAPIMediaType{
+				"application/problem+json": {s},
+			},
+		}
+	}
+
+	if len(o.Responses) == 0 {
+		o.Responses["default"] = &openAPIResponse{Description: "Undocumented response"}
+	}
+
+	return o
+}
+
+// openAPIPath translates a httptreemux path into an OpenAPI path template,
+// returning the template and the names of its path parameters, i.e.
+// '/files/:id/*path' becomes '/files/{id}/{path}'. Unnamed parameters are given
+// a name from their position, i.e. '/files/*' becomes '/files/{param1}'.
+func openAPIPath(path string) (string, []string) {
+	segments := strings.Split(path, "/")
+	named := make(map[string]bool)
+	for _, s := range segments {
+		if len(s) > 1 && (s[0] == ':' || s[0] == '*') {
+			named[s[1:]] = true
+		}
+	}
+
+	params := make([]string, 0)
+	for i, s := range segments {
+		if len(s) == 0 || (s[0] != ':' && s[0] != '*') {
+			continue
+		}
+		name := s[1:]
+		for n := len(params) + 1; name == ""; n++ {
+			// Don't clash with the path's named parameters.
+			if candidate := fmt.Sprintf("param%d", n); !named[candidate] {
+				name = candidate
+			}
+		}
+		params = append(params, name)
+		segments[i] = "{" + name + "}"
+	}
+	return strings.Join(segments, "/"), params
+}
+
+//
+// Schemas
+//
+
+// schema is a JSON Schema, as used by OpenAPI 3.1 documents.
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	AllOf                []*schema          `json:"allOf,omitempty"`
+}
+
+// schemaRef returns the reference to the named component schema.
+func schemaRef(name string) string {
+	return "#/components/schemas/" + name
+}
+
+// schemaGenerator creates schemas from Go types. Named struct types are
+// defined once as component schemas, and referenced from elsewhere.
+type schemaGenerator struct {
+	components map[string]*schema
+	names      map[reflect.Type]string
+}
+
+// newSchemaGenerator returns an empty schemaGenerator.
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{
+		components: map[string]*schema{},
+		names:      map[reflect.Type]string{},
+	}
+}
+
+// define adds the struct type t as a component schema with the given name.
+func (g *schemaGenerator) define(name string, t reflect.Type) {
+	g.names[t] = name
+	// Add a placeholder first, so recursive types terminate.
+	g.components[name] = &schema{}
+	g.components[name] = g.structSchema(t)
+}
+
+var (
+	timeType           = reflect.TypeOf(time.Time{})
+	rawMessageType     = reflect.TypeOf(json.RawMessage{})
+	jsonMarshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	byteSliceType      = reflect.TypeOf([]byte{})
+	emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// schemaFor returns the schema describing the JSON encoding of values of type t.
+func (g *schemaGenerator) schemaFor(t reflect.Type) *schema {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &schema{Type: "string", Format: "date-time"}
+	case t == rawMessageType, t == emptyInterfaceType:
+		return &schema{}
+	case t == byteSliceType:
+		return &schema{Type: "string", Format: "byte"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// There's no way of knowing what custom marshalling produces.
+		return &schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &schema{Type: "integer", Format: "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &schema{Type: "integer", Format: "int32"}
+	case reflect.Float32:
+		return &schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &schema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			// Anonymous structs are described inline.
+			return g.structSchema(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.uniqueName(t)
+			g.define(name, t)
+		}
+		return &schema{Ref: schemaRef(name)}
+	}
+
+	// Any other kind, i.e. a func or channel, cannot be encoded as JSON.
+	return &schema{}
+}
+
+// uniqueName returns a component schema name for the named type t, that
+// doesn't clash with any already defined.
+func (g *schemaGenerator) uniqueName(t reflect.Type) string {
+	name := t.Name()
+	for i := 2; ; i++ {
+		if _, ok := g.components[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s%d", t.Name(), i)
+	}
+}
+
+// structSchema returns the schema describing the JSON encoding of the struct type t.
+func (g *schemaGenerator) structSchema(t reflect.Type) *schema {
+	s := &schema{Type: "object", Properties: map[string]*schema{}}
+	g.addFields(s, t)
+	sort.Strings(s.Required)
+	return s
+}
+
+// addFields adds the properties of the struct type t to the given schema,
+// following the same rules as encoding/json.
+func (g *schemaGenerator) addFields(s *schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := parseTag(tag)
+
+		// Fields of embedded structs without a name are promoted.
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(s, ft)
+				continue
+			}
+		}
+
+		// Unexported fields are not encoded.
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fs := g.schemaFor(f.Type)
+		if opts.contains("string") {
+			fs = &schema{Type: "string"}
+		}
+
+		s.Properties[name] = fs
+		if !opts.contains("omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// tagOptions are the options of a struct field's json tag, after the name.
+type tagOptions []string
+
+// parseTag splits a struct field's json tag into its name and options.
+func parseTag(tag string) (string, tagOptions) {
+	parts := strings.Split(tag, ",")
+	return parts[0], tagOptions(parts[1:])
+}
+
+// contains reports whether the tag options contain the given option.
+func (o tagOptions) contains(opt string) bool {
+	for _, v := range o {
+		if v == opt {
+			return true
+		}
+	}
+	return false
+}
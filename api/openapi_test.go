@@ -0,0 +1,211 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+type teapot struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Capacity  float64   `json:"capacity,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Lid       *lid      `json:"lid,omitempty"`
+	Cups      []teapot  `json:"cups,omitempty"`
+	internal  string
+}
+
+type lid struct {
+	Colour string `json:"colour"`
+}
+
+type docAPI struct{}
+
+func (a *docAPI) Endpoints() []Endpoint {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	return []Endpoint{
+		{
+			Method:  "GET",
+			Path:    "/teapots/:id",
+			Handler: h,
+			Operation: &Operation{
+				ID:      "getTeapot",
+				Summary: "Get a teapot",
+				Tags:    []string{"teapots"},
+				Params:  map[string]string{"id": "The teapot's ID"},
+				Responses: map[int]OperationResponse{
+					http.StatusOK: {Description: "The teapot", Body: teapot{}},
+				},
+				Problems: []ProblemType{
+					{Status: http.StatusNotFound, Type: "https://example.com/problems/no-teapot", Title: "Teapot not found"},
+				},
+			},
+		},
+		{
+			Method:  "POST",
+			Path:    "/teapots",
+			Handler: h,
+			Operation: &Operation{
+				Request: &teapot{},
+				Responses: map[int]OperationResponse{
+					http.StatusCreated: {Body: teapot{}},
+				},
+			},
+		},
+		{
+			Method:  "GET",
+			Path:    "/files/*path",
+			Handler: h,
+		},
+	}
+}
+
+func TestOpenAPIPath(t *testing.T) {
+
+	tests := []struct {
+		Path           string
+		ExpectedPath   string
+		ExpectedParams []string
+	}{
+		{"/", "/", []string{}},
+		{"/teapots", "/teapots", []string{}},
+		{"/teapots/:id", "/teapots/{id}", []string{"id"}},
+		{"/teapots/:id/lids/:lid", "/teapots/{id}/lids/{lid}", []string{"id", "lid"}},
+		{"/files/*path", "/files/{path}", []string{"path"}},
+		{"/files/*", "/files/{param1}", []string{"param1"}},
+		{"/tags/:/items/:", "/tags/{param1}/items/{param2}", []string{"param1", "param2"}},
+		{"/tags/:/items/:param1", "/tags/{param2}/items/{param1}", []string{"param2", "param1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Path, func(t *testing.T) {
+			is := is.New(t)
+
+			path, params := openAPIPath(tt.Path)
+			is.Equal(path, tt.ExpectedPath)     // path is translated.
+			is.Equal(params, tt.ExpectedParams) // params are found.
+		})
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+
+	is := is.New(t)
+
+	b, err := OpenAPIJSON(OpenAPIInfo{Title: "Teapots", Version: "1.0.0"}, (&docAPI{}).Endpoints())
+	is.NoErr(err) // document generated.
+
+	var doc map[string]interface{}
+	is.NoErr(json.Unmarshal(b, &doc)) // document is json.
+
+	// get walks the document, following the given keys.
+	get := func(keys ...string) interface{} {
+		var v interface{} = doc
+		for _, k := range keys {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		}
+		return v
+	}
+
+	is.Equal(get("openapi"), "3.1.0")         // openapi version is set.
+	is.Equal(get("info", "title"), "Teapots") // info is set.
+
+	// Check operation metadata.
+	is.Equal(get("paths", "/teapots/{id}", "get", "operationId"), "getTeapot") // operation id is set.
+	is.Equal(get("paths", "/teapots/{id}", "get", "summary"), "Get a teapot")  // summary is set.
+
+	// Check path parameters.
+	params := get("paths", "/teapots/{id}", "get", "parameters").([]interface{})
+	is.Equal(len(params), 1) // path param is documented.
+	param := params[0].(map[string]interface{})
+	is.Equal(param["name"], "id")                     // param name is set.
+	is.Equal(param["in"], "path")                     // param is in path.
+	is.Equal(param["description"], "The teapot's ID") // param description is set.
+
+	// Check response schemas.
+	is.Equal(get("paths", "/teapots/{id}", "get", "responses", "200", "content", "application/json", "schema", "$ref"), "#/components/schemas/teapot") // response references type.
+	is.Equal(get("paths", "/teapots", "post", "requestBody", "content", "application/json", "schema", "$ref"), "#/components/schemas/teapot")          // request references type.
+	is.Equal(get("paths", "/teapots", "post", "responses", "201", "description"), "Created")                                                           // response description defaults to status text.
+
+	// Check problem responses.
+	is.Equal(get("paths", "/teapots/{id}", "get", "responses", "404", "description"), "Teapot not found") // problem is documented.
+	schema := get("paths", "/teapots/{id}", "get", "responses", "404", "content", "application/problem+json", "schema", "allOf").([]interface{})
+	is.Equal(schema[0].(map[string]interface{})["$ref"], "#/components/schemas/Problem") // problem references problem schema.
+
+	// Check undocumented and wildcard endpoints.
+	is.True(get("paths", "/files/{path}", "get", "responses", "default") != nil) // undocumented endpoint has default response.
+
+	// Check component schemas.
+	is.Equal(get("components", "schemas", "teapot", "properties", "createdAt", "format"), "date-time")                     // time is a date-time.
+	is.Equal(get("components", "schemas", "teapot", "properties", "cups", "items", "$ref"), "#/components/schemas/teapot") // recursive types are referenced.
+	is.Equal(get("components", "schemas", "teapot", "properties", "lid", "$ref"), "#/components/schemas/lid")              // nested types are referenced.
+	is.Equal(get("components", "schemas", "teapot", "properties", "internal"), nil)                                        // unexported fields are ignored.
+	is.Equal(get("components", "schemas", "teapot", "required"), []interface{}{"createdAt", "id", "name"})                 // fields without omitempty are required.
+	is.Equal(get("components", "schemas", "Problem", "required"), []interface{}{"detail", "status", "title", "type"})      // problem schema is defined.
+}
+
+func TestServerServesOpenAPI(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// Create server
+	srv := NewServer(":0", logger, &docAPI{},
+		WithRegisterer(prometheus.NewRegistry()),
+		WithOpenAPI("/openapi", OpenAPIInfo{Title: "Teapots", Version: "1.0.0"}),
+	)
+
+	// Request the JSON document.
+	r, err := http.NewRequest("GET", "/openapi", nil)
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusOK)                              // document is served.
+	is.Equal(rr.Header().Get("Content-Type"), "application/json") // document is json.
+
+	var doc map[string]interface{}
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &doc))         // document is valid json.
+	is.Equal(len(doc["paths"].(map[string]interface{})), 3) // document endpoint is not documented.
+
+	// Request the YAML document.
+	r.Header.Set("Accept", "application/yaml")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusOK)                              // document is served.
+	is.Equal(rr.Header().Get("Content-Type"), "application/yaml") // document is yaml.
+
+	var ydoc map[string]interface{}
+	is.NoErr(yaml.Unmarshal(rr.Body.Bytes(), &ydoc)) // document is valid yaml.
+	is.Equal(ydoc["openapi"], "3.1.0")               // yaml document has openapi version.
+
+	// Request either document, preferring JSON.
+	r.Header.Set("Accept", "application/yaml;q=0.5, application/json")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusOK)                              // document is served.
+	is.Equal(rr.Header().Get("Content-Type"), "application/json") // preferred encoding is served.
+
+	// Request a document that can't be served.
+	r.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusNotAcceptable) // unacceptable documents aren't served.
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimitAlgorithm is the algorithm used to limit the rate of requests.
+type RateLimitAlgorithm int
+
+// Rate limiting algorithms.
+const (
+	// TokenBucket allows bursts of up to Limit requests, with capacity for
+	// requests refilling steadily over each Window.
+	TokenBucket RateLimitAlgorithm = iota
+	// SlidingWindow allows up to Limit requests within any Window, estimated
+	// from the number of requests in the current and previous windows.
+	SlidingWindow
+)
+
+// KeyFunc returns the key that a request is rate limited by, i.e. the client's
+// IP address. Requests with the same key share a limit. Requests with an empty
+// key are not limited.
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP limits requests by the IP address of the client, as given by the
+// request's remote address. It ignores the 'X-Forwarded-For' header, so behind
+// a proxy or load balancer all clients share the proxy's limit, in which case
+// KeyByClientIP should be used instead.
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// KeyByClientIP limits requests by the IP address of the client, read from the
+// 'X-Forwarded-For' header of requests from the given trusted proxies, as IPs
+// or CIDRs, in the same way as AccessLogTrustedProxies. Requests from other
+// addresses are limited by their remote address. It panics if an address can't
+// be parsed.
+func KeyByClientIP(trustedProxies ...string) KeyFunc {
+	trusted := parseTrustedProxies(trustedProxies)
+	return func(r *http.Request) string {
+		return "ip:" + clientIP(r, trusted)
+	}
+}
+
+// KeyByIdentity limits requests by the identity of the caller, as returned by
+// the given lookup from the request's context. Requests without an identity
+// are limited by the IP address of the client instead.
+func KeyByIdentity(lookup func(ctx context.Context) (string, bool)) KeyFunc {
+	return func(r *http.Request) string {
+		if id, ok := lookup(r.Context()); ok && id != "" {
+			return "id:" + id
+		}
+		return KeyByIP(r)
+	}
+}
+
+// RateLimit is a policy limiting the rate of requests to an endpoint.
+type RateLimit struct {
+	// Limit is the number of requests allowed per Window. A limit of zero
+	// disables rate limiting, i.e. to exclude an endpoint from the server's limit.
+	Limit int
+	// Window is the period of time the limit applies to.
+	Window time.Duration
+	// Algorithm is the rate limiting algorithm. By default, TokenBucket is used.
+	Algorithm RateLimitAlgorithm
+	// Key returns the key requests are limited by. By default, KeyByIP is used.
+	Key KeyFunc
+}
+
+// RateLimitResult is the outcome of checking a request against a rate limit.
+type RateLimitResult struct {
+	// Allowed reports whether the request is within the limit.
+	Allowed bool
+	// Remaining is the number of requests that would currently be allowed.
+	Remaining int
+	// Reset is how long it will be until the full limit is available again.
+	Reset time.Duration
+	// RetryAfter is how long it will be until a request is allowed again, if
+	// this request wasn't allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the state of rate limits, so that requests can be
+// checked against them. Implementations must be safe for concurrent use, and
+// may share state between servers, i.e. via a database.
+type RateLimitStore interface {
+	// Take checks a request with the given key against the policy, counting it
+	// if it is allowed.
+	Take(ctx context.Context, key string, policy RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// memoryRateLimitStore is a RateLimitStore that keeps state in memory.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitState
+	lastSweep time.Time
+}
+
+// rateLimitState is the state of a single key.
+type rateLimitState struct {
+	// tokens and last are used by the token bucket algorithm.
+	tokens float64
+	last   time.Time
+	// windowStart, current and previous are used by the sliding window algorithm.
+	windowStart time.Time
+	current     int
+	previous    int
+	// expires is when the state can be forgotten, as it has returned to its initial value.
+	expires time.Time
+}
+
+// rateLimitSweepInterval is how often expired state is removed from memory.
+const rateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore returns a RateLimitStore that keeps state in memory,
+// so limits apply to each server separately.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*rateLimitState)}
+}
+
+// Take implements RateLimitStore.
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, policy RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Periodically forget keys that haven't been seen recently.
+	if now.Sub(s.lastSweep) > rateLimitSweepInterval {
+		for k, st := range s.buckets {
+			if now.After(st.expires) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	st, ok := s.buckets[key]
+	if !ok {
+		st = &rateLimitState{tokens: float64(policy.Limit), last: now, windowStart: now.Truncate(policy.Window)}
+		s.buckets[key] = st
+	}
+
+	if policy.Algorithm == SlidingWindow {
+		return st.takeSlidingWindow(policy, now), nil
+	}
+	return st.takeTokenBucket(policy, now), nil
+}
+
+// takeTokenBucket checks a request using the token bucket algorithm.
+func (st *rateLimitState) takeTokenBucket(policy RateLimit, now time.Time) RateLimitResult {
+	limit := float64(policy.Limit)
+	rate := limit / policy.Window.Seconds()
+
+	// Refill the bucket for the time since it was last checked.
+	if elapsed := now.Sub(st.last).Seconds(); elapsed > 0 {
+		st.tokens = math.Min(limit, st.tokens+elapsed*rate)
+		st.last = now
+	}
+
+	var res RateLimitResult
+	if st.tokens >= 1 {
+		st.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - st.tokens) / rate)
+	}
+
+	res.Remaining = int(st.tokens)
+	res.Reset = seconds((limit - st.tokens) / rate)
+	st.expires = now.Add(res.Reset)
+	return res
+}
+
+// takeSlidingWindow checks a request using the sliding window algorithm.
+func (st *rateLimitState) takeSlidingWindow(policy RateLimit, now time.Time) RateLimitResult {
+	limit := float64(policy.Limit)
+
+	// Move the window along, if it has ended.
+	start := now.Truncate(policy.Window)
+	switch {
+	case start.Sub(st.windowStart) == policy.Window:
+		st.previous, st.current = st.current, 0
+	case start.Sub(st.windowStart) > policy.Window:
+		st.previous, st.current = 0, 0
+	}
+	st.windowStart = start
+
+	// Estimate the number of requests in the window ending now, assuming the
+	// previous window's requests were evenly spread.
+	elapsed := now.Sub(start)
+	weight := 1 - elapsed.Seconds()/policy.Window.Seconds()
+	count := float64(st.previous)*weight + float64(st.current)
+
+	var res RateLimitResult
+	if count+1 <= limit {
+		st.current++
+		count++
+		res.Allowed = true
+	} else if st.previous > 0 && float64(st.current) < limit {
+		// Wait until enough of the previous window's requests have slid out.
+		needed := (count + 1 - limit) / float64(st.previous)
+		res.RetryAfter = seconds(needed * policy.Window.Seconds())
+	} else {
+		// Wait until the next window.
+		res.RetryAfter = policy.Window - elapsed
+	}
+
+	res.Remaining = int(math.Max(0, math.Floor(limit-count)))
+	res.Reset = policy.Window - elapsed
+	if st.current > 0 {
+		// The current window's requests count towards the next window too.
+		res.Reset += policy.Window
+	}
+	st.expires = start.Add(2 * policy.Window)
+	return res
+}
+
+// seconds converts a number of seconds into a duration, rounded to the
+// nearest nanosecond.
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Round(s * float64(time.Second)))
+}
+
+// RateLimitMW returns a middleware that limits the rate of requests, as
+// defined by the given policy, using the given store. Requests over the limit
+// are responded to with a 429 Too Many Requests problem. All responses include
+// 'RateLimit-Limit', 'RateLimit-Remaining' and 'RateLimit-Reset' headers,
+// and throttled responses also include a 'Retry-After' header.
+//
+// Limits are kept separately for each route. Requests are counted by a
+// Prometheus Counter, labelled by whether they were allowed or throttled. If
+// the store fails, requests are allowed, and counted as errors.
+func RateLimitMW(reg prometheus.Registerer, store RateLimitStore, policy RateLimit, opts ...MetricsOption) Middleware {
+
+	cfg := newMetricsConfig(opts)
+
+	if policy.Key == nil {
+		policy.Key = KeyByIP
+	}
+
+	// Create the Counter of rate limited requests. If it has already been
+	// registered, i.e. by another endpoint, use the existing one instead.
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.namespace,
+		Name:        "http_rate_limit_requests_total",
+		Help:        "HTTP Requests checked against a rate limit",
+		ConstLabels: cfg.constLabels,
+	}, []string{"method", "path", "result"})
+	requests = registerCollector(reg, requests).(*prometheus.CounterVec)
+
+	return func(next http.Handler) http.Handler {
+		if policy.Limit <= 0 || policy.Window <= 0 {
+			// Rate limiting is disabled.
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := policy.Key(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			method, path := r.Method, r.URL.Path
+			if d := getDetails(r); d != nil {
+				method, path = d.Method, d.RequestPath
+			}
+
+			// Keep limits separately for each route.
+			res, err := store.Take(r.Context(), method+" "+path+" "+key, policy, time.Now())
+			if err != nil {
+				requests.WithLabelValues(method, path, "error").Inc()
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, ceilSeconds(policy.Window)))
+
+			if !res.Allowed {
+				requests.WithLabelValues(method, path, "throttled").Inc()
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				Error(w, r, "Rate limit exceeded, retry later", http.StatusTooManyRequests)
+				return
+			}
+
+			requests.WithLabelValues(method, path, "allowed").Inc()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds returns the duration as a whole number of seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// WithRateLimit sets the rate limit applied to each of the server's endpoints,
+// unless an endpoint sets its own limit. See RateLimitMW.
+func WithRateLimit(policy RateLimit) Option {
+	return func(s *server) {
+		s.rateLimit = &policy
+	}
+}
+
+// WithRateLimitStore sets the store the server's rate limits are kept in. By
+// default, limits are kept in memory.
+func WithRateLimitStore(store RateLimitStore) Option {
+	return func(s *server) {
+		s.rateLimitStore = store
+	}
+}
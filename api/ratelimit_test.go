@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	is := is.New(t)
+
+	store := NewMemoryRateLimitStore()
+	policy := RateLimit{Limit: 2, Window: 10 * time.Second, Algorithm: TokenBucket}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	// A burst of the whole limit is allowed.
+	res, err := store.Take(ctx, "k", policy, now)
+	is.NoErr(err)
+	is.True(res.Allowed)       // first request is allowed.
+	is.Equal(res.Remaining, 1) // one request remains.
+	res, _ = store.Take(ctx, "k", policy, now)
+	is.True(res.Allowed)                // second request is allowed.
+	is.Equal(res.Remaining, 0)          // no requests remain.
+	is.Equal(res.Reset, 10*time.Second) // bucket is full again after the window.
+
+	// Then requests are throttled, until a token is refilled.
+	res, _ = store.Take(ctx, "k", policy, now.Add(time.Second))
+	is.True(!res.Allowed)                   // third request is throttled.
+	is.Equal(res.RetryAfter, 4*time.Second) // a token is refilled every 5 seconds.
+
+	res, _ = store.Take(ctx, "k", policy, now.Add(5*time.Second))
+	is.True(res.Allowed) // request is allowed once a token is refilled.
+
+	// Other keys have their own limit.
+	res, _ = store.Take(ctx, "other", policy, now.Add(5*time.Second))
+	is.True(res.Allowed)       // other key is allowed.
+	is.Equal(res.Remaining, 1) // other key has its own bucket.
+}
+
+func TestSlidingWindow(t *testing.T) {
+
+	is := is.New(t)
+
+	store := NewMemoryRateLimitStore()
+	policy := RateLimit{Limit: 2, Window: 10 * time.Second, Algorithm: SlidingWindow}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	// Fill the first window.
+	res, err := store.Take(ctx, "k", policy, start.Add(5*time.Second))
+	is.NoErr(err)
+	is.True(res.Allowed) // first request is allowed.
+	res, _ = store.Take(ctx, "k", policy, start.Add(6*time.Second))
+	is.True(res.Allowed)       // second request is allowed.
+	is.Equal(res.Remaining, 0) // no requests remain.
+
+	res, _ = store.Take(ctx, "k", policy, start.Add(7*time.Second))
+	is.True(!res.Allowed)                   // third request is throttled.
+	is.Equal(res.RetryAfter, 3*time.Second) // retry in the next window.
+
+	// Early in the next window, the previous window's requests still count.
+	res, _ = store.Take(ctx, "k", policy, start.Add(11*time.Second))
+	is.True(!res.Allowed)                   // request is throttled, as 1.8 requests are estimated.
+	is.Equal(res.RetryAfter, 4*time.Second) // retry once the estimate drops to 1.
+
+	res, _ = store.Take(ctx, "k", policy, start.Add(15*time.Second))
+	is.True(res.Allowed) // request is allowed once half of the previous window has slid out.
+
+	// After two windows, everything has slid out.
+	res, _ = store.Take(ctx, "k", policy, start.Add(30*time.Second))
+	is.True(res.Allowed)       // request is allowed.
+	is.Equal(res.Remaining, 1) // only this request counts.
+}
+
+func TestRateLimitMW(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, r, http.StatusOK, nil)
+	})
+
+	// Callers are authenticated by the endpoint's middleware, before being
+	// limited by their identity.
+	authmw := AuthMW(APIKeyAuthenticator("X-API-Key", StaticAPIKeys(map[string]string{"alice-key": "alice", "bob-key": "bob"})))
+	byIdentity := KeyByIdentity(PrincipalID)
+
+	// Create a server with a server wide limit, and endpoints with their own.
+	reg := prometheus.NewRegistry()
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/default", Handler: h},
+			{Method: "GET", Path: "/strict", Handler: h, Middlewares: []Middleware{authmw}, RateLimit: &RateLimit{Limit: 1, Window: time.Minute, Algorithm: SlidingWindow, Key: byIdentity}},
+			{Method: "GET", Path: "/unlimited", Handler: h, RateLimit: &RateLimit{}},
+		}
+	}), WithRegisterer(reg), WithRateLimit(RateLimit{Limit: 2, Window: time.Minute}))
+
+	// do makes a request from the given client, with the given identity's key.
+	do := func(path, addr, id string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", path, nil)
+		is.NoErr(err)
+		r.RemoteAddr = addr
+		if id != "" {
+			r.Header.Set("X-API-Key", id+"-key")
+		}
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	// The server wide limit applies to endpoints without their own.
+	rr := do("/default", "10.0.0.1:1234", "")
+	is.Equal(rr.Code, http.StatusOK)                        // first request is allowed.
+	is.Equal(rr.Header().Get("RateLimit-Limit"), "2")       // limit is set.
+	is.Equal(rr.Header().Get("RateLimit-Remaining"), "1")   // remaining is set.
+	is.Equal(rr.Header().Get("RateLimit-Reset"), "30")      // reset is set.
+	is.Equal(rr.Header().Get("RateLimit-Policy"), "2;w=60") // policy is set.
+	do("/default", "10.0.0.1:5678", "")
+	rr = do("/default", "10.0.0.1:1234", "")
+	is.Equal(rr.Code, http.StatusTooManyRequests)                         // third request from the same ip is throttled.
+	is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+	is.Equal(rr.Header().Get("Retry-After"), "30")                        // retry after is set.
+	is.Equal(rr.Header().Get("RateLimit-Remaining"), "0")                 // no requests remain.
+
+	rr = do("/default", "10.0.0.2:1234", "")
+	is.Equal(rr.Code, http.StatusOK) // other ips have their own limit.
+
+	// Endpoints can have their own limit and key.
+	rr = do("/strict", "10.0.0.1:1234", "alice")
+	is.Equal(rr.Code, http.StatusOK) // first request is allowed, despite the ip being throttled elsewhere.
+	rr = do("/strict", "10.0.0.2:1234", "alice")
+	is.Equal(rr.Code, http.StatusTooManyRequests) // same identity is throttled from another ip.
+	rr = do("/strict", "10.0.0.1:1234", "bob")
+	is.Equal(rr.Code, http.StatusOK) // other identities have their own limit.
+
+	// Endpoints can opt out of the server wide limit.
+	for i := 0; i < 3; i++ {
+		rr = do("/unlimited", "10.0.0.1:1234", "")
+		is.Equal(rr.Code, http.StatusOK)                 // request is allowed.
+		is.Equal(rr.Header().Get("RateLimit-Limit"), "") // no limit is set.
+	}
+
+	// Check requests are counted by route and result.
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http_rate_limit_requests_total", Help: "HTTP Requests checked against a rate limit"}, []string{"method", "path", "result"})
+	requests = registerCollector(reg, requests).(*prometheus.CounterVec)
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("GET", "/default", "allowed")), float64(3))   // allowed requests are counted.
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("GET", "/default", "throttled")), float64(1)) // throttled requests are counted.
+	is.Equal(testutil.ToFloat64(requests.WithLabelValues("GET", "/strict", "throttled")), float64(1))  // throttled requests are counted per route.
+}
+
+func TestKeyByClientIP(t *testing.T) {
+
+	is := is.New(t)
+
+	key := KeyByClientIP("10.0.0.0/8")
+
+	// req returns a request from the given address, forwarded for the given clients.
+	req := func(addr string, forwarded ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		for _, f := range forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		return r
+	}
+
+	is.Equal(key(req("10.0.0.1:1234", "203.0.113.1")), "ip:203.0.113.1")                         // clients behind trusted proxies are keyed by their own ip.
+	is.Equal(key(req("10.0.0.1:1234", "203.0.113.2")), "ip:203.0.113.2")                         // each client behind a proxy has its own key.
+	is.Equal(key(req("10.0.0.1:1234", "198.51.100.1, 203.0.113.1, 10.0.0.2")), "ip:203.0.113.1") // spoofed addresses before the last untrusted hop are ignored.
+	is.Equal(key(req("203.0.113.9:1234", "203.0.113.1")), "ip:203.0.113.9")                      // untrusted clients can't set their own key.
+	is.Equal(KeyByIP(req("10.0.0.1:1234", "203.0.113.1")), "ip:10.0.0.1")                        // KeyByIP keys by the remote address.
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// PanicHandler responds to a request whose handler panicked with the given value.
+type PanicHandler func(w http.ResponseWriter, r *http.Request, err interface{})
+
+// RecoverMW returns a middleware that recovers from panics in the wrapped
+// handler. The panic and its stack trace are logged with the request's ID, and
+// counted by a Prometheus Counter labelled by route. The request is responded
+// to with a 500 Internal Server Error problem, which doesn't include the panic,
+// unless the response has already begun.
+//
+// Panics with http.ErrAbortHandler are not recovered, so the server can abort
+// the response as intended.
+func RecoverMW(logger *zap.SugaredLogger, reg prometheus.Registerer, opts ...MetricsOption) Middleware {
+	return recoverMW(logger, reg, opts, nil)
+}
+
+// recoverMW implements RecoverMW, responding to requests with the given
+// handler, if not nil.
+func recoverMW(logger *zap.SugaredLogger, reg prometheus.Registerer, opts []MetricsOption, handler PanicHandler) Middleware {
+
+	cfg := newMetricsConfig(opts)
+
+	// Create the Counter of panics. If it has already been registered, i.e. by
+	// another server, use the existing one instead.
+	panics := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.namespace,
+		Name:        "http_panics_total",
+		Help:        "HTTP Requests whose handler panicked",
+		ConstLabels: cfg.constLabels,
+	}, []string{"method", "path"})
+	panics = registerCollector(reg, panics).(*prometheus.CounterVec)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				method, path := r.Method, r.URL.Path
+				fields := []interface{}{"method", method, "path", path}
+				if d := getDetails(r); d != nil {
+					method, path = d.Method, d.RequestPath
+					fields = append([]interface{}{
+						"request_id", d.RequestID,
+						"method", method,
+						"path", r.URL.Path,
+					}, requestFields(d)...)
+				}
+
+				panics.WithLabelValues(method, path).Inc()
+				logger.Errorw("panic", append(fields,
+					"panic", fmt.Sprint(err),
+					"stack", string(debug.Stack()),
+				)...)
+				SpanFromRequest(r).RecordError(fmt.Errorf("panic: %v", err))
+
+				if responseStarted(w) {
+					// The response has begun, so it's too late to replace it.
+					return
+				}
+
+				if handler != nil {
+					handler(w, r, err)
+					return
+				}
+				Error(w, r, "Internal Server Error", http.StatusInternalServerError)
+			}()
+
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		})
+	}
+}
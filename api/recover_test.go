@@ -0,0 +1,141 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestRecoverMW(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	reg := prometheus.NewRegistry()
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "GET",
+				Path:   "/items/:id",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					panic("database password is hunter2")
+				}),
+			},
+			{
+				Method: "GET",
+				Path:   "/partial",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Respond(w, r, http.StatusOK, map[string]string{"partial": "response"})
+					panic("too late")
+				}),
+			},
+		}
+	}), WithRegisterer(reg))
+
+	r, err := http.NewRequest("GET", "/items/1", nil)
+	is.NoErr(err)
+	r.Header.Set("X-Request-ID", "abc123")
+
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusInternalServerError)                                                                                  // response code is 500.
+	is.Equal(rr.Header().Get("Content-Type"), "application/problem+json")                                                              // problem is responded with.
+	is.Equal(rr.Body.String(), `{"detail":"Internal Server Error","status":500,"title":"Internal Server Error","type":"about:blank"}`) // panic isn't leaked.
+
+	// Check the panic is logged, and the request is logged with its status.
+	is.Equal(logs.Len(), 2) // panic and request are logged.
+	panicLog, requestLog := logs.All()[0], logs.All()[1]
+	is.Equal(panicLog.Message, "panic")                                                   // panic is logged.
+	is.Equal(panicLog.ContextMap()["request_id"], "abc123")                               // panic is logged with the request id.
+	is.Equal(panicLog.ContextMap()["panic"], "database password is hunter2")              // panic value is logged.
+	is.True(strings.Contains(panicLog.ContextMap()["stack"].(string), "recover_test.go")) // stack trace is logged.
+	is.Equal(requestLog.ContextMap()["status"], int64(http.StatusInternalServerError))    // request is logged with the 500 status.
+
+	// A panic after the response has begun can't be responded to.
+	r, err = http.NewRequest("GET", "/partial", nil)
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusOK)                     // response code is unchanged.
+	is.Equal(rr.Body.String(), `{"partial":"response"}`) // response body is unchanged.
+
+	// Check panics are counted by route, and seen by the metrics middleware.
+	panics := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http_panics_total", Help: "HTTP Requests whose handler panicked"}, []string{"method", "path"})
+	panics = registerCollector(reg, panics).(*prometheus.CounterVec)
+	is.Equal(testutil.ToFloat64(panics.WithLabelValues("GET", "/items/:id")), float64(1)) // panic is counted by route.
+	is.Equal(testutil.ToFloat64(panics.WithLabelValues("GET", "/partial")), float64(1))   // late panic is counted.
+
+	mfs, err := reg.Gather()
+	is.NoErr(err)
+	var observed uint64
+	for _, mf := range mfs {
+		if mf.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["path"] == "/items/:id" && labels["status"] == "5XX" {
+				observed = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	is.Equal(observed, uint64(1)) // request is observed as a 5XX.
+}
+
+func TestWithPanicHandler(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{{
+			Method:       "GET",
+			Path:         "/",
+			Handler:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("oops") }),
+			SuppressLogs: true,
+		}}
+	}), WithRegisterer(prometheus.NewRegistry()), WithPanicHandler(func(w http.ResponseWriter, r *http.Request, err interface{}) {
+		Error(w, r, "Try again later", http.StatusServiceUnavailable)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+
+	is.Equal(rr.Code, http.StatusServiceUnavailable) // panic handler responds.
+	is.Equal(logs.Len(), 1)                          // panic is still logged.
+}
+
+func TestRecoverMWAbortHandler(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	h := RecoverMW(logger, prometheus.NewRegistry())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		is.Equal(recover(), http.ErrAbortHandler) // abort panics are not recovered.
+		is.Equal(logs.Len(), 0)                   // abort panics are not logged.
+	}()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
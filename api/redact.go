@@ -0,0 +1,390 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces sensitive values that have been redacted.
+const Redacted = "[REDACTED]"
+
+// Patterns of sensitive values commonly found in free text, for use with
+// RedactPatterns.
+var (
+	// CardNumberPattern matches payment card numbers, optionally separated by
+	// spaces or dashes.
+	CardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	// EmailPattern matches email addresses.
+	EmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// defaultRedactedHeaders are the headers that are always redacted, as they
+// carry credentials.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Redactor removes sensitive data, such as credentials and personal details,
+// from values before they are logged or responded with, by its rules. A
+// server's redactor, set with WithRedactor, is applied to everything the
+// server logs, including the fields of loggers returned by LoggerFromRequest,
+// and to the fields of problem responses. A nil Redactor redacts nothing.
+type Redactor struct {
+	headers  map[string]bool
+	params   map[string]bool
+	fields   [][]string
+	patterns []*regexp.Regexp
+}
+
+// RedactionRule is a function that can be passed to NewRedactor to add to
+// what it redacts.
+type RedactionRule func(*Redactor)
+
+// NewRedactor returns a Redactor with the given rules. The 'Authorization',
+// 'Proxy-Authorization', 'Cookie' and 'Set-Cookie' headers are always
+// redacted.
+func NewRedactor(rules ...RedactionRule) *Redactor {
+	rd := &Redactor{headers: make(map[string]bool), params: make(map[string]bool)}
+	RedactHeaders(defaultRedactedHeaders...)(rd)
+	for _, rule := range rules {
+		rule(rd)
+	}
+	return rd
+}
+
+// RedactHeaders redacts the values of the given headers.
+func RedactHeaders(names ...string) RedactionRule {
+	return func(rd *Redactor) {
+		for _, name := range names {
+			rd.headers[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// RedactQueryParams redacts the values of the given query parameters, i.e.
+// 'access_token'.
+func RedactQueryParams(names ...string) RedactionRule {
+	return func(rd *Redactor) {
+		for _, name := range names {
+			rd.params[name] = true
+		}
+	}
+}
+
+// RedactFields redacts the values of the given fields of JSON objects, problem
+// responses and log lines. Fields are given as paths of dot separated names,
+// i.e. 'card.number', where '*' matches any name or array index. A path of a
+// single name, i.e. 'password', matches fields with that name at any depth.
+func RedactFields(paths ...string) RedactionRule {
+	return func(rd *Redactor) {
+		for _, path := range paths {
+			rd.fields = append(rd.fields, strings.Split(path, "."))
+		}
+	}
+}
+
+// RedactPatterns redacts the parts of any string that match the given
+// patterns, i.e. CardNumberPattern.
+func RedactPatterns(patterns ...*regexp.Regexp) RedactionRule {
+	return func(rd *Redactor) {
+		rd.patterns = append(rd.patterns, patterns...)
+	}
+}
+
+// String returns s with the parts matching the redactor's patterns redacted.
+func (rd *Redactor) String(s string) string {
+	if rd == nil {
+		return s
+	}
+	for _, p := range rd.patterns {
+		s = p.ReplaceAllString(s, Redacted)
+	}
+	return s
+}
+
+// Header returns a copy of h, with the values of redacted headers, and the
+// parts of other values matching the redactor's patterns, redacted.
+func (rd *Redactor) Header(h http.Header) http.Header {
+	if rd == nil {
+		return h
+	}
+	redacted := make(http.Header, len(h))
+	for name, values := range h {
+		vs := make([]string, len(values))
+		for i, v := range values {
+			if rd.headers[http.CanonicalHeaderKey(name)] {
+				vs[i] = Redacted
+			} else {
+				vs[i] = rd.String(v)
+			}
+		}
+		redacted[name] = vs
+	}
+	return redacted
+}
+
+// Query returns the raw query string with the values of redacted parameters,
+// and the parts of other values matching the redactor's patterns, redacted.
+func (rd *Redactor) Query(query string) string {
+	if rd == nil || query == "" {
+		return query
+	}
+	parts := strings.Split(query, "&")
+	for i, part := range parts {
+		j := strings.Index(part, "=")
+		if j < 0 {
+			continue
+		}
+		key, value := part[:j], part[j+1:]
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if rd.params[name] {
+			parts[i] = key + "=" + Redacted
+			continue
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			if rv := rd.String(v); rv != v {
+				parts[i] = key + "=" + url.QueryEscape(rv)
+			}
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// URL returns the given URL, i.e. a 'Referer' header, with its query redacted,
+// and the parts of it matching the redactor's patterns redacted.
+func (rd *Redactor) URL(rawurl string) string {
+	if rd == nil {
+		return rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rd.String(rawurl)
+	}
+	u.RawQuery = rd.Query(u.RawQuery)
+	return rd.String(u.String())
+}
+
+// JSON returns the given JSON document with its redacted fields, and the parts
+// of its strings matching the redactor's patterns, redacted, i.e. to log a
+// request or response body. If b isn't valid JSON, it is redacted as a string.
+func (rd *Redactor) JSON(b []byte) []byte {
+	if rd == nil {
+		return b
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return []byte(rd.String(string(b)))
+	}
+	redacted, err := json.Marshal(rd.value(nil, v))
+	if err != nil {
+		return []byte(rd.String(string(b)))
+	}
+	return redacted
+}
+
+// Value returns a copy of v, a value that can be encoded as JSON, with its
+// redacted fields, and the parts of its strings matching the redactor's
+// patterns, redacted.
+func (rd *Redactor) Value(v interface{}) interface{} {
+	if rd == nil {
+		return v
+	}
+	return rd.value(nil, v)
+}
+
+// value redacts v, found at the given path.
+func (rd *Redactor) value(path []string, v interface{}) interface{} {
+	if len(path) > 0 && rd.redactsField(path) {
+		return Redacted
+	}
+
+	switch v := v.(type) {
+	case nil, bool, float64, int, int64:
+		return v
+	case string:
+		return rd.String(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = rd.value(append(path[:len(path):len(path)], k), e)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, e := range v {
+			redacted[i] = rd.value(append(path[:len(path):len(path)], "*"), e)
+		}
+		return redacted
+	}
+
+	// Other values, i.e. structs, are redacted as they'd be encoded.
+	if len(rd.fields) == 0 && len(rd.patterns) == 0 {
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return v
+	}
+	return rd.value(path, decoded)
+}
+
+// redactsField reports whether the field at the given path is redacted.
+func (rd *Redactor) redactsField(path []string) bool {
+	for _, f := range rd.fields {
+		if len(f) == 1 {
+			if f[0] == path[len(path)-1] {
+				return true
+			}
+			continue
+		}
+		if len(f) != len(path) {
+			continue
+		}
+		match := true
+		for i := range f {
+			if f[i] != "*" && f[i] != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactLogger returns a logger that redacts the fields and messages it logs,
+// using rd, before writing them with the given logger.
+func RedactLogger(l *zap.SugaredLogger, rd *Redactor) *zap.SugaredLogger {
+	if c, ok := l.Desugar().Core().(*redactingCore); ok && c.rd == rd {
+		// The logger already redacts.
+		return l
+	}
+	return l.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: c, rd: rd}
+	})).Sugar()
+}
+
+// redactingCore is a zapcore.Core that redacts fields and messages before
+// they are written.
+type redactingCore struct {
+	zapcore.Core
+	rd *Redactor
+}
+
+// With implements zapcore.Core.
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.redact(fields)), rd: c.rd}
+}
+
+// Check implements zapcore.Core. The wrapped core decides whether the entry is
+// written, i.e. by its level or by sampling, and the entry is then written
+// redacted by the cores it chose.
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	ent.Message = c.rd.String(ent.Message)
+	checked := c.Core.Check(ent, nil)
+	if checked == nil {
+		return ce
+	}
+	return ce.AddCore(ent, &redactedWriter{Core: c.Core, checked: checked, redact: c.redact})
+}
+
+// Write implements zapcore.Core.
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.rd.String(ent.Message)
+	return c.Core.Write(ent, c.redact(fields))
+}
+
+// redact returns a copy of the fields, redacted.
+func (c *redactingCore) redact(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch {
+		case c.rd.redactsField([]string{f.Key}):
+			f = zap.String(f.Key, Redacted)
+		case f.Type == zapcore.StringType:
+			f.String = c.rd.String(f.String)
+		case f.Type == zapcore.ByteStringType || f.Type == zapcore.BinaryType:
+			if b, ok := f.Interface.([]byte); ok {
+				f.Interface = c.rd.bytes(b)
+			}
+		case f.Type == zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zap.String(f.Key, c.rd.String(safeString(err, err.Error)))
+			}
+		case f.Type == zapcore.StringerType:
+			if str, ok := f.Interface.(fmt.Stringer); ok {
+				f = zap.String(f.Key, c.rd.String(safeString(str, str.String)))
+			}
+		case f.Type == zapcore.ReflectType:
+			f = zap.Reflect(f.Key, c.rd.value([]string{f.Key}, f.Interface))
+		case f.Type == zapcore.ObjectMarshalerType || f.Type == zapcore.ArrayMarshalerType:
+			// Redact objects and arrays as the generic values they encode to.
+			enc := zapcore.NewMapObjectEncoder()
+			f.AddTo(enc)
+			f = zap.Reflect(f.Key, c.rd.value([]string{f.Key}, enc.Fields[f.Key]))
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
+
+// bytes returns b with the parts matching the redactor's patterns redacted.
+func (rd *Redactor) bytes(b []byte) []byte {
+	for _, p := range rd.patterns {
+		b = p.ReplaceAll(b, []byte(Redacted))
+	}
+	return b
+}
+
+// safeString returns the result of s, a method of v, as zap would encode it:
+// if v is a nil pointer whose method panics, it is "<nil>".
+func safeString(v interface{}, s func() string) (str string) {
+	defer func() {
+		if p := recover(); p != nil {
+			if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+				str = "<nil>"
+				return
+			}
+			str = fmt.Sprintf("PANIC=%v", p)
+		}
+	}()
+	return s()
+}
+
+// redactedWriter is added to an entry checked by a redactingCore, to write it
+// with the cores that its wrapped core chose to write it with, once its fields
+// have been redacted.
+type redactedWriter struct {
+	zapcore.Core
+	checked *zapcore.CheckedEntry
+	redact  func([]zapcore.Field) []zapcore.Field
+}
+
+// Write implements zapcore.Core.
+func (w *redactedWriter) Write(_ zapcore.Entry, fields []zapcore.Field) error {
+	w.checked.Write(w.redact(fields)...)
+	return nil
+}
+
+// WithRedactor sets the redactor applied to everything the server logs, and
+// to the fields of problem responses. See Redactor.
+func WithRedactor(rd *Redactor) Option {
+	return func(s *server) {
+		s.redactor = rd
+	}
+}
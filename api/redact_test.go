@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Sensitive values, which must never be logged or responded with.
+const (
+	secretToken    = "s3cr3t-t0k3n"
+	secretKey      = "k3y-0f-th3-c4stl3"
+	secretPassword = "hunter2"
+	secretEmail    = "jane.doe@example.com"
+	secretCard     = "4111 1111 1111 1111"
+)
+
+var secrets = []string{secretToken, secretKey, secretPassword, secretEmail, secretCard}
+
+// newTestRedactor returns a redactor with rules redacting each of the secrets.
+func newTestRedactor() *Redactor {
+	return NewRedactor(
+		RedactHeaders("X-Api-Key"),
+		RedactQueryParams("access_token"),
+		RedactFields("password", "payment.card.number"),
+		RedactPatterns(CardNumberPattern, EmailPattern),
+	)
+}
+
+func TestRedactor(t *testing.T) {
+
+	is := is.New(t)
+
+	rd := newTestRedactor()
+
+	is.Equal(rd.String("card "+secretCard+" of "+secretEmail), "card [REDACTED] of [REDACTED]") // patterns are redacted.
+
+	h := http.Header{"Authorization": {"Bearer " + secretToken}, "X-Api-Key": {secretKey}, "Accept": {"application/json"}}
+	is.Equal(rd.Header(h), http.Header{"Authorization": {Redacted}, "X-Api-Key": {Redacted}, "Accept": {"application/json"}}) // redacted headers are redacted.
+	is.Equal(h.Get("X-Api-Key"), secretKey)                                                                                   // headers are copied.
+
+	is.Equal(rd.Query("access_token="+secretToken+"&email=jane.doe%40example.com&page=2"), "access_token=[REDACTED]&email=%5BREDACTED%5D&page=2") // query params and patterns are redacted.
+	is.Equal(rd.URL("https://example.com/callback?access_token="+secretToken), "https://example.com/callback?access_token=[REDACTED]")            // urls are redacted.
+
+	body := rd.JSON([]byte(`{"user":{"password":"hunter2","name":"jane"},"payment":{"card":{"number":"4111111111111111","expiry":"01/30"}},"passwords":["hunter2"]}`))
+	is.Equal(string(body), `{"passwords":["hunter2"],"payment":{"card":{"expiry":"01/30","number":"[REDACTED]"}},"user":{"name":"jane","password":"[REDACTED]"}}`) // fields are redacted, by name and path.
+
+	v := rd.Value(map[string]interface{}{
+		"items": []interface{}{map[string]interface{}{"password": secretPassword}},
+		"user":  struct{ Email string }{Email: secretEmail},
+	})
+	is.Equal(v, map[string]interface{}{
+		"items": []interface{}{map[string]interface{}{"password": Redacted}},
+		"user":  map[string]interface{}{"Email": Redacted},
+	}) // values are redacted as they're encoded.
+
+	rd = NewRedactor(RedactFields("items.*.id"))
+	is.Equal(string(rd.JSON([]byte(`{"items":[{"id":1},{"id":2}],"id":3}`))), `{"id":3,"items":[{"id":"[REDACTED]"},{"id":"[REDACTED]"}]}`) // wildcards match array items.
+
+	var none *Redactor
+	is.Equal(none.String(secretEmail), secretEmail) // nil redactors redact nothing.
+}
+
+func TestRedactLogger(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.DebugLevel)
+
+	rd := newTestRedactor()
+	logger = RedactLogger(logger, rd)
+	is.Equal(RedactLogger(logger, rd), logger) // loggers aren't redacted twice.
+
+	logger.With("password", secretPassword).Infow("signed up "+secretEmail,
+		"card", secretCard,
+		"error", errors.New("declined "+secretCard),
+		"payment", map[string]interface{}{"card": map[string]interface{}{"number": secretCard}},
+	)
+
+	is.Equal(logs.Len(), 1) // line is logged.
+	ll := logs.All()[0]
+	fields := ll.ContextMap()
+	is.Equal(ll.Message, "signed up [REDACTED]")                                                            // message is redacted.
+	is.Equal(fields["password"], Redacted)                                                                  // redacted fields are redacted.
+	is.Equal(fields["card"], Redacted)                                                                      // string fields are redacted.
+	is.Equal(fields["error"], "declined [REDACTED]")                                                        // errors are redacted.
+	is.Equal(fields["payment"], map[string]interface{}{"card": map[string]interface{}{"number": Redacted}}) // nested fields are redacted.
+}
+
+func TestWithRedactor(t *testing.T) {
+
+	is := is.New(t)
+
+	// Log everything the server logs, as it would be written.
+	var out bytes.Buffer
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&out), zap.DebugLevel)).Sugar()
+
+	// And access log lines written to a sink.
+	var sink bytes.Buffer
+
+	a := apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "POST",
+				Path:   "/payments",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					LoggerFromRequest(r, logger).Infow("paying", "email", secretEmail, "password", secretPassword)
+					Problem(w, r, "Payment declined", "The card "+secretCard+" was declined", http.StatusPaymentRequired, WithFields(map[string]interface{}{
+						"payment": map[string]interface{}{"card": map[string]interface{}{"number": secretCard}},
+						"contact": secretEmail,
+					}))
+				}),
+			},
+			{
+				Method: "GET",
+				Path:   "/fail",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					RespondError(w, r, errors.New("no account for "+secretEmail))
+				}),
+			},
+			{
+				Method: "GET",
+				Path:   "/panic",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					panic("card " + secretCard)
+				}),
+			},
+		}
+	})
+
+	srvs := []http.Handler{
+		NewServer(":0", logger, a, WithRegisterer(prometheus.NewRegistry()), WithRedactor(newTestRedactor()), WithAccessLog(AccessLogHeaders("Authorization", "X-Api-Key", "User-Agent"))).Handler,
+		NewServer(":0", logger, a, WithRegisterer(prometheus.NewRegistry()), WithRedactor(newTestRedactor()), WithAccessLog(AccessLogOutput(JSONLogFormat, &sink), AccessLogHeaders("X-Api-Key"))).Handler,
+	}
+
+	var problems []string
+	for _, h := range srvs {
+		for _, path := range []string{"/payments", "/fail", "/panic"} {
+			method := "GET"
+			if path == "/payments" {
+				method = "POST"
+			}
+			r := httptest.NewRequest(method, path+"?access_token="+secretToken+"&email="+secretEmail, strings.NewReader(`{}`))
+			r.Header.Set("Authorization", "Bearer "+secretToken)
+			r.Header.Set("X-Api-Key", secretKey)
+			r.Header.Set("User-Agent", "agent/1.0 ("+secretEmail+")")
+			r.Header.Set("Referer", "https://example.com/?access_token="+secretToken)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+			if path == "/payments" {
+				is.Equal(rr.Code, http.StatusPaymentRequired) // problem is responded with.
+				problems = append(problems, rr.Body.String())
+			}
+		}
+	}
+
+	for _, secret := range secrets {
+		is.True(!strings.Contains(out.String(), secret))                 // secrets are never logged.
+		is.True(!strings.Contains(sink.String(), secret))                // secrets are never written to the access log.
+		is.True(!strings.Contains(strings.Join(problems, "\n"), secret)) // secrets are never responded with in problems.
+	}
+
+	var lines []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var line map[string]interface{}
+		is.NoErr(json.Unmarshal([]byte(l), &line))
+		lines = append(lines, line)
+	}
+	is.Equal(lines[0]["msg"], "paying")         // handler logs are written.
+	is.Equal(lines[0]["password"], Redacted)    // handler log fields are redacted.
+	is.True(lines[0]["request_id"] != Redacted) // other fields are logged.
+
+	var access map[string]interface{}
+	for _, line := range lines {
+		if line["msg"] == "request" && line["route"] == "/payments" {
+			access = line
+		}
+	}
+	is.Equal(access["query"], "access_token=[REDACTED]&email=%5BREDACTED%5D")                                                                                                                  // access log query is redacted.
+	is.Equal(access["referer"], "https://example.com/?access_token=[REDACTED]")                                                                                                                // access log referer is redacted.
+	is.Equal(access["user_agent"], "agent/1.0 ([REDACTED])")                                                                                                                                   // access log user agent is redacted.
+	is.Equal(access["headers"], map[string]interface{}{"Authorization": []interface{}{Redacted}, "X-Api-Key": []interface{}{Redacted}, "User-Agent": []interface{}{"agent/1.0 ([REDACTED])"}}) // access log headers are redacted.
+
+	var p map[string]interface{}
+	is.NoErr(json.Unmarshal([]byte(problems[0]), &p))
+	is.Equal(p["detail"], "The card [REDACTED] was declined")                                          // problem detail is redacted.
+	is.Equal(p["contact"], Redacted)                                                                   // problem extras are redacted.
+	is.Equal(p["payment"], map[string]interface{}{"card": map[string]interface{}{"number": Redacted}}) // problem extra fields are redacted.
+	is.Equal(p["title"], "Payment declined")                                                           // other problem fields are unchanged.
+}
+
+// nilError is an error whose Error method panics for nil pointers.
+type nilError struct{ msg string }
+
+func (e *nilError) Error() string { return e.msg }
+
+func TestRedactLoggerCores(t *testing.T) {
+
+	is := is.New(t)
+
+	rd := newTestRedactor()
+
+	// Sampling by the wrapped core is kept.
+	core, logs := observer.New(zap.InfoLevel)
+	sampled := zapcore.NewSamplerWithOptions(core, time.Minute, 1, 100)
+	logger := RedactLogger(zap.New(sampled).Sugar(), rd)
+	for i := 0; i < 10; i++ {
+		logger.Infow("paying", "email", secretEmail)
+	}
+	is.Equal(logs.Len(), 1)                                 // identical lines are sampled.
+	is.Equal(logs.All()[0].ContextMap()["email"], Redacted) // sampled lines are redacted.
+
+	// Each core of a tee is only written to at its own level.
+	info, infoLogs := observer.New(zap.InfoLevel)
+	debug, debugLogs := observer.New(zap.DebugLevel)
+	logger = RedactLogger(zap.New(zapcore.NewTee(info, debug)).Sugar(), rd)
+	logger.Debugw("debugging", "email", secretEmail)
+	logger.Infow("paying", "email", secretEmail)
+	is.Equal(infoLogs.Len(), 1)                                  // info core only gets info lines.
+	is.Equal(debugLogs.Len(), 2)                                 // debug core gets all lines.
+	is.Equal(debugLogs.All()[0].ContextMap()["email"], Redacted) // tee'd lines are redacted.
+
+	// Nil errors, and binary fields, are redacted.
+	core, logs = observer.New(zap.DebugLevel)
+	var err *nilError
+	RedactLogger(zap.New(core).Sugar(), rd).Desugar().Info("failed",
+		zap.Error(err),
+		zap.ByteString("text", []byte("from "+secretEmail)),
+		zap.Binary("data", []byte("card "+secretCard)),
+	)
+	fields := logs.All()[0].ContextMap()
+	is.Equal(fields["error"], "<nil>")                  // nil errors are logged as nil.
+	is.Equal(fields["text"], "from [REDACTED]")         // byte strings are redacted.
+	is.Equal(fields["data"], []byte("card [REDACTED]")) // binary data is redacted.
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/segmentio/ksuid"
+)
+
+// defaultRequestIDHeader is the header request IDs are read from, and echoed
+// in, if no other header is configured.
+const defaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of a request ID taken from a request.
+// Longer IDs are truncated.
+const maxRequestIDLength = 128
+
+// requestIDConfig configures how a server identifies requests.
+type requestIDConfig struct {
+	header   string
+	generate func() string
+}
+
+// defaultRequestIDConfig is used when a request isn't served by a server.
+var defaultRequestIDConfig = requestIDConfig{
+	header:   defaultRequestIDHeader,
+	generate: newRequestID,
+}
+
+// newRequestID returns a new, unique request ID.
+func newRequestID() string {
+	return ksuid.New().String()
+}
+
+// requestID returns the ID of the given request, which is taken from the
+// request's header if it is valid, or generated otherwise. If the request has
+// already been given an ID, that ID is returned.
+func (c requestIDConfig) requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(keyRequestID).(string); ok {
+		return id
+	}
+	id := r.Header.Get(c.header)
+	if len(id) > maxRequestIDLength {
+		id = id[:maxRequestIDLength]
+	}
+	if id == "" || !validRequestID(id) {
+		id = c.generate()
+	}
+	return id
+}
+
+// validRequestID reports whether id only contains characters that are safe to
+// log and echo, i.e. letters, digits and common separators. This stops clients
+// from injecting fake log lines or headers via their request ID.
+func validRequestID(id string) bool {
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=', c == '@':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDFromContext returns the ID of the request the given context belongs
+// to, or an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	d, ok := ctx.Value(keyDetails).(*details)
+	if !ok {
+		return ""
+	}
+	return d.RequestID
+}
+
+// Transport is a http.RoundTripper that forwards correlation headers, from the
+// request being served, onto outgoing requests, so that the calls a service
+// makes can be correlated with the request that caused them. Outgoing requests
+// must use the context of the request being served, i.e. via
+// http.NewRequestWithContext(r.Context(), ...).
+//
+// The request ID is always forwarded, using the header the server is configured
+// with. If the request is being traced, the 'traceparent' and 'tracestate'
+// headers are set so that the callee continues the trace.
+type Transport struct {
+	// Base is the RoundTripper used to make requests. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+	// Headers are the names of any other headers to copy from the request being
+	// served, i.e. 'Baggage'.
+	Headers []string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	d, ok := req.Context().Value(keyDetails).(*details)
+	if !ok {
+		// The request isn't made while serving a request, so there is nothing to forward.
+		return base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the given request, so copy it.
+	out := req.Clone(req.Context())
+
+	for _, name := range t.Headers {
+		if vs := d.header.Values(name); len(vs) > 0 && out.Header.Get(name) == "" {
+			out.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), vs...)
+		}
+	}
+
+	header := d.requestIDHeader
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+	out.Header.Set(header, d.RequestID)
+
+	if sc := d.span.SpanContext(); sc.IsValid() {
+		out.Header.Set("traceparent", sc.Traceparent())
+		if sc.TraceState != "" {
+			out.Header.Set("tracestate", sc.TraceState)
+		} else {
+			out.Header.Del("tracestate")
+		}
+	}
+
+	return base.RoundTrip(out)
+}
+
+// WithRequestIDHeader sets the header request IDs are read from, and echoed in
+// on every response. By default, 'X-Request-ID' is used.
+func WithRequestIDHeader(name string) Option {
+	return func(s *server) {
+		s.requestIDs.header = name
+	}
+}
+
+// WithRequestIDGenerator sets the function used to generate IDs for requests
+// without a valid ID of their own. By default, a KSUID is generated.
+func WithRequestIDGenerator(fn func() string) Option {
+	return func(s *server) {
+		s.requestIDs.generate = fn
+	}
+}
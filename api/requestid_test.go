@@ -0,0 +1,185 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestRequestIDValidation(t *testing.T) {
+
+	tests := []struct {
+		Name       string
+		RequestID  string
+		ExpectedID string
+	}{
+		{"valid id is kept", "a1b2-c3d4_e5.f6:g7/h8+i9=j0@k", "a1b2-c3d4_e5.f6:g7/h8+i9=j0@k"},
+		{"long id is truncated", strings.Repeat("a", 200), strings.Repeat("a", 128)},
+		{"id with newline is replaced", "abc\nlevel=error msg=injected", "generated"},
+		{"id with spaces is replaced", "abc def", "generated"},
+		{"missing id is generated", "", "generated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			r, err := http.NewRequest("GET", "/foo", nil)
+			is.NoErr(err)
+			r.Header.Set("X-Correlation-ID", tt.RequestID)
+
+			r = setDetails(r, "/foo", map[string]string{}, requestIDConfig{
+				header:   "X-Correlation-ID",
+				generate: func() string { return "generated" },
+			})
+
+			is.Equal(RequestIDFromContext(r.Context()), tt.ExpectedID) // request id is as expected.
+		})
+	}
+}
+
+func TestServerEchoesRequestID(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// Create a server with a custom request id header and generator.
+	srv := NewServer(":0", logger, limitsAPI(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithRequestIDHeader("X-Correlation-ID"),
+		WithRequestIDGenerator(func() string { return "generated" }),
+	)
+
+	// Make a request without an id.
+	r, err := http.NewRequest("POST", "/small", strings.NewReader(`{}`))
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Header().Get("X-Correlation-ID"), "generated") // generated id is echoed.
+
+	// Make a request with an id, but with a rejected body.
+	r, err = http.NewRequest("POST", "/small", strings.NewReader(`{"a":"Brown Betty"}`))
+	is.NoErr(err)
+	r.Header.Set("X-Correlation-ID", "abc")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Header().Get("X-Correlation-ID"), "abc") // given id is echoed.
+	is.Equal(rr.Header().Get("X-Request-ID"), "")        // default header isn't used.
+}
+
+func TestServerEchoesRequestIDWhenUnrouted(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	// Generate a different id for each request.
+	var n int
+	srv := NewServer(":0", logger, limitsAPI(),
+		WithRegisterer(prometheus.NewRegistry()),
+		WithRequestIDGenerator(func() string { n++; return fmt.Sprintf("generated-%d", n) }),
+	)
+
+	// Make a request to a path without an endpoint.
+	r, err := http.NewRequest("GET", "/missing", nil)
+	is.NoErr(err)
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusNotFound)                   // request isn't routed.
+	is.Equal(rr.Header().Get("X-Request-ID"), "generated-1") // not found responses echo the id.
+
+	// Make a request with a method the endpoint doesn't allow.
+	r, err = http.NewRequest("DELETE", "/small", nil)
+	is.NoErr(err)
+	r.Header.Set("X-Request-ID", "abc")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusMethodNotAllowed)   // request isn't routed.
+	is.Equal(rr.Header().Get("X-Request-ID"), "abc") // method not allowed responses echo the id.
+
+	// Make a request that is routed.
+	r, err = http.NewRequest("POST", "/small", strings.NewReader(`{}`))
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Header().Get("X-Request-ID"), "generated-2")                                   // routed responses echo the id.
+	is.Equal(logs.FilterMessage("request").All()[0].ContextMap()["request_id"], "generated-2") // routed requests are only given one id.
+}
+
+func TestTransportForwardsCorrelationHeaders(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create a downstream service, that records the headers it receives.
+	var received http.Header
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer downstream.Close()
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	client := &http.Client{Transport: &Transport{Headers: []string{"Baggage"}}}
+
+	var spanContext SpanContext
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanContext = SpanFromRequest(r).SpanContext()
+
+		req, err := http.NewRequest("GET", downstream.URL, nil)
+		is.NoErr(err)
+		req.Header.Set("tracestate", "stale=1")
+
+		resp, err := client.Do(req.WithContext(r.Context()))
+		is.NoErr(err)
+		resp.Body.Close()
+
+		is.Equal(req.Header.Get("tracestate"), "stale=1") // outgoing request isn't modified.
+	})
+
+	// Create a traced server, that calls the downstream service.
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{{Method: "GET", Path: "/call", Handler: h}}
+	}), WithRegisterer(prometheus.NewRegistry()), WithRequestIDHeader("X-Correlation-ID"), WithTracing(NewInMemoryExporter()))
+
+	r, err := http.NewRequest("GET", "/call", nil)
+	is.NoErr(err)
+	r.Header.Set("X-Correlation-ID", "abc")
+	r.Header.Set("Baggage", "tea=earl-grey")
+	r.Header.Set("X-Other", "not forwarded")
+	srv.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	is.Equal(received.Get("X-Correlation-ID"), "abc")                // request id is forwarded.
+	is.Equal(received.Get("Baggage"), "tea=earl-grey")               // configured headers are forwarded.
+	is.Equal(received.Get("X-Other"), "")                            // other headers aren't forwarded.
+	is.Equal(received.Get("traceparent"), spanContext.Traceparent()) // trace is continued by the callee.
+	is.Equal(received.Get("tracestate"), "")                         // stale trace state is removed.
+}
+
+func TestTransportWithoutRequest(t *testing.T) {
+
+	is := is.New(t)
+
+	var received http.Header
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer downstream.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+
+	resp, err := client.Get(downstream.URL)
+	is.NoErr(err)
+	resp.Body.Close()
+
+	is.Equal(received.Get("X-Request-ID"), "") // nothing is forwarded outside of a request.
+}
@@ -1,44 +1,132 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/peterbourgon/mergemap"
 )
 
-// Decode should be used to convert the request's JSON body into the given v value.
+// Decode should be used to convert the request's body into the given v value.
+// The body is decoded using the codec registered for the request's content type,
+// or JSON if the request has no content type. If there is no codec for the
+// content type, Decode responds with a 415 Unsupported Media Type problem, and
+// returns ErrUnsupportedMediaType, in which case the handler should not respond.
+//
+// Likewise, if the body exceeds one of the server's limits, Decode responds with
+// a problem, and returns ErrBodyTooLarge, ErrBodyTooDeep or ErrBodyReadTimeout.
+//
+// If the body can't be decoded, nothing is responded with, and a 400 Bad Request
+// *ProblemError wrapping the codec's error is returned, so a HandlerFunc can
+// return it as is, or the handler can respond itself.
 func Decode(w http.ResponseWriter, r *http.Request, v interface{}) error {
-	// FUTURE: Can handle different content types by looking at the request headers.
-	return json.NewDecoder(r.Body).Decode(v)
+	codec, err := requestCodec(w, r)
+	if err != nil {
+		return err
+	}
+	err = codec.Decode(requestBody(r), v)
+	if rerr := rejectBody(w, r, err); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return decodeProblem(err)
+	}
+	return nil
+}
+
+// decodeProblem returns the 400 Bad Request problem describing why a request
+// body could not be decoded.
+func decodeProblem(err error) *ProblemError {
+	detail := "Request body could not be decoded"
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		detail = "Request body is malformed"
+	case errors.Is(err, io.EOF):
+		detail = "Request body must not be empty"
+	}
+	return &ProblemError{Status: http.StatusBadRequest, Detail: detail, Err: err}
+}
+
+// requestCodec returns the codec for the request's content type, or JSON if
+// the request has no content type. If there is no codec for the content type, a
+// 415 Unsupported Media Type problem is responded with, and
+// ErrUnsupportedMediaType is returned.
+func requestCodec(w http.ResponseWriter, r *http.Request) (Codec, error) {
+
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return JSONCodec{}, nil
+	}
+
+	cs := requestCodecs(r)
+
+	codec, ok := cs.lookup(ct)
+	if !ok {
+		Error(w, r, fmt.Sprintf("Content-Type must be one of: %s", cs.supported()), http.StatusUnsupportedMediaType)
+		return nil, ErrUnsupportedMediaType
+	}
+
+	return codec, nil
 }
 
 // Respond should be used to respond to a http request within a http handler.
-// Respond encodes any data passed in as JSON.
+// Respond encodes any data passed in using the codec that best matches the
+// request's Accept header, which is JSON by default. If the response's
+// Content-Type header has already been set, that content type is used instead.
+// If no codec is acceptable, a 406 Not Acceptable problem is responded with.
 // Respond also sets the status code of the response on the request details, so
 // middlewares can access this value.
+//
+// If the endpoint computes ETags, or the handler has set the response's version
+// or modification time, a conditional GET or HEAD request may be responded to
+// with 304 Not Modified instead. See CachingMW.
 func Respond(w http.ResponseWriter, r *http.Request, code int, data interface{}) {
 
-	var jsonData []byte
-	var err error
+	var body bytes.Buffer
 
-	// If we have data to respond with, encode it into JSON, and set the correct
-	// header. If we cannot encode, we'll return an Internal Server Error.
+	// If we have data to respond with, encode it, and set the correct header.
+	// If we cannot encode, we'll return an Internal Server Error.
 	if data != nil {
-		// Set the content-type if not already set
-		if w.Header().Get("Content-Type") == "" {
-			w.Header().Set("Content-Type", "application/json")
+		cs := requestCodecs(r)
+
+		var codec Codec
+		if ct := w.Header().Get("Content-Type"); ct != "" {
+			// The content type has already been chosen, i.e. for problem responses.
+			var ok bool
+			codec, ok = cs.lookup(ct)
+			if !ok {
+				codec = JSONCodec{}
+			}
+		} else {
+			// Choose the content type the request would most like.
+			var ok bool
+			ct, codec, ok = cs.negotiate(r.Header.Get("Accept"))
+			if !ok {
+				Error(w, r, fmt.Sprintf("Accept must allow one of: %s", cs.supported()), http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Content-Type", ct)
 		}
 
-		// Marshal data into byte array
-		jsonData, err = json.Marshal(data)
-		if err != nil {
-			// There was an error Marshalling, so return a server error
+		// Encode data into the body
+		if err := codec.Encode(&body, data); err != nil {
+			// There was an error encoding, so return a server error
 			Error(w, r, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 	}
 
+	// Set caching headers, and respond with 304 Not Modified instead if the
+	// client's copy of the response is still valid.
+	if respondCached(w, r, code, body.Bytes()) {
+		return
+	}
+
 	// Set status code value on request details so other middlewares can access it
 	if d := getDetails(r); d != nil {
 		d.StatusCode = code
@@ -47,11 +135,20 @@ func Respond(w http.ResponseWriter, r *http.Request, code int, data interface{})
 	// Set the status code of the response. This should be the last header to be written.
 	w.WriteHeader(code)
 
-	// Write the JSON body. This must be done last, otherwise we flush the response too quickly.
-	if len(jsonData) > 0 {
+	// Write the body. This must be done last, otherwise we flush the response too quickly.
+	if body.Len() > 0 {
 		//nolint:errcheck
-		w.Write(jsonData)
+		w.Write(body.Bytes())
+	}
+}
+
+// requestCodecs returns the codecs registered with the server serving the
+// request, or the default codecs if there are none.
+func requestCodecs(r *http.Request) *codecs {
+	if d := getDetails(r); d != nil && d.codecs != nil {
+		return d.codecs
 	}
+	return defaultCodecs
 }
 
 // Redirect replies to the request with a redirect to url.
@@ -150,6 +247,11 @@ func Problem(w http.ResponseWriter, r *http.Request, title, detail string, code
 		e(&p)
 	}
 
+	// Redact sensitive data from the problem, if the server is configured to.
+	if d := getDetails(r); d != nil && d.redactor != nil {
+		p.fields = d.redactor.Value(p.fields).(map[string]interface{})
+	}
+
 	// Set the correct content-type header, as defined by RFC 7807.
 	w.Header().Set("Content-Type", "application/problem+json")
 
@@ -158,8 +260,9 @@ func Problem(w http.ResponseWriter, r *http.Request, title, detail string, code
 
 // problem is a wrapper around a map that is used to collect all fields required for a problem response in
 // accordance to RFC 7807. It implements the json Marshaler interface to define a custom json marshalling.
+// This type defines the schema of problem responses in generated OpenAPI documents.
 // swagger:model problem
-type problemSwaggerDefn struct { //nolint:deadcode,unused
+type problemSwaggerDefn struct {
 	// A URI reference [RFC3986] that identifies the problem type.
 	// required: true
 	Type string `json:"type"`
@@ -174,5 +277,5 @@ type problemSwaggerDefn struct { //nolint:deadcode,unused
 	// example: 200
 	Status int `json:"status"`
 	// A URI reference that identifies the specific occurrence of the problem.
-	Instance string `json:"instance"`
+	Instance string `json:"instance,omitempty"`
 }
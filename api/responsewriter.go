@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// responseWriter is a http.ResponseWriter that captures the status code, number
+// of bytes written and time to first byte of a response, and records them on
+// the request details, so middlewares can access these values.
+//
+// It always implements http.Flusher, http.Hijacker, http.Pusher and
+// io.ReaderFrom, delegating to the wrapped ResponseWriter where it supports
+// them, so that streaming responses and websockets keep working.
+type responseWriter struct {
+	http.ResponseWriter
+	d           *details
+	wroteHeader bool
+}
+
+// captureResponseWriter returns a responseWriter wrapping w, that records the
+// response details on the given request's details. If w is already a
+// responseWriter, it is returned as is, so responses are not counted twice.
+func captureResponseWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	if cw, ok := w.(*compressWriter); ok {
+		// A compressWriter wraps a responseWriter, which records the response as
+		// it is sent.
+		return cw
+	}
+
+	d := getDetails(r)
+	if d == nil {
+		// There's nowhere to record the response, so don't wrap.
+		return w
+	}
+
+	// A handler that writes nothing results in an implicit 200 response.
+	if d.StatusCode == 0 {
+		d.StatusCode = http.StatusOK
+	}
+
+	return &responseWriter{ResponseWriter: w, d: d}
+}
+
+// started reports whether the response header has been written.
+func (w *responseWriter) started() bool {
+	return w.wroteHeader
+}
+
+// responseStarted reports whether the response has begun, so can no longer be
+// replaced, i.e. by an error response.
+func responseStarted(w http.ResponseWriter) bool {
+	s, ok := w.(interface{ started() bool })
+	return ok && s.started()
+}
+
+// WriteHeader overrides the underlying ResponseWriter to capture the status code written.
+// Informational responses, i.e. 103 Early Hints, are sent before the final
+// response, so aren't captured.
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && !informational(code) {
+		w.wroteHeader = true
+		w.d.StatusCode = code
+		w.d.TimeToFirstByte = time.Since(w.d.Now)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// informational reports whether code is the status of an informational
+// response, which precedes the final response. 101 Switching Protocols is
+// final, as nothing follows it.
+func informational(code int) bool {
+	return code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols
+}
+
+// Write overrides the underlying ResponseWriter to capture the number of bytes written.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.d.BytesWritten += int64(n)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, using the underlying ResponseWriter's
+// implementation if there is one, i.e. to allow sendfile to be used.
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		// Hide our ReadFrom method from io.Copy, so it isn't called recursively.
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	w.d.BytesWritten += n
+	return n, err
+}
+
+// Flush implements http.Flusher. It does nothing if the underlying
+// ResponseWriter does not support flushing.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker. It returns an error if the underlying
+// ResponseWriter does not support hijacking.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("api: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && !w.wroteHeader {
+		// The connection has been taken over, i.e. by a websocket, so record it as
+		// having switched protocols.
+		w.wroteHeader = true
+		w.d.StatusCode = http.StatusSwitchingProtocols
+		w.d.TimeToFirstByte = time.Since(w.d.Now)
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher. It returns http.ErrNotSupported if the
+// underlying ResponseWriter does not support server push.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
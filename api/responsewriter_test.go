@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// rawAPI is an API whose handlers don't use Respond.
+type rawAPI struct{}
+
+func (a *rawAPI) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method: "GET",
+			Path:   "/teapot",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+				w.Write([]byte("short and stout")) //nolint:errcheck
+			}),
+		},
+		{
+			Method: "GET",
+			Path:   "/content",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "content.txt", time.Time{}, strings.NewReader("some content"))
+			}),
+		},
+		{
+			Method: "GET",
+			Path:   "/implicit",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Write nothing, which results in an implicit 200.
+			}),
+		},
+		{
+			Method: "GET",
+			Path:   "/stream",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, ok := w.(http.Flusher)
+				if !ok {
+					http.Error(w, "not a flusher", http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte("data")) //nolint:errcheck
+				f.Flush()
+			}),
+		},
+		{
+			Method: "GET",
+			Path:   "/hijack",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h, ok := w.(http.Hijacker)
+				if !ok {
+					http.Error(w, "not a hijacker", http.StatusInternalServerError)
+					return
+				}
+				conn, buf, err := h.Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: close\r\n\r\n") //nolint:errcheck
+				buf.Flush()                                                                      //nolint:errcheck
+			}),
+		},
+	}
+}
+
+func TestServerCapturesResponse(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	// Create server
+	srv := NewServer(":0", logger, &rawAPI{}, WithRegisterer(prometheus.NewRegistry()))
+
+	// Create test server from real server
+	s := httptest.NewServer(srv.Handler)
+	defer s.Close()
+
+	// loggedStatus returns the status logged for the most recent request.
+	loggedStatus := func() int64 {
+		all := logs.FilterMessage("request").All()
+		return all[len(all)-1].ContextMap()["status"].(int64)
+	}
+
+	// Status written directly is captured.
+	resp, err := http.Get(s.URL + "/teapot")
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusTeapot) // response status is as expected.
+	is.Equal(loggedStatus(), int64(418))         // status written directly is logged.
+
+	// Status written by http.ServeContent is captured.
+	req, err := http.NewRequest("GET", s.URL+"/content", nil)
+	is.NoErr(err)
+	req.Header.Set("Range", "bytes=0-3")
+	resp, err = http.DefaultClient.Do(req)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusPartialContent) // response status is as expected.
+	is.Equal(loggedStatus(), int64(206))                 // status written by ServeContent is logged.
+
+	// Implicit status is captured.
+	resp, err = http.Get(s.URL + "/implicit")
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(loggedStatus(), int64(200)) // implicit status is logged.
+
+	// Flusher is preserved.
+	resp, err = http.Get(s.URL + "/stream")
+	is.NoErr(err)
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK) // writer implements http.Flusher.
+	is.Equal(string(buf), "data")            // streamed body is as expected.
+
+	// Hijacker is preserved.
+	resp, err = http.Get(s.URL + "/hijack")
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusSwitchingProtocols) // writer implements http.Hijacker.
+	is.Equal(loggedStatus(), int64(101))                     // hijacked status is logged.
+}
+
+func TestResponseWriterCapturesDetails(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create a dummy request.
+	r, err := newTestRequest("GET", "/teapot", nil, "/:path")
+	is.NoErr(err)
+
+	// Create a response recorder, which satisfies http.ResponseWriter, to record the response.
+	rr := httptest.NewRecorder()
+
+	// Wrap the recorder.
+	w := captureResponseWriter(rr, r)
+	is.Equal(captureResponseWriter(w, r), w) // wrapping twice returns the same writer.
+
+	// Write the response, using io.ReaderFrom.
+	n, err := w.(*responseWriter).ReadFrom(bytes.NewBufferString("short and stout"))
+	is.NoErr(err)
+	is.Equal(n, int64(15)) // all bytes are copied.
+
+	w.Write([]byte("!")) //nolint:errcheck
+
+	d := getDetails(r)
+	is.Equal(d.StatusCode, http.StatusOK)          // implicit status is captured.
+	is.Equal(d.BytesWritten, int64(16))            // bytes written are captured.
+	is.True(d.TimeToFirstByte > 0)                 // time to first byte is captured.
+	is.Equal(rr.Body.String(), "short and stout!") // body is written to the underlying writer.
+
+	// Push isn't supported by the recorder.
+	is.Equal(w.(http.Pusher).Push("/style.css", nil), http.ErrNotSupported) // push reports not supported.
+
+	// Hijack isn't supported by the recorder.
+	_, _, err = w.(http.Hijacker).Hijack()
+	is.True(err != nil) // hijack reports an error.
+}
+
+func TestServerCapturesResponseAfterInformational(t *testing.T) {
+
+	// hints writes an informational response, before the final response.
+	hints := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.Repeat("short and stout ", 100))) //nolint:errcheck
+	})
+
+	tests := []struct {
+		Name string
+		Opts []Option
+	}{
+		{"uncompressed", nil},
+		{"compressed", []Option{WithCompression()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger, and captured logs.
+			logger, logs := newTestLogger(zap.InfoLevel)
+
+			srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+				return []Endpoint{
+					{Method: "POST", Path: "/hints", Handler: hints},
+					{Method: "POST", Path: "/idempotent", Handler: hints, Idempotency: &Idempotency{}},
+				}
+			}), append(tt.Opts, WithRegisterer(prometheus.NewRegistry()))...)
+
+			// Create test server from real server
+			s := httptest.NewServer(srv.Handler)
+			defer s.Close()
+
+			for _, path := range []string{"/hints", "/idempotent", "/idempotent"} {
+				req, err := http.NewRequest("POST", s.URL+path, nil)
+				is.NoErr(err)
+				req.Header.Set("Idempotency-Key", "key-1")
+				resp, err := http.DefaultClient.Do(req)
+				is.NoErr(err)
+				body, err := ioutil.ReadAll(resp.Body)
+				is.NoErr(err)
+				resp.Body.Close()
+				is.Equal(resp.StatusCode, http.StatusCreated)                   // final status is responded with.
+				is.Equal(string(body), strings.Repeat("short and stout ", 100)) // body is responded with.
+
+				all := logs.FilterMessage("request").All()
+				is.Equal(all[len(all)-1].ContextMap()["status"], int64(201)) // final status is logged.
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Route is a route registered with a server's router, for one of its API's
+// endpoints.
+type Route struct {
+	// Method is the HTTP method of the route.
+	Method string `json:"method"`
+	// Path is the path template of the route, i.e. '/items/:id'.
+	Path string `json:"path"`
+	// Version is the version of the endpoint, if versioned.
+	Version string `json:"version,omitempty"`
+	// Middlewares are the names of the middlewares requests to the route pass
+	// through, in the order they are executed.
+	Middlewares []string `json:"middlewares"`
+	// SuppressLogs, SuppressMetrics and SuppressTracing are the endpoint's flags.
+	SuppressLogs    bool `json:"suppress_logs"`
+	SuppressMetrics bool `json:"suppress_metrics"`
+	SuppressTracing bool `json:"suppress_tracing"`
+	// Implicit is whether the route was added by the server, rather than being
+	// an endpoint's method, i.e. 'OPTIONS' for endpoints with CORS.
+	Implicit bool `json:"implicit"`
+}
+
+// Routes returns the route table of the given handler, which must be the
+// handler of a server returned by NewServer. Routes are sorted by path, method
+// and then version. If the handler isn't a server's, nil is returned.
+func Routes(h http.Handler) []Route {
+	s, ok := h.(*server)
+	if !ok {
+		return nil
+	}
+	return s.routeTable()
+}
+
+// Routes returns the server's route table, sorted by path, method and then
+// version.
+func (s *Server) Routes() []Route {
+	return s.s.routeTable()
+}
+
+// routeTable returns a sorted copy of the server's routes.
+func (s *server) routeTable() []Route {
+	routes := make([]Route, len(s.routes))
+	copy(routes, s.routes)
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		if routes[i].Method != routes[j].Method {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Version < routes[j].Version
+	})
+	return routes
+}
+
+// FormatRoutes writes the given routes to w as an aligned table, with one line
+// per route, i.e. to compare the routes of different releases.
+func FormatRoutes(w io.Writer, routes []Route) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tPATH\tVERSION\tMIDDLEWARES\tSUPPRESSED\tIMPLICIT")
+	for _, r := range routes {
+		var suppressed []string
+		if r.SuppressLogs {
+			suppressed = append(suppressed, "logs")
+		}
+		if r.SuppressMetrics {
+			suppressed = append(suppressed, "metrics")
+		}
+		if r.SuppressTracing {
+			suppressed = append(suppressed, "tracing")
+		}
+		var version []string
+		if r.Version != "" {
+			version = append(version, r.Version)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\n", r.Method, r.Path, orDash(version), orDash(r.Middlewares), orDash(suppressed), r.Implicit)
+	}
+	return tw.Flush()
+}
+
+// orDash joins the given values, or returns '-' if there are none.
+func orDash(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ",")
+}
+
+// closureSuffix matches the suffixes of the names of closures and method values.
+var closureSuffix = regexp.MustCompile(`(\.func\d+|\.\d+|-fm)+$`)
+
+// middlewareName returns the name of the function that created the given
+// middleware, i.e. 'api.AuthMW'.
+func middlewareName(mw Middleware) string {
+	if mw == nil {
+		return "nil"
+	}
+	f := runtime.FuncForPC(reflect.ValueOf(mw).Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return closureSuffix.ReplaceAllString(name, "")
+}
+
+// routesHandler returns a handler responding with the server's route table,
+// as a table of text if the 'format' query parameter is 'text'.
+func (s *server) routesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes := s.routeTable()
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			FormatRoutes(w, routes) //nolint:errcheck
+			return
+		}
+		Respond(w, r, http.StatusOK, routes)
+	})
+}
+
+// WithRoutesEndpoint serves the server's route table at the given path, i.e.
+// for debugging. The table is encoded as JSON, or as text if the request's
+// 'format' query parameter is 'text'.
+func WithRoutesEndpoint(path string) Option {
+	return func(s *server) {
+		s.routesPath = path
+	}
+}
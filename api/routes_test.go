@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestRoutes(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, r, http.StatusOK, nil)
+	})
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method:         "POST",
+				Path:           "/items",
+				Handler:        h,
+				CorsMiddleware: DefaultCorsMW(),
+				Middlewares:    []Middleware{AuthMW(APIKeyAuthenticator("X-API-Key", StaticAPIKeys(nil)))},
+			},
+			{Method: "GET", Path: "/items", Handler: h, SuppressLogs: true},
+			{Method: "GET", Path: "/health", Handler: h, SuppressLogs: true, SuppressMetrics: true},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()), WithRoutesEndpoint("/debug/routes"))
+
+	routes := Routes(srv.Handler)
+	is.Equal(len(routes), 5) // endpoints and the routes endpoint are listed.
+
+	is.Equal(routes[0].Path, "/debug/routes")            // routes endpoint is listed.
+	is.Equal(routes[0].Middlewares, []string{"recover"}) // routes endpoint is suppressed.
+
+	health := Route{Method: "GET", Path: "/health", Middlewares: []string{"recover"}, SuppressLogs: true, SuppressMetrics: true}
+	is.Equal(routes[1], health) // suppression is listed.
+
+	is.Equal(routes[2].Method, "GET")     // routes are sorted by method.
+	is.Equal(routes[3].Method, "OPTIONS") // routes are sorted by method.
+	is.True(routes[3].Implicit)           // cors route is implicit.
+	is.Equal(routes[4].Method, "POST")    // routes are sorted by method.
+	is.True(!routes[4].Implicit)          // endpoint route isn't implicit.
+
+	mws := []string{"metrics", "logs", "recover", "cors", "api.AuthMW"}
+	is.Equal(routes[4].Middlewares, mws) // middlewares are listed in order.
+
+	is.Equal(Routes(http.NotFoundHandler()), nil) // other handlers have no routes.
+
+	var buf bytes.Buffer
+	is.NoErr(FormatRoutes(&buf, routes[1:2]))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	is.Equal(len(lines), 2)                                                                                      // header and route are written.
+	is.Equal(strings.Join(strings.Fields(lines[0]), " "), "METHOD PATH VERSION MIDDLEWARES SUPPRESSED IMPLICIT") // header is written.
+	is.Equal(strings.Join(strings.Fields(lines[1]), " "), "GET /health - recover logs,metrics false")            // route is written.
+
+	// The routes endpoint responds with the route table.
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/routes", nil))
+	is.Equal(rr.Code, http.StatusOK) // response code is 200.
+	var listed []Route
+	is.NoErr(json.Unmarshal(rr.Body.Bytes(), &listed))
+	is.Equal(listed, routes) // route table is responded with.
+
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/routes?format=text", nil))
+	is.Equal(rr.Header().Get("Content-Type"), "text/plain; charset=utf-8") // text is responded with.
+	is.True(strings.HasPrefix(rr.Body.String(), "METHOD"))                 // route table is formatted.
+}
@@ -1,7 +1,12 @@
 package api
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dimfeld/httptreemux/v5"
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,80 +14,371 @@ import (
 )
 
 type server struct {
-	router *httptreemux.TreeMux
-	logger *zap.SugaredLogger
-	mw     []Middleware
+	// inflight is the number of requests currently being handled. It is
+	// accessed atomically, so is kept first in the struct for alignment.
+	inflight int32
+	// shuttingDown is set to 1 once the server has begun to shutdown. It is
+	// accessed atomically.
+	shuttingDown int32
+	// httpServers are the http.Servers that have served requests, and will
+	// mark the server as shutting down when they do.
+	httpServers sync.Map
+
+	router       *httptreemux.TreeMux
+	logger       *zap.SugaredLogger
+	mw           []Middleware
+	panicHandler PanicHandler
+
+	accessLogOpts []AccessLogOption
+	logSampling   *LogSampling
+	redactor      *Redactor
+
+	codecs        *codecs
+	requestIDs    requestIDConfig
+	errorStatuses []errorStatus
+
+	maxBodyBytes int64
+	maxJSONDepth int
+	readTimeout  time.Duration
+	rejected     *prometheus.CounterVec
+
+	spanExporter SpanExporter
+
+	compressmw Middleware
+
+	rateLimit      *RateLimit
+	rateLimitStore RateLimitStore
+
+	idempotencyStore IdempotencyStore
+
+	grantsLookup GrantsLookup
+	policy       Policy
+
+	registerer  prometheus.Registerer
+	metricsOpts []MetricsOption
+
+	routes     []Route
+	routesPath string
+
+	versioning Versioning
+
+	openAPIPath string
+	openAPIInfo OpenAPIInfo
+
+	healthEnabled  bool
+	healthChecks   []HealthCheck
+	livenessPath   string
+	readinessPath  string
+	healthCacheTTL time.Duration
+
+	shutdownTimeout time.Duration
+	shutdownHooks   []ShutdownHook
+	signals         <-chan os.Signal
 }
 
-// NewServer returns a HTTP server for accessing the the given API.
+// NewServer returns a HTTP server for accessing the the given API. It panics
+// if the API's endpoints are invalid, see ValidateEndpoints. Use
+// NewValidatedServer to handle invalid endpoints instead.
 func NewServer(addr string, logger *zap.SugaredLogger, a API, opts ...Option) http.Server {
 
+	s, err := newServer(logger, a, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	// Convert our server into a http.Server
+	return http.Server{
+		Addr:        addr,
+		Handler:     s,
+		ReadTimeout: s.readTimeout,
+	}
+}
+
+// newServer creates the server's handler, with all of the given API's
+// endpoints registered, unless they are invalid.
+func newServer(logger *zap.SugaredLogger, a API, opts ...Option) (*server, error) {
+
 	// Create our server
 	s := server{
-		router: httptreemux.New(),
-		logger: logger,
-		mw:     make([]Middleware, 0),
+		router:          httptreemux.New(),
+		logger:          logger,
+		mw:              make([]Middleware, 0),
+		codecs:          newCodecs(),
+		requestIDs:      defaultRequestIDConfig,
+		registerer:      prometheus.DefaultRegisterer,
+		livenessPath:    defaultLivenessPath,
+		readinessPath:   defaultReadinessPath,
+		healthCacheTTL:  defaultHealthCacheTTL,
+		shutdownTimeout: defaultShutdownTimeout,
 	}
 
 	for _, opt := range opts {
 		opt(&s)
 	}
 
+	// Redact everything the server logs, if configured.
+	if s.redactor != nil {
+		logger = RedactLogger(logger, s.redactor)
+		s.logger = logger
+	}
+
+	endpoints := make([]Endpoint, 0)
+	for _, e := range a.Endpoints() {
+		if s.versioning.Strategy == PathVersioning {
+			// Serve each version of the endpoint under its own path.
+			e.Path = s.versioning.versionPath(e.Version, e.Path)
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	// Serve an OpenAPI document describing the API's endpoints, if configured.
+	if s.openAPIPath != "" {
+		h, err := openAPIHandler(s.openAPIInfo, endpoints)
+		if err != nil {
+			// The generated document only contains values that can be encoded, so
+			// this should never happen.
+			panic(err)
+		}
+		endpoints = append(endpoints, Endpoint{
+			Method:          "GET",
+			Path:            s.openAPIPath,
+			Handler:         h,
+			SuppressLogs:    true,
+			SuppressMetrics: true,
+			SuppressTracing: true,
+		})
+	}
+
+	// Serve liveness and readiness endpoints, if configured.
+	if s.healthEnabled {
+		hc := newHealthChecker(s.healthChecks, s.healthCacheTTL, s.ready, s.registerer, newMetricsConfig(s.metricsOpts))
+		endpoints = append(endpoints,
+			Endpoint{
+				Method:          "GET",
+				Path:            s.livenessPath,
+				Handler:         hc.handleLiveness(),
+				SuppressLogs:    true,
+				SuppressMetrics: true,
+				SuppressTracing: true,
+			},
+			Endpoint{
+				Method:          "GET",
+				Path:            s.readinessPath,
+				Handler:         hc.handleReadiness(),
+				SuppressLogs:    true,
+				SuppressMetrics: true,
+				SuppressTracing: true,
+			},
+		)
+	}
+
+	// Serve the route table, if configured.
+	if s.routesPath != "" {
+		endpoints = append(endpoints, Endpoint{
+			Method:          "GET",
+			Path:            s.routesPath,
+			Handler:         s.routesHandler(),
+			SuppressLogs:    true,
+			SuppressMetrics: true,
+			SuppressTracing: true,
+		})
+	}
+
+	// Check all of the endpoints can be registered, including the server's own,
+	// before registering any of them.
+	if err := ValidateEndpoints(endpoints); err != nil {
+		return nil, err
+	}
+
 	// Gather endpoints to register with metrics middleware.
 	// Some endpoints may not wish to be instrumented.
 	metricEndpoints := make([]Endpoint, 0)
-	for _, e := range a.Endpoints() {
+	for _, e := range endpoints {
 		if !e.SuppressMetrics {
 			metricEndpoints = append(metricEndpoints, e)
 		}
 	}
 
 	// Create metrics middleware.
-	metricsmw := MetricsMW(prometheus.DefaultRegisterer, metricEndpoints)
+	metricsmw := MetricsMW(s.registerer, metricEndpoints, s.metricsOpts...)
 
 	// Create logging middleware.
-	logmw := LogMW(logger)
+	logmw := AccessLogMW(logger, s.accessLogOpts...)
+
+	// Create panic recovery middleware.
+	recovermw := recoverMW(logger, s.registerer, s.metricsOpts, s.panicHandler)
+
+	// Create tracing middleware, if configured.
+	var tracemw Middleware
+	if s.spanExporter != nil {
+		tracemw = TracingMW(logger, s.spanExporter)
+	}
+
+	// Create the store of rate limits, unless one has been given.
+	if s.rateLimitStore == nil {
+		s.rateLimitStore = NewMemoryRateLimitStore()
+	}
+
+	// Create the store of idempotent responses, unless one has been given.
+	if s.idempotencyStore == nil {
+		s.idempotencyStore = NewMemoryIdempotencyStore()
+	}
+
+	// Create the counter of requests rejected due to their body.
+	s.rejected = newRejectionCounter(s.registerer, newMetricsConfig(s.metricsOpts))
+
+	// The routes with versions chosen by the request, rather than the path.
+	versioned := make(map[string]*versionedRoute)
+	versionedKeys := make([]string, 0)
 
 	// Add all endpoints to the server's router.
-	for _, e := range a.Endpoints() {
+	for _, e := range endpoints {
 
 		methods := []string{e.Method}
 
-		// Gather list of middleware to wrap this endpoint in.
+		// Gather list of middleware to wrap this endpoint in, and their names for
+		// the route table.
 		mws := make([]Middleware, 0)
+		names := make([]string, 0)
+		for _, mw := range s.mw {
+			names = append(names, middlewareName(mw))
+		}
+		use := func(name string, mw Middleware) {
+			mws = append(mws, mw)
+			names = append(names, name)
+		}
+
+		if tracemw != nil && !e.SuppressTracing {
+			// Add tracing middleware first, so the span covers the whole request.
+			use("tracing", tracemw)
+		}
 		if !e.SuppressMetrics {
 			// Add metrics middleware if metrics should not be suppressed.
-			mws = append(mws, metricsmw)
+			use("metrics", metricsmw)
 		}
 		if !e.SuppressLogs {
-			// Add logging middleware if logs should not be suppressed.
-			mws = append(mws, logmw)
+			// Add logging middleware if logs should not be suppressed, sampling
+			// the requests logged by the endpoint's policy, or the server's.
+			if ls := e.LogSampling; ls != nil || s.logSampling != nil {
+				if ls == nil {
+					ls = s.logSampling
+				}
+				opts := append(append([]AccessLogOption{}, s.accessLogOpts...), AccessLogSampling(s.registerer, *ls, s.metricsOpts...))
+				use("logs", AccessLogMW(logger, opts...))
+			} else {
+				use("logs", logmw)
+			}
+		}
+		// Add panic recovery middleware, so the above see the response to a panic.
+		use("recover", recovermw)
+		// Keep the middleware observing requests, to also observe requests for
+		// versions of the endpoint that don't exist.
+		observers := append([]Middleware{}, mws...)
+		if s.compressmw != nil {
+			// Add compression middleware.
+			use("compress", s.compressmw)
+		}
+		if e.Deprecation != nil {
+			// Add deprecation middleware.
+			use("deprecation", DeprecationMW(*e.Deprecation))
 		}
 		if e.CorsMiddleware != nil {
 			// Add cors middleware.
-			mws = append(mws, Middleware(*e.CorsMiddleware))
+			use("cors", Middleware(*e.CorsMiddleware))
 			// Add OPTIONS method to be registered.
 			methods = append(methods, "OPTIONS")
 		}
+		if e.ETag != NoETag || e.CacheControl != nil {
+			// Add caching middleware.
+			use("caching", CachingMW(e.ETag, e.CacheControl))
+		}
 
 		// Add all of the endpoint specific middleware.
-		mws = append(mws, e.Middlewares...)
+		for _, mw := range e.Middlewares {
+			use(middlewareName(mw), mw)
+		}
+
+		if rl := e.RateLimit; rl != nil || s.rateLimit != nil {
+			// Add rate limiting middleware after the endpoint's middleware, so
+			// requests can be limited by the caller they authenticate. Use the
+			// server's limit unless the endpoint has its own.
+			if rl == nil {
+				rl = s.rateLimit
+			}
+			use("ratelimit", RateLimitMW(s.registerer, s.rateLimitStore, *rl, s.metricsOpts...))
+		}
+
+		if e.Requires != nil && !e.Requires.IsZero() {
+			// Add authorization middleware last, so the caller has been authenticated.
+			use("authorize", AuthorizeMW(*e.Requires, s.grantsLookup, s.policy))
+		}
+		if e.Idempotency != nil {
+			// Add idempotency middleware after authorization, so keys are only
+			// claimed by requests that are allowed.
+			use("idempotency", IdempotencyMW(s.registerer, s.idempotencyStore, *e.Idempotency, s.metricsOpts...))
+		}
+
+		// Use the server's maximum body size, unless the endpoint has its own.
+		maxBodyBytes := s.maxBodyBytes
+		if e.MaxBodyBytes != 0 {
+			maxBodyBytes = e.MaxBodyBytes
+		}
+
+		for i, method := range methods {
+			h := s.handler(e.Path, e.Version, e.Handler, maxBodyBytes, mws...)
+
+			if s.versioning.Strategy == PathVersioning {
+				// Register endpoint with the server.
+				s.router.Handle(method, e.Path, h)
+			} else {
+				// Gather the versions of the endpoint, to be registered together.
+				key := method + " " + e.Path
+				route, ok := versioned[key]
+				if !ok {
+					route = &versionedRoute{
+						method:      method,
+						path:        e.Path,
+						handlers:    make(map[string]httptreemux.HandlerFunc),
+						unsupported: s.handler(e.Path, "", s.versioning.unsupported(method, e.Path), 0, observers...),
+					}
+					versioned[key] = route
+					versionedKeys = append(versionedKeys, key)
+				}
+				route.handlers[e.Version] = h
+			}
 
-		for _, method := range methods {
-			// Register endpoint with the server.
-			s.handle(method, e.Path, e.Handler, mws...)
+			// Record the route, so it can be listed.
+			s.routes = append(s.routes, Route{
+				Method:          method,
+				Path:            e.Path,
+				Version:         e.Version,
+				Middlewares:     names,
+				SuppressLogs:    e.SuppressLogs,
+				SuppressMetrics: e.SuppressMetrics,
+				SuppressTracing: e.SuppressTracing,
+				Implicit:        i > 0,
+			})
 		}
 	}
 
-	// Convert our server into a http.Server
-	return http.Server{
-		Addr:    addr,
-		Handler: &s,
+	// Register each versioned route with the server, routing requests to the
+	// version they choose, unless there is only an unversioned endpoint.
+	for _, key := range versionedKeys {
+		route := versioned[key]
+		if h, ok := route.handlers[""]; ok && len(route.handlers) == 1 {
+			s.router.Handle(route.method, route.path, h)
+			continue
+		}
+		s.router.Handle(route.method, route.path, s.versioning.dispatch(route))
 	}
+
+	return &s, nil
 }
 
-// handle registers handlers with the given middleware to the server's router
-func (s *server) handle(method, path string, handler http.Handler, mw ...Middleware) {
+// handler returns the function the server's router calls for requests to the
+// given version of an endpoint, which calls the handler wrapped in the given
+// middleware. Request bodies are limited to maxBodyBytes, if positive.
+func (s *server) handler(path, version string, handler http.Handler, maxBodyBytes int64, mw ...Middleware) httptreemux.HandlerFunc {
 
 	// First wrap the handler with its specific middleware
 	handler = wrapMiddleware(mw, handler)
@@ -93,29 +389,73 @@ func (s *server) handle(method, path string, handler http.Handler, mw ...Middlew
 	// Create the function to execute for each request
 	h := func(w http.ResponseWriter, r *http.Request, params map[string]string) {
 
+		// Track the request as in flight, so shutdown can wait for it to complete
+		atomic.AddInt32(&s.inflight, 1)
+		defer atomic.AddInt32(&s.inflight, -1)
+
 		// Update request context with the required details to process the request
-		r = SetDetails(r, path, params)
+		r = setDetails(r, path, params, s.requestIDs)
+
+		// Make the server's codecs, limits and error statuses available to Decode,
+		// Respond and RespondError
+		d := getDetails(r)
+		d.codecs = s.codecs
+		d.maxJSONDepth = s.maxJSONDepth
+		d.maxBodyBytes = maxBodyBytes
+		d.rejected = s.rejected
+		d.logger = s.logger
+		d.redactor = s.redactor
+		d.errorStatuses = s.errorStatuses
+		d.apiVersion = version
+
+		// Echo the request ID, so clients can correlate their requests with our logs
+		w.Header().Set(s.requestIDs.header, d.RequestID)
+
+		// Limit the size of the request body
+		if maxBodyBytes > 0 {
+			r.Body = newLimitedBody(r.Body, r.ContentLength, maxBodyBytes)
+		}
+
+		// Capture response details, regardless of how the handler writes its response
+		w = captureResponseWriter(w, r)
 
 		// Call the wrapped handler
 		handler.ServeHTTP(w, r)
 	}
 
-	// Register the handler to the router
-	s.router.Handle(method, path, h)
+	return h
 }
 
 // ServeHTTP implements http.Handler
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Readiness should fail as soon as the http.Server serving the request
+	// begins to shutdown. NewServer returns the http.Server by value, so the
+	// server serving requests is only known once it serves one.
+	if hs, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+		if _, loaded := s.httpServers.LoadOrStore(hs, true); !loaded {
+			hs.RegisterOnShutdown(s.beginShutdown)
+		}
+	}
+
+	// Identify the request before it is routed, so that responses the router
+	// makes itself, i.e. 404 Not Found, also echo the request ID
+	id := s.requestIDs.requestID(r)
+	w.Header().Set(s.requestIDs.header, id)
+	r = r.WithContext(context.WithValue(r.Context(), keyRequestID, id))
+
 	s.router.ServeHTTP(w, r)
 }
 
 // Option is a function that can be passed to NewServer to modify the server.
 type Option func(*server)
 
-// WithPanicHandler sets the server's panic handler.
+// WithPanicHandler sets the server's panic handler, which responds to requests
+// whose handler panicked. The panic is still logged and counted, see RecoverMW.
+// By default, a 500 Internal Server Error problem is responded with.
 func WithPanicHandler(ph func(w http.ResponseWriter, r *http.Request, err interface{})) Option {
 	return func(s *server) {
 		s.router.PanicHandler = ph
+		s.panicHandler = ph
 	}
 }
 
@@ -132,3 +472,37 @@ func WithDefaultMiddleware(mw []Middleware) Option {
 		s.mw = append(s.mw, mw...)
 	}
 }
+
+// WithRegisterer sets the Prometheus registerer the server's metrics are
+// registered with. By default, prometheus.DefaultRegisterer is used.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(s *server) {
+		s.registerer = reg
+	}
+}
+
+// WithMetricsNamespace sets the namespace, i.e. prefix, of the server's metric names.
+func WithMetricsNamespace(ns string) Option {
+	return func(s *server) {
+		s.metricsOpts = append(s.metricsOpts, MetricsNamespace(ns))
+	}
+}
+
+// WithMetricsConstLabels adds labels, with fixed values, to the server's
+// metrics, i.e. server="admin". This allows more than one server to expose
+// distinct metrics from the same registerer.
+func WithMetricsConstLabels(labels prometheus.Labels) Option {
+	return func(s *server) {
+		s.metricsOpts = append(s.metricsOpts, MetricsConstLabels(labels))
+	}
+}
+
+// WithOpenAPI serves an OpenAPI document, describing all of the API's
+// endpoints, at the given path. The document is encoded as JSON, or YAML if the
+// request accepts it.
+func WithOpenAPI(path string, info OpenAPIInfo) Option {
+	return func(s *server) {
+		s.openAPIPath = path
+		s.openAPIInfo = info
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
@@ -191,3 +192,95 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+// sampleCount returns the number of observations of the request duration
+// histogram, with the given name, for successful 'GET /' requests with the
+// given server label.
+func sampleCount(t *testing.T, reg prometheus.Gatherer, name, server string) (uint64, bool) {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["method"] == "GET" && labels["path"] == "/" && labels["status"] == "2XX" && labels["server"] == server {
+				return m.GetHistogram().GetSampleCount(), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func TestServersWithConstLabels(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// Create prometheus registry, shared by both servers.
+	reg := prometheus.NewRegistry()
+
+	// Create two servers for the same api, that would otherwise clash.
+	a := &testAPI{logger}
+	public := NewServer(":0", logger, a, WithRegisterer(reg), WithMetricsConstLabels(prometheus.Labels{"server": "public"}))
+	admin := NewServer(":0", logger, a, WithRegisterer(reg), WithMetricsConstLabels(prometheus.Labels{"server": "admin"}))
+
+	// Make a request to the public server only.
+	r, err := http.NewRequest("GET", "/", nil)
+	is.NoErr(err)
+	public.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	count, ok := sampleCount(t, reg, "http_request_duration_seconds", "public")
+	is.True(ok)                // public server exposes its series.
+	is.Equal(count, uint64(1)) // public server observed the request.
+
+	count, ok = sampleCount(t, reg, "http_request_duration_seconds", "admin")
+	is.True(ok)                // admin server exposes its own series.
+	is.Equal(count, uint64(0)) // admin server did not observe the request.
+
+	// Make a request to the admin server.
+	admin.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	count, _ = sampleCount(t, reg, "http_request_duration_seconds", "admin")
+	is.Equal(count, uint64(1)) // admin server observed the request.
+	count, _ = sampleCount(t, reg, "http_request_duration_seconds", "public")
+	is.Equal(count, uint64(1)) // public server is unchanged.
+}
+
+func TestServersShareHistogram(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger.
+	logger, _ := newTestLogger(zap.InfoLevel)
+
+	// Create prometheus registry, shared by both servers.
+	reg := prometheus.NewRegistry()
+
+	// Create two identically configured servers, which share a histogram.
+	a := &testAPI{logger}
+	s1 := NewServer(":0", logger, a, WithRegisterer(reg), WithMetricsNamespace("kit"))
+	s2 := NewServer(":0", logger, a, WithRegisterer(reg), WithMetricsNamespace("kit"))
+
+	// Make a request to each server.
+	r, err := http.NewRequest("GET", "/", nil)
+	is.NoErr(err)
+	s1.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	s2.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	count, ok := sampleCount(t, reg, "kit_http_request_duration_seconds", "")
+	is.True(ok)                // namespaced series is exposed.
+	is.Equal(count, uint64(2)) // both requests observed by the shared histogram.
+}
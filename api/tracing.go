@@ -0,0 +1,411 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TraceID identifies a trace, as defined by W3C Trace Context.
+type TraceID [16]byte
+
+// IsValid reports whether the trace ID is valid, i.e. not all zeroes.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// String returns the trace ID as lowercase hex.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace, as defined by W3C Trace Context.
+type SpanID [8]byte
+
+// IsValid reports whether the span ID is valid, i.e. not all zeroes.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// String returns the span ID as lowercase hex.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that is propagated between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled reports whether the trace is being recorded, and so whether the
+	// span is exported.
+	Sampled bool
+	// TraceState is vendor specific trace information, from the 'tracestate' header.
+	TraceState string
+	// Remote reports whether the span context was propagated from another service.
+	Remote bool
+}
+
+// IsValid reports whether both the trace and span IDs are valid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the span context encoded as a W3C 'traceparent' header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// parseTraceparent parses a W3C 'traceparent' header value. It returns false if
+// the value is invalid, in which case a new trace should be started.
+func parseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+
+	// Later versions may append fields, but must keep these ones.
+	v = strings.TrimSpace(v)
+	if len(v) < 55 || (len(v) > 55 && v[55] != '-') {
+		return sc, false
+	}
+	if v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, false
+	}
+
+	version, ok := decodeHex(v[0:2], 1)
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(v) != 55) {
+		return sc, false
+	}
+	traceID, ok := decodeHex(v[3:35], 16)
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeHex(v[36:52], 8)
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeHex(v[53:55], 1)
+	if !ok {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&0x01 == 0x01
+	sc.Remote = true
+
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes the lowercase hex string s, which must be n bytes long.
+func decodeHex(s string, n int) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != n {
+		return nil, false
+	}
+	return b, true
+}
+
+// StatusCode is the status of a span, as defined by OpenTelemetry.
+type StatusCode int
+
+// Span statuses.
+const (
+	// StatusUnset is the default status of a span.
+	StatusUnset StatusCode = iota
+	// StatusError means the operation the span represents failed.
+	StatusError
+	// StatusOK means the operation has explicitly been marked as successful.
+	StatusOK
+)
+
+// String returns the name of the status.
+func (c StatusCode) String() string {
+	switch c {
+	case StatusError:
+		return "Error"
+	case StatusOK:
+		return "Ok"
+	}
+	return "Unset"
+}
+
+// SpanEvent is something that happened during a span, such as an error.
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+// SpanData is a snapshot of a span, as passed to a SpanExporter once the span ends.
+type SpanData struct {
+	// Name is the name of the span, i.e. 'GET /teapots/:id'.
+	Name        string
+	SpanContext SpanContext
+	// Parent is the span context of the span's parent, which is invalid if the
+	// span is the root of a trace.
+	Parent        SpanContext
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    map[string]interface{}
+	Events        []SpanEvent
+	Status        StatusCode
+	StatusMessage string
+}
+
+// SpanExporter exports ended spans, i.e. to a tracing backend. Spans are
+// exported as each request completes, so implementations should buffer spans
+// rather than block.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+}
+
+// Span is the server span of a request being traced. Handlers can retrieve it
+// with SpanFromRequest, to add attributes or record errors. All of its methods
+// are safe to call on a nil Span, which is returned for untraced requests.
+type Span struct {
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the span's context, i.e. to propagate it to other services.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes[key] = value
+}
+
+// RecordError records err as an 'exception' event of the span. It does not
+// change the span's status.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Events = append(s.data.Events, SpanEvent{
+		Name: "exception",
+		Time: time.Now(),
+		Attributes: map[string]interface{}{
+			"exception.type":    fmt.Sprintf("%T", err),
+			"exception.message": err.Error(),
+		},
+	})
+}
+
+// SetStatus sets the status of the span. The description is only kept for
+// the error status.
+func (s *Span) SetStatus(code StatusCode, description string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status = code
+	s.data.StatusMessage = ""
+	if code == StatusError {
+		s.data.StatusMessage = description
+	}
+}
+
+// end ends the span, returning a snapshot of it. It returns false if the span
+// has already ended.
+func (s *Span) end() (SpanData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return SpanData{}, false
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+
+	data := s.data
+	data.Attributes = make(map[string]interface{}, len(s.data.Attributes))
+	for k, v := range s.data.Attributes {
+		data.Attributes[k] = v
+	}
+	data.Events = append([]SpanEvent(nil), s.data.Events...)
+	return data, true
+}
+
+// SpanFromRequest returns the span of the given request, or nil if the request
+// isn't being traced.
+func SpanFromRequest(r *http.Request) *Span {
+	d := getDetails(r)
+	if d == nil {
+		return nil
+	}
+	return d.span
+}
+
+// TracingMW returns a middleware that traces requests, exporting a server span
+// for each one to the given exporter. The trace is continued from the request's
+// W3C 'traceparent' and 'tracestate' headers, if present. Spans are named after
+// the method and route template of the request, i.e. 'GET /teapots/:id', and a
+// response with a 5XX status marks the span as an error.
+func TracingMW(logger *zap.SugaredLogger, exporter SpanExporter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Retrieve detail state of this request
+			d := getDetails(r)
+			if d == nil {
+				// There's nowhere to keep the span if we can't find the details.
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			span := startSpan(r, d)
+			d.span = span
+
+			defer func() {
+				status := d.StatusCode
+				span.SetAttribute("http.status_code", status)
+				if status >= 500 {
+					span.SetStatus(StatusError, http.StatusText(status))
+				}
+
+				data, ok := span.end()
+				if !ok || !data.SpanContext.Sampled {
+					return
+				}
+				if err := exporter.ExportSpans(r.Context(), []SpanData{data}); err != nil {
+					logger.Warnw("failed to export span",
+						"request_id", d.RequestID,
+						"trace_id", data.SpanContext.TraceID.String(),
+						"err", err,
+					)
+				}
+			}()
+
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// startSpan starts the server span of the given request, continuing the
+// request's trace if it has one.
+func startSpan(r *http.Request, d *details) *Span {
+
+	parent, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if ok {
+		parent.TraceState = strings.TrimSpace(r.Header.Get("tracestate"))
+	}
+
+	sc := SpanContext{
+		TraceID:    parent.TraceID,
+		Sampled:    parent.Sampled,
+		TraceState: parent.TraceState,
+	}
+	if !ok {
+		// Start a new trace, which is always sampled.
+		sc.TraceID = newTraceID()
+		sc.Sampled = true
+	}
+	sc.SpanID = newSpanID()
+
+	return &Span{
+		data: SpanData{
+			Name:        d.Method + " " + d.RequestPath,
+			SpanContext: sc,
+			Parent:      parent,
+			StartTime:   d.Now,
+			Attributes: map[string]interface{}{
+				"http.method": d.Method,
+				"http.route":  d.RequestPath,
+				"http.target": r.URL.RequestURI(),
+			},
+		},
+	}
+}
+
+// newTraceID returns a random, valid trace ID.
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		randomBytes(id[:])
+	}
+	return id
+}
+
+// newSpanID returns a random, valid span ID.
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		randomBytes(id[:])
+	}
+	return id
+}
+
+// randomBytes fills b with random bytes.
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// The system's secure random number generator is broken.
+		panic(err)
+	}
+}
+
+// InMemoryExporter is a SpanExporter that keeps exported spans in memory, so
+// that tests can check the spans of requests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewInMemoryExporter returns an empty InMemoryExporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpans implements SpanExporter.
+func (e *InMemoryExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans returns all spans exported so far, in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset removes all exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// WithTracing traces requests to the server's endpoints, exporting their spans
+// to the given exporter. See TracingMW.
+func WithTracing(exporter SpanExporter) Option {
+	return func(s *server) {
+		s.spanExporter = exporter
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestParseTraceparent(t *testing.T) {
+
+	tests := []struct {
+		Name            string
+		Traceparent     string
+		ExpectedOK      bool
+		ExpectedSampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version with more fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-cafe", true, true},
+		{"current version with more fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-cafe", false, false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"too short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			sc, ok := parseTraceparent(tt.Traceparent)
+			is.Equal(ok, tt.ExpectedOK) // traceparent validity is as expected.
+			if !ok {
+				return
+			}
+
+			is.Equal(sc.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736") // trace id is parsed.
+			is.Equal(sc.SpanID.String(), "00f067aa0ba902b7")                  // span id is parsed.
+			is.Equal(sc.Sampled, tt.ExpectedSampled)                          // sampled flag is parsed.
+			is.True(sc.Remote)                                                // span context is remote.
+		})
+	}
+}
+
+// tracedAPI returns an API whose endpoints record their log lines and errors.
+func tracedAPI(logger *zap.SugaredLogger) API {
+	return apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method: "GET",
+				Path:   "/teapots/:id",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					LoggerFromRequest(r, logger).Info("from handler")
+					Respond(w, r, http.StatusOK, nil)
+				}),
+			},
+			{
+				Method: "GET",
+				Path:   "/broken",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					SpanFromRequest(r).RecordError(errors.New("no tea"))
+					Error(w, r, "no tea", http.StatusInternalServerError)
+				}),
+			},
+			{
+				Method:          "GET",
+				Path:            "/untraced",
+				Handler:         http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				SuppressTracing: true,
+			},
+		}
+	})
+}
+
+func TestTracing(t *testing.T) {
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		Name               string
+		Path               string
+		Traceparent        string
+		Tracestate         string
+		ExpectedSpans      int
+		ExpectedName       string
+		ExpectedRemote     bool
+		ExpectedStatus     StatusCode
+		ExpectedStatusCode int
+		ExpectedEvents     int
+	}{
+		{
+			Name:               "new trace",
+			Path:               "/teapots/1",
+			ExpectedSpans:      1,
+			ExpectedName:       "GET /teapots/:id",
+			ExpectedStatus:     StatusUnset,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "continued trace",
+			Path:               "/teapots/1",
+			Traceparent:        traceparent,
+			Tracestate:         "kit=1",
+			ExpectedSpans:      1,
+			ExpectedName:       "GET /teapots/:id",
+			ExpectedRemote:     true,
+			ExpectedStatus:     StatusUnset,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "invalid traceparent starts new trace",
+			Path:               "/teapots/1",
+			Traceparent:        "00-not-a-trace",
+			Tracestate:         "kit=1",
+			ExpectedSpans:      1,
+			ExpectedName:       "GET /teapots/:id",
+			ExpectedStatus:     StatusUnset,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:          "unsampled trace is not exported",
+			Path:          "/teapots/1",
+			Traceparent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			ExpectedSpans: 0,
+		},
+		{
+			Name:               "server error",
+			Path:               "/broken",
+			ExpectedSpans:      1,
+			ExpectedName:       "GET /broken",
+			ExpectedStatus:     StatusError,
+			ExpectedStatusCode: http.StatusInternalServerError,
+			ExpectedEvents:     1,
+		},
+		{
+			Name:          "suppressed endpoint",
+			Path:          "/untraced",
+			ExpectedSpans: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger, and captured logs.
+			logger, logs := newTestLogger(zap.InfoLevel)
+
+			// Create a traced server.
+			exporter := NewInMemoryExporter()
+			srv := NewServer(":0", logger, tracedAPI(logger), WithRegisterer(prometheus.NewRegistry()), WithTracing(exporter))
+
+			r, err := http.NewRequest("GET", tt.Path, nil)
+			is.NoErr(err)
+			r.Header.Set("traceparent", tt.Traceparent)
+			r.Header.Set("tracestate", tt.Tracestate)
+
+			srv.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			spans := exporter.Spans()
+			is.Equal(len(spans), tt.ExpectedSpans) // spans are exported as expected.
+			if tt.ExpectedSpans == 0 {
+				return
+			}
+
+			span := spans[0]
+			is.Equal(span.Name, tt.ExpectedName)                                   // span is named after the route.
+			is.True(span.SpanContext.IsValid())                                    // span has a valid context.
+			is.Equal(span.Parent.IsValid(), tt.ExpectedRemote)                     // span has a parent if continued.
+			is.Equal(span.Status, tt.ExpectedStatus)                               // span status is as expected.
+			is.Equal(span.Attributes["http.status_code"], tt.ExpectedStatusCode)   // span records the status code.
+			is.Equal(span.Attributes["http.route"], tt.ExpectedName[len("GET "):]) // span records the route.
+			is.Equal(len(span.Events), tt.ExpectedEvents)                          // span records errors.
+			is.True(!span.EndTime.Before(span.StartTime))                          // span ends after it starts.
+
+			if tt.ExpectedRemote {
+				is.Equal(span.SpanContext.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736") // trace is continued.
+				is.Equal(span.Parent.SpanID.String(), "00f067aa0ba902b7")                       // parent is the caller's span.
+				is.Equal(span.SpanContext.TraceState, "kit=1")                                  // trace state is kept.
+			} else {
+				is.Equal(span.SpanContext.TraceState, "") // trace state is dropped without a valid parent.
+			}
+
+			// Check that log lines can be correlated with the span.
+			for _, ll := range logs.All() {
+				is.Equal(ll.ContextMap()["trace_id"], span.SpanContext.TraceID.String()) // log line has the trace id.
+				is.Equal(ll.ContextMap()["span_id"], span.SpanContext.SpanID.String())   // log line has the span id.
+			}
+		})
+	}
+}
+
+func TestUntracedRequestLogs(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	// Create a dummy request, which isn't traced.
+	r, err := newTestRequest("GET", "/status", nil, "/:path")
+	is.NoErr(err)
+
+	LoggerFromRequest(r, logger).Info("message")
+
+	_, ok := logs.All()[0].ContextMap()["trace_id"]
+	is.True(!ok)                       // log line has no trace id.
+	is.True(SpanFromRequest(r) == nil) // request has no span.
+}
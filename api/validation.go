@@ -0,0 +1,489 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Validator can be implemented by values decoded by DecodeAndValidate, to
+// validate them beyond what struct tags allow. Returning InvalidParams reports
+// each invalid field, any other error is reported against the whole value.
+type Validator interface {
+	Validate() error
+}
+
+// InvalidParam describes a single invalid field of a request body, as included
+// in the 'invalid-params' field of validation problem responses.
+type InvalidParam struct {
+	// The name of the field, i.e. 'cups[0].name'.
+	Name string `json:"name"`
+	// Why the field is invalid.
+	Reason string `json:"reason"`
+	// A JSON Pointer (RFC 6901) to the field within the request body, i.e. '/cups/0/name'.
+	Pointer string `json:"pointer"`
+}
+
+// InvalidParams is an error describing all of the invalid fields of a request body.
+type InvalidParams []InvalidParam
+
+// Error implements error.
+func (p InvalidParams) Error() string {
+	reasons := make([]string, 0, len(p))
+	for _, ip := range p {
+		reasons = append(reasons, fmt.Sprintf("%s %s", ip.Name, ip.Reason))
+	}
+	return "invalid params: " + strings.Join(reasons, "; ")
+}
+
+// DecodeOption is a function that can be passed to DecodeAndValidate to make
+// decoding stricter.
+type DecodeOption func(*decodeConfig)
+
+// decodeConfig holds the configuration of DecodeAndValidate.
+type decodeConfig struct {
+	disallowUnknownFields bool
+	disallowTrailingData  bool
+}
+
+// DisallowUnknownFields causes JSON request bodies that contain fields which
+// don't exist in the decoded value to be rejected.
+func DisallowUnknownFields() DecodeOption {
+	return func(c *decodeConfig) {
+		c.disallowUnknownFields = true
+	}
+}
+
+// DisallowTrailingData causes JSON request bodies that contain more data after
+// the decoded value to be rejected.
+func DisallowTrailingData() DecodeOption {
+	return func(c *decodeConfig) {
+		c.disallowTrailingData = true
+	}
+}
+
+// DecodeAndValidate decodes the request's body into v, in the same way as
+// Decode, and then validates it using the 'validate' struct tags of v, and its
+// Validate method if it implements Validator.
+//
+// The supported tags are 'required', 'min=n' and 'max=n' (bounding numbers, or
+// the length of strings, slices and maps), 'enum=a|b|c' and 'regex=pattern',
+// which must be last, i.e. `validate:"required,max=10,regex=^[a-z]+$"`. Nested
+// structs, and structs within slices and maps, are validated too.
+//
+// If decoding or validation fails, a 400 Bad Request problem, with an
+// 'invalid-params' field describing each invalid field, is responded with and
+// the error is returned, in which case the handler should not respond. Bodies
+// exceeding the server's limits are rejected in the same way as by Decode.
+func DecodeAndValidate(w http.ResponseWriter, r *http.Request, v interface{}, opts ...DecodeOption) error {
+
+	var cfg decodeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	codec, err := requestCodec(w, r)
+	if err != nil {
+		return err
+	}
+
+	// The strict options are only supported for JSON bodies.
+	body := requestBody(r)
+	if _, ok := codec.(JSONCodec); ok {
+		err = decodeJSON(body, v, cfg)
+	} else {
+		err = codec.Decode(body, v)
+	}
+	if rerr := rejectBody(w, r, err); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		respondDecodeError(w, r, err)
+		return err
+	}
+
+	params, err := validate(v)
+	if err != nil {
+		// The struct tags are invalid, which isn't the client's fault.
+		Error(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return err
+	}
+	if len(params) > 0 {
+		respondInvalidParams(w, r, "Request body is invalid", params)
+		return params
+	}
+
+	return nil
+}
+
+// decodeJSON decodes the JSON body read from r into v, as configured.
+func decodeJSON(r io.Reader, v interface{}, cfg decodeConfig) error {
+	d := json.NewDecoder(r)
+	if cfg.disallowUnknownFields {
+		d.DisallowUnknownFields()
+	}
+
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+
+	if cfg.disallowTrailingData {
+		if _, err := d.Token(); err != io.EOF {
+			return errTrailingData
+		}
+	}
+
+	return nil
+}
+
+// errTrailingData is returned when a request body has data after the decoded value.
+var errTrailingData = errors.New("api: request body must only contain a single value")
+
+// respondDecodeError responds with a 400 Bad Request problem describing why the
+// request body could not be decoded.
+func respondDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		respondInvalidParams(w, r, "Request body is invalid", InvalidParams{{
+			Name:    typeErr.Field,
+			Reason:  fmt.Sprintf("must be of type %s", typeErr.Type),
+			Pointer: "/" + strings.Replace(typeErr.Field, ".", "/", -1),
+		}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields, so the field name is
+		// taken from the message.
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		respondInvalidParams(w, r, "Request body is invalid", InvalidParams{{
+			Name:    name,
+			Reason:  "is not allowed",
+			Pointer: "/" + name,
+		}})
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		Error(w, r, "Request body is malformed", http.StatusBadRequest)
+	case errors.Is(err, io.EOF):
+		Error(w, r, "Request body must not be empty", http.StatusBadRequest)
+	case errors.Is(err, errTrailingData):
+		Error(w, r, "Request body must only contain a single value", http.StatusBadRequest)
+	default:
+		Error(w, r, "Request body could not be decoded", http.StatusBadRequest)
+	}
+}
+
+// respondInvalidParams responds with a 400 Bad Request problem, that includes
+// the given invalid params.
+func respondInvalidParams(w http.ResponseWriter, r *http.Request, detail string, params InvalidParams) {
+	Error(w, r, detail, http.StatusBadRequest, WithFields(map[string]interface{}{
+		"invalid-params": params,
+	}))
+}
+
+//
+// Validation
+//
+
+// validate validates v, returning the invalid params found. An error is
+// returned if v's struct tags are invalid.
+func validate(v interface{}) (InvalidParams, error) {
+	var params InvalidParams
+	err := validateValue(reflect.ValueOf(v), "", "", &params)
+	return params, err
+}
+
+// validatorType is the reflect.Type of the Validator interface.
+var validatorType = reflect.TypeOf((*Validator)(nil)).Elem()
+
+// validateValue validates the value rv, found at the field with the given name
+// and JSON pointer, adding any invalid params found to params.
+func validateValue(rv reflect.Value, name, pointer string, params *InvalidParams) error {
+
+	// Call Validate on the value, if implemented.
+	validated := false
+	if rv.IsValid() && rv.Type().Implements(validatorType) && !(rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		validated = true
+		if err := rv.Interface().(Validator).Validate(); err != nil {
+			addValidatorError(err, name, pointer, params)
+		}
+	}
+
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		// Call Validate on the struct's pointer, if the method has a pointer receiver.
+		if !validated && rv.CanAddr() && rv.Addr().Type().Implements(validatorType) {
+			if err := rv.Addr().Interface().(Validator).Validate(); err != nil {
+				addValidatorError(err, name, pointer, params)
+			}
+		}
+		return validateStruct(rv, name, pointer, params)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			err := validateValue(rv.Index(i), fmt.Sprintf("%s[%d]", name, i), fmt.Sprintf("%s/%d", pointer, i), params)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range rv.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			err := validateValue(rv.MapIndex(k), joinName(name, key), pointer+"/"+escapePointer(key), params)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateStruct validates the fields of the struct value rv.
+func validateStruct(rv reflect.Value, name, pointer string, params *InvalidParams) error {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		fname, _ := parseTag(sf.Tag.Get("json"))
+		if fname == "-" {
+			continue
+		}
+		if fname == "" {
+			fname = sf.Name
+		}
+
+		f := rv.Field(i)
+
+		// Fields of embedded structs without a name are promoted.
+		fieldName, fieldPointer := joinName(name, fname), pointer+"/"+escapePointer(fname)
+		if sf.Anonymous && sf.Tag.Get("json") == "" {
+			fieldName, fieldPointer = name, pointer
+		}
+
+		if tag := sf.Tag.Get("validate"); tag != "" {
+			reason, err := checkRules(f, tag)
+			if err != nil {
+				return fmt.Errorf("api: invalid validate tag on %s.%s: %w", t.Name(), sf.Name, err)
+			}
+			if reason != "" {
+				*params = append(*params, InvalidParam{Name: fieldName, Reason: reason, Pointer: fieldPointer})
+				// Don't validate the contents of an invalid field.
+				continue
+			}
+		}
+
+		if err := validateValue(f, fieldName, fieldPointer, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRules checks the value f against the rules of the given validate tag,
+// returning the reason the first failing rule fails, or an empty string if all
+// pass.
+func checkRules(f reflect.Value, tag string) (string, error) {
+
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regex=") {
+			// The pattern may contain commas, so takes the rest of the tag.
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+
+		key, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			key, arg = rule[:i], rule[i+1:]
+		}
+
+		isZero := isZeroValue(f)
+
+		switch key {
+		case "required":
+			if isZero {
+				return "is required", nil
+			}
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return "", fmt.Errorf("%s must be a number: %w", key, err)
+			}
+			if isZero && !isNumber(f) {
+				// Missing optional values are not bounded.
+				continue
+			}
+			if reason := checkBound(f, key, n); reason != "" {
+				return reason, nil
+			}
+		case "enum":
+			if isZero {
+				continue
+			}
+			allowed := strings.Split(arg, "|")
+			value := fmt.Sprint(reflect.Indirect(f).Interface())
+			if !contains(allowed, value) {
+				return fmt.Sprintf("must be one of: %s", strings.Join(allowed, ", ")), nil
+			}
+		case "regex":
+			re, err := compileRegex(arg)
+			if err != nil {
+				return "", err
+			}
+			if isZero {
+				continue
+			}
+			s := reflect.Indirect(f)
+			if s.Kind() != reflect.String {
+				return "", fmt.Errorf("regex can only validate strings, not %s", s.Kind())
+			}
+			if !re.MatchString(s.String()) {
+				return fmt.Sprintf("must match %s", arg), nil
+			}
+		default:
+			return "", fmt.Errorf("unknown rule %q", key)
+		}
+	}
+
+	return "", nil
+}
+
+// checkBound checks the value f against the min or max bound n, returning the
+// reason it fails if it does.
+func checkBound(f reflect.Value, key string, n float64) string {
+	f = reflect.Indirect(f)
+
+	var actual float64
+	var unit string
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		actual = float64(f.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		actual = float64(f.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = f.Float()
+	case reflect.String:
+		actual, unit = float64(utf8.RuneCountInString(f.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		actual, unit = float64(f.Len()), " items"
+	default:
+		return ""
+	}
+
+	bound := strconv.FormatFloat(n, 'f', -1, 64)
+	if key == "min" && actual < n {
+		if unit != "" {
+			return fmt.Sprintf("must have at least %s%s", bound, unit)
+		}
+		return fmt.Sprintf("must be at least %s", bound)
+	}
+	if key == "max" && actual > n {
+		if unit != "" {
+			return fmt.Sprintf("must have at most %s%s", bound, unit)
+		}
+		return fmt.Sprintf("must be at most %s", bound)
+	}
+	return ""
+}
+
+// regexes caches compiled patterns from validate tags.
+var regexes sync.Map
+
+// compileRegex returns the compiled pattern, compiling it on first use.
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexes.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexes.Store(pattern, re)
+	return re, nil
+}
+
+// addValidatorError adds the error returned by a Validate method, for the value
+// at the given name and pointer, to params.
+func addValidatorError(err error, name, pointer string, params *InvalidParams) {
+	var ips InvalidParams
+	if errors.As(err, &ips) {
+		// Field names and pointers are relative to the validated value.
+		for _, ip := range ips {
+			*params = append(*params, InvalidParam{
+				Name:    joinName(name, ip.Name),
+				Reason:  ip.Reason,
+				Pointer: pointer + ip.Pointer,
+			})
+		}
+		return
+	}
+	*params = append(*params, InvalidParam{Name: name, Reason: err.Error(), Pointer: pointer})
+}
+
+// isZeroValue reports whether f is the zero value of its type, or an empty
+// slice or map.
+func isZeroValue(f reflect.Value) bool {
+	switch f.Kind() {
+	case reflect.Slice, reflect.Map:
+		return f.Len() == 0
+	}
+	return f.IsZero()
+}
+
+// isNumber reports whether f, or the value it points to, is a number.
+func isNumber(f reflect.Value) bool {
+	switch reflect.Indirect(f).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// joinName joins a field name onto the name of its parent.
+func joinName(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	if name == "" {
+		return parent
+	}
+	return parent + "." + name
+}
+
+// escapePointer escapes a reference token of a JSON Pointer, as defined by RFC 6901.
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// contains reports whether s is within the given values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+type cup struct {
+	Size string `json:"size" validate:"required,enum=small|medium|large"`
+}
+
+type order struct {
+	Name   string            `json:"name" validate:"required,max=10,regex=^[a-z ,]+$"`
+	Cups   []cup             `json:"cups" validate:"min=1,max=3"`
+	Sugar  int               `json:"sugar" validate:"max=5"`
+	Milk   *float64          `json:"milk,omitempty" validate:"min=0.5"`
+	Extras map[string]cup    `json:"extras,omitempty"`
+	Notes  map[string]string `json:"notes,omitempty" validate:"max=1"`
+}
+
+// Validate implements Validator.
+func (o *order) Validate() error {
+	if o.Sugar > 0 && o.Milk == nil {
+		return InvalidParams{{Name: "sugar", Reason: "requires milk", Pointer: "/sugar"}}
+	}
+	return nil
+}
+
+func TestDecodeAndValidate(t *testing.T) {
+
+	tests := []struct {
+		Name           string
+		Body           string
+		Opts           []DecodeOption
+		ExpectedCode   int
+		ExpectedDetail string
+		ExpectedParams []InvalidParam
+	}{
+		{
+			Name:         "valid",
+			Body:         `{"name": "earl grey", "cups": [{"size": "small"}], "milk": 1, "sugar": 1}`,
+			ExpectedCode: 0,
+		},
+		{
+			Name:           "missing required fields",
+			Body:           `{"cups": [{}]}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "name", Reason: "is required", Pointer: "/name"},
+				{Name: "cups[0].size", Reason: "is required", Pointer: "/cups/0/size"},
+			},
+		},
+		{
+			Name:           "bounds, enums and patterns",
+			Body:           `{"name": "Earl Grey Tea", "cups": [{"size": "huge"}, {"size": "small"}], "milk": 0.1, "notes": {"a": "b", "c": "d"}}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "name", Reason: "must have at most 10 characters", Pointer: "/name"},
+				{Name: "cups[0].size", Reason: "must be one of: small, medium, large", Pointer: "/cups/0/size"},
+				{Name: "milk", Reason: "must be at least 0.5", Pointer: "/milk"},
+				{Name: "notes", Reason: "must have at most 1 items", Pointer: "/notes"},
+			},
+		},
+		{
+			Name:           "regex with comma",
+			Body:           `{"name": "EARL", "cups": [{"size": "small"}]}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "name", Reason: "must match ^[a-z ,]+$", Pointer: "/name"},
+			},
+		},
+		{
+			Name:           "nested maps",
+			Body:           `{"name": "earl grey", "cups": [{"size": "small"}], "extras": {"x/y": {}}}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "extras.x/y.size", Reason: "is required", Pointer: "/extras/x~1y/size"},
+			},
+		},
+		{
+			Name:           "validate method",
+			Body:           `{"name": "earl grey", "cups": [{"size": "small"}], "sugar": 2}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "sugar", Reason: "requires milk", Pointer: "/sugar"},
+			},
+		},
+		{
+			Name:           "wrong type",
+			Body:           `{"name": 1}`,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "name", Reason: "must be of type string", Pointer: "/name"},
+			},
+		},
+		{
+			Name:           "malformed",
+			Body:           `{"name": `,
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is malformed",
+		},
+		{
+			Name:           "unknown fields rejected",
+			Body:           `{"name": "earl grey", "cups": [{"size": "small"}], "lemon": true}`,
+			Opts:           []DecodeOption{DisallowUnknownFields()},
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body is invalid",
+			ExpectedParams: []InvalidParam{
+				{Name: "lemon", Reason: "is not allowed", Pointer: "/lemon"},
+			},
+		},
+		{
+			Name:         "unknown fields allowed",
+			Body:         `{"name": "earl grey", "cups": [{"size": "small"}], "lemon": true}`,
+			ExpectedCode: 0,
+		},
+		{
+			Name:           "trailing data rejected",
+			Body:           `{"name": "earl grey", "cups": [{"size": "small"}]} {}`,
+			Opts:           []DecodeOption{DisallowTrailingData()},
+			ExpectedCode:   http.StatusBadRequest,
+			ExpectedDetail: "Request body must only contain a single value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create a dummy request.
+			r, err := newTestRequest("POST", "/orders", strings.NewReader(tt.Body), "/orders")
+			is.NoErr(err)
+
+			// Create a response recorder, which satisfies http.ResponseWriter, to record the response.
+			rr := httptest.NewRecorder()
+
+			var o order
+			err = DecodeAndValidate(rr, r, &o, tt.Opts...)
+
+			if tt.ExpectedCode == 0 {
+				is.NoErr(err)              // body is valid.
+				is.Equal(rr.Body.Len(), 0) // nothing is responded.
+				return
+			}
+
+			is.True(err != nil)                                                   // body is invalid.
+			is.Equal(rr.Code, tt.ExpectedCode)                                    // response code is as expected.
+			is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+
+			var body struct {
+				Detail        string         `json:"detail"`
+				InvalidParams []InvalidParam `json:"invalid-params"`
+			}
+			is.NoErr(json.Unmarshal(rr.Body.Bytes(), &body)) // body is json.
+			is.Equal(body.Detail, tt.ExpectedDetail)         // detail is as expected.
+			is.Equal(body.InvalidParams, tt.ExpectedParams)  // invalid params are as expected.
+		})
+	}
+}
+
+func TestValidateInvalidTag(t *testing.T) {
+
+	is := is.New(t)
+
+	type bad struct {
+		Name string `json:"name" validate:"sometimes"`
+	}
+
+	_, err := validate(&bad{})
+	is.True(err != nil) // unknown rules are reported.
+
+	var ips InvalidParams
+	is.True(!errors.As(err, &ips)) // error is not a validation failure.
+}
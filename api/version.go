@@ -0,0 +1,219 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimfeld/httptreemux/v5"
+)
+
+// VersioningStrategy is how a request chooses the version of an endpoint it
+// is for.
+type VersioningStrategy int
+
+// Ways of choosing versions.
+const (
+	// PathVersioning serves each version of an endpoint under its own path
+	// prefix, i.e. '/v2/items'.
+	PathVersioning VersioningStrategy = iota
+	// MediaTypeVersioning chooses the version by the 'version' parameter of the
+	// request's 'Accept' header, i.e. 'application/vnd.x+json;version=2'.
+	MediaTypeVersioning
+	// HeaderVersioning chooses the version by a request header, i.e.
+	// 'API-Version: 2'.
+	HeaderVersioning
+)
+
+// Versioning is how a server routes requests to the versions of its
+// endpoints, as set by their Version.
+type Versioning struct {
+	// Strategy is how requests choose a version. By default, PathVersioning.
+	Strategy VersioningStrategy
+	// PathFormat formats an endpoint's version as its path prefix, when using
+	// PathVersioning. By default, '/v%s'.
+	PathFormat string
+	// Header is the request header the version is read from, when using
+	// HeaderVersioning. By default, 'API-Version'.
+	Header string
+	// Default is the version of requests that don't choose one, when using
+	// MediaTypeVersioning or HeaderVersioning. If there is no endpoint with the
+	// default version, requests that don't choose one are routed to the
+	// endpoint without a version, if any.
+	Default string
+}
+
+// Defaults of versioning.
+const (
+	defaultVersionPathFormat = "/v%s"
+	defaultVersionHeader     = "API-Version"
+)
+
+// Deprecation describes an endpoint that is deprecated, and so may be removed.
+// It is advertised in the 'Deprecation' and 'Sunset' headers of responses, as
+// defined by RFC 9745 and RFC 8594.
+type Deprecation struct {
+	// Date is when the endpoint was deprecated. If zero, the endpoint is
+	// advertised as deprecated without a date.
+	Date time.Time
+	// Sunset is when the endpoint is expected to be removed, if known.
+	Sunset time.Time
+	// Link is the URL of documentation about the deprecation, i.e. a migration
+	// guide, if any.
+	Link string
+}
+
+// DeprecationMW returns a middleware that advertises that an endpoint is
+// deprecated, as described by dep, in the headers of its responses.
+func DeprecationMW(dep Deprecation) Middleware {
+	deprecation := "true"
+	if !dep.Date.IsZero() {
+		deprecation = "@" + strconv.FormatInt(dep.Date.Unix(), 10)
+	}
+	var sunset string
+	if !dep.Sunset.IsZero() {
+		sunset = dep.Sunset.UTC().Format(http.TimeFormat)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Deprecation", deprecation)
+			if sunset != "" {
+				h.Set("Sunset", sunset)
+			}
+			if dep.Link != "" {
+				h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, dep.Link))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIVersion returns the version of the endpoint handling the request, or an
+// empty string if it isn't versioned.
+func APIVersion(r *http.Request) string {
+	d := getDetails(r)
+	if d == nil {
+		return ""
+	}
+	return d.apiVersion
+}
+
+// versionPath returns the path of the given version of an endpoint, when
+// using PathVersioning.
+func (v Versioning) versionPath(version, path string) string {
+	if version == "" {
+		return path
+	}
+	format := v.PathFormat
+	if format == "" {
+		format = defaultVersionPathFormat
+	}
+	return strings.TrimSuffix(fmt.Sprintf(format, version), "/") + path
+}
+
+// requested returns the version the request chose, if any.
+func (v Versioning) requested(r *http.Request) (string, bool) {
+	switch v.Strategy {
+	case MediaTypeVersioning:
+		for _, ar := range parseAccept(r.Header.Get("Accept")) {
+			if ar.q <= 0 {
+				continue
+			}
+			if _, params, err := mime.ParseMediaType(ar.raw); err == nil && params["version"] != "" {
+				return params["version"], true
+			}
+		}
+	case HeaderVersioning:
+		header := v.Header
+		if header == "" {
+			header = defaultVersionHeader
+		}
+		if version := strings.TrimSpace(r.Header.Get(header)); version != "" {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// versionedRoute is the handlers of each version of an endpoint, registered
+// under the same method and path.
+type versionedRoute struct {
+	method   string
+	path     string
+	handlers map[string]httptreemux.HandlerFunc
+	// unsupported responds to requests for versions that don't exist, observed
+	// by the same middleware as the endpoint.
+	unsupported httptreemux.HandlerFunc
+}
+
+// dispatch returns a handler that routes requests to the handler of the
+// version they chose. Requests for versions that don't exist are responded to
+// with a problem. CORS preflight requests can't choose a version, so are
+// routed to any version, as each version shares the endpoint's CORS policy.
+func (v Versioning) dispatch(route *versionedRoute) httptreemux.HandlerFunc {
+
+	// The version preflight requests are routed to, if they don't choose one.
+	var preflight string
+	if route.method == http.MethodOptions {
+		versions := make([]string, 0, len(route.handlers))
+		for version := range route.handlers {
+			versions = append(versions, version)
+		}
+		sort.Strings(versions)
+		preflight = versions[0]
+		if _, ok := route.handlers[v.Default]; ok {
+			preflight = v.Default
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		version, ok := v.requested(r)
+		if !ok {
+			version = v.Default
+		}
+
+		h, found := route.handlers[version]
+		if !found && !ok {
+			h, found = route.handlers[""]
+		}
+		if !found && !ok && route.method == http.MethodOptions {
+			h, found = route.handlers[preflight]
+		}
+		if !found {
+			route.unsupported(w, r, params)
+			return
+		}
+
+		h(w, r, params)
+	}
+}
+
+// unsupported returns a handler that responds to requests for versions of the
+// endpoint with the given method and path that don't exist with a problem.
+func (v Versioning) unsupported(method, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, ok := v.requested(r)
+		if !ok {
+			version = v.Default
+		}
+		status := http.StatusBadRequest
+		if v.Strategy == MediaTypeVersioning {
+			status = http.StatusNotAcceptable
+		}
+		Error(w, r, fmt.Sprintf("Version %q of %s %s is not supported", version, method, path), status)
+	})
+}
+
+// WithVersioning sets how the server routes requests to the versions of its
+// endpoints. By default, PathVersioning is used.
+func WithVersioning(v Versioning) Option {
+	return func(s *server) {
+		s.versioning = v
+	}
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// versionedAPI returns an API with two versions of an endpoint, the first of
+// which is deprecated, and an unversioned endpoint.
+func versionedAPI() API {
+	h := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Respond(w, r, http.StatusOK, map[string]string{"body": body, "version": APIVersion(r)})
+		})
+	}
+	return apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{
+				Method:  "GET",
+				Path:    "/items",
+				Handler: h("old"),
+				Version: "1",
+				Deprecation: &Deprecation{
+					Date:   time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					Sunset: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+					Link:   "https://example.com/migrate",
+				},
+			},
+			{Method: "GET", Path: "/items", Handler: h("new"), Version: "2"},
+			{Method: "GET", Path: "/status", Handler: h("status")},
+		}
+	})
+}
+
+func TestPathVersioning(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	reg := prometheus.NewRegistry()
+	srv := NewServer(":0", logger, versionedAPI(), WithRegisterer(reg))
+
+	// do makes a GET request to the given path.
+	do := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	rr := do("/v1/items")
+	is.Equal(rr.Body.String(), `{"body":"old","version":"1"}`)                            // first version is served under its prefix.
+	is.Equal(rr.Header().Get("Deprecation"), "@1609459200")                               // deprecation date is advertised.
+	is.Equal(rr.Header().Get("Sunset"), "Tue, 01 Jun 2021 00:00:00 GMT")                  // sunset is advertised.
+	is.Equal(rr.Header().Get("Link"), `<https://example.com/migrate>; rel="deprecation"`) // deprecation documentation is linked.
+
+	rr = do("/v2/items")
+	is.Equal(rr.Body.String(), `{"body":"new","version":"2"}`) // second version is served under its prefix.
+	is.Equal(rr.Header().Get("Deprecation"), "")               // second version isn't deprecated.
+
+	rr = do("/items")
+	is.Equal(rr.Code, http.StatusNotFound) // versioned endpoints are only served under their prefix.
+
+	rr = do("/status")
+	is.Equal(rr.Body.String(), `{"body":"status","version":""}`) // unversioned endpoints are served as is.
+
+	// Check logs and metrics are labelled by version.
+	is.Equal(logs.FilterMessage("request").All()[0].ContextMap()["version"], "1") // version is logged.
+	_, ok := logs.FilterMessage("request").All()[2].ContextMap()["version"]
+	is.True(!ok) // unversioned requests have no version.
+
+	mfs, err := reg.Gather()
+	is.NoErr(err)
+	observed := map[string]uint64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["status"] == "2XX" {
+				observed[labels["path"]+" "+labels["version"]] = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	is.Equal(observed, map[string]uint64{"/v1/items 1": 1, "/v2/items 2": 1, "/status ": 1}) // requests are observed by version.
+
+	routes := Routes(srv.Handler)
+	is.Equal(routes[1].Path, "/v1/items") // route table lists the full path.
+	is.Equal(routes[1].Version, "1")      // route table lists the version.
+}
+
+func TestNegotiatedVersioning(t *testing.T) {
+
+	tests := []struct {
+		Name         string
+		Versioning   Versioning
+		Headers      map[string]string
+		ExpectedCode int
+		ExpectedBody string
+		ExpectedType string
+	}{
+		{
+			Name:         "header",
+			Versioning:   Versioning{Strategy: HeaderVersioning},
+			Headers:      map[string]string{"API-Version": "1"},
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"body":"old","version":"1"}`,
+		},
+		{
+			Name:         "custom header",
+			Versioning:   Versioning{Strategy: HeaderVersioning, Header: "X-Version"},
+			Headers:      map[string]string{"X-Version": "2"},
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"body":"new","version":"2"}`,
+		},
+		{
+			Name:         "default",
+			Versioning:   Versioning{Strategy: HeaderVersioning, Default: "2"},
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"body":"new","version":"2"}`,
+		},
+		{
+			Name:         "no default",
+			Versioning:   Versioning{Strategy: HeaderVersioning},
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Name:         "unsupported header",
+			Versioning:   Versioning{Strategy: HeaderVersioning},
+			Headers:      map[string]string{"API-Version": "3"},
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Name:         "media type",
+			Versioning:   Versioning{Strategy: MediaTypeVersioning},
+			Headers:      map[string]string{"Accept": "application/vnd.x+json;version=2"},
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"body":"new","version":"2"}`,
+			ExpectedType: "application/vnd.x+json; version=2",
+		},
+		{
+			Name:         "preferred media type",
+			Versioning:   Versioning{Strategy: MediaTypeVersioning},
+			Headers:      map[string]string{"Accept": "application/vnd.x+json;version=2;q=0.5, application/vnd.x+json;version=1"},
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"body":"old","version":"1"}`,
+			ExpectedType: "application/vnd.x+json; version=1",
+		},
+		{
+			Name:         "unsupported media type",
+			Versioning:   Versioning{Strategy: MediaTypeVersioning},
+			Headers:      map[string]string{"Accept": "application/vnd.x+json;version=3"},
+			ExpectedCode: http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Create logger.
+			logger, _ := newTestLogger(zap.InfoLevel)
+
+			srv := NewServer(":0", logger, versionedAPI(), WithRegisterer(prometheus.NewRegistry()), WithVersioning(tt.Versioning))
+
+			r := httptest.NewRequest("GET", "/items", nil)
+			for k, v := range tt.Headers {
+				r.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, r)
+
+			is.Equal(rr.Code, tt.ExpectedCode) // response code is as expected.
+			if tt.ExpectedBody != "" {
+				is.Equal(rr.Body.String(), tt.ExpectedBody) // version is routed to.
+			} else {
+				is.Equal(rr.Header().Get("Content-Type"), "application/problem+json") // problem is responded with.
+			}
+			if tt.ExpectedType != "" {
+				is.Equal(rr.Header().Get("Content-Type"), tt.ExpectedType) // media type is echoed.
+			}
+
+			rr = httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/status", nil))
+			is.Equal(rr.Code, http.StatusOK) // unversioned endpoints are served regardless.
+		})
+	}
+}
+
+func TestVersioningPreflight(t *testing.T) {
+
+	is := is.New(t)
+
+	// Create logger, and captured logs.
+	logger, logs := newTestLogger(zap.InfoLevel)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, r, http.StatusOK, nil)
+	})
+
+	srv := NewServer(":0", logger, apiFunc(func() []Endpoint {
+		return []Endpoint{
+			{Method: "GET", Path: "/items", Handler: h, Version: "1", CorsMiddleware: AllowAllCorsMW()},
+			{Method: "GET", Path: "/items", Handler: h, Version: "2", CorsMiddleware: AllowAllCorsMW()},
+		}
+	}), WithRegisterer(prometheus.NewRegistry()), WithVersioning(Versioning{Strategy: HeaderVersioning}))
+
+	r := httptest.NewRequest("OPTIONS", "/items", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "API-Version")
+	rr := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.True(rr.Code < 300)                                        // preflight succeeds without a version.
+	is.Equal(rr.Header().Get("Access-Control-Allow-Origin"), "*") // preflight is answered by the cors policy.
+
+	r = httptest.NewRequest("GET", "/items", nil)
+	r.Header.Set("API-Version", "3")
+	rr = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rr, r)
+	is.Equal(rr.Code, http.StatusBadRequest)       // unsupported versions are rejected.
+	is.True(rr.Header().Get("X-Request-ID") != "") // rejections have a request id.
+	ll := logs.FilterMessage("request").All()
+	is.Equal(ll[len(ll)-1].ContextMap()["status"], int64(400)) // rejections are logged.
+}